@@ -2,8 +2,11 @@ package asmgenerator
 
 import (
 	"compiler/ir"
+	"compiler/utils"
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -31,16 +34,54 @@ const (
 	Deref
 	New
 	Delete
+	NewArray
+	Element
+	CBool
+	UnsignedAdd
+	UnsignedSub
+	UnsignedMul
+	UnsignedDiv
+	UnsignedMod
+	UnsignedGT
+	UnsignedGTE
+	UnsignedLT
+	UnsignedLTE
+	Extend
 )
 
 type Symbol struct {
 	op    Op
 	value string
+	// extend is the instruction of Extend that sign or zero extends %eax,
+	// %ax or %al to %rax
+	extend string
 }
 
 type Locals struct {
 	varToLocation map[ir.IRVar]string
 	stackUsed     int
+	funcName      string
+	trapCount     int
+	locationCount int
+	stringCount   int
+	divisionCount int
+	tableCount    int
+	opts          Options
+}
+
+// Options controls optional code generation features.
+type Options struct {
+	// CheckOverflow makes + - * and unary - trap on signed overflow.
+	CheckOverflow bool
+	// PIC generates position independent code: calls go through the PLT.
+	// Data is always addressed relative to %rip.
+	PIC bool
+	// Library keeps main local so the output can be linked into programs
+	// that define their own main.
+	Library bool
+	// GC enables the stdlib garbage collector by recording the frame of
+	// main as the end of the stack scanned for heap pointers.
+	GC bool
 }
 
 func collectAllVars(instructions []ir.Instruction) []ir.IRVar {
@@ -61,20 +102,125 @@ func collectAllVars(instructions []ir.Instruction) []ir.IRVar {
 }
 
 func GenerateASM(funcMap map[string][]ir.Instruction) string {
+	return GenerateASMWithOptions(funcMap, Options{})
+}
+
+func GenerateASMWithOptions(funcMap map[string][]ir.Instruction, opts Options) string {
 	var lines []string
 	emit := func(s string) { lines = append(lines, s) }
 
-	emit(".extern print_int\n.extern print_bool\n.extern read_int\n.section .text\n\n")
+	// Number the source files so instructions can refer to them in .loc
+	files := collectSourceFiles(funcMap)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(a, b int) bool { return files[names[a]] < files[names[b]] })
+	for _, name := range names {
+		emit(fmt.Sprintf(".file %d %s", files[name], strconv.Quote(name)))
+	}
+
+	emit(".extern print_int\n.extern print_bool\n.extern read_int\n.extern print_string\n.extern concat\n.extern __string_equals\n.extern __runtime_error\n.extern __alloc\n.extern __free\n.extern __alloc_array\n.extern gc_collect\n.section .text\n\n")
 
 	// Generate code for each function
 	for funcName, instructions := range funcMap {
-		lines = append(lines, generateFunction(funcName, instructions)...)
+		lines = append(lines, generateFunction(funcName, instructions, files, opts)...)
 	}
 
+	// Globals are zeroed until main assigns them. With --gc main records
+	// where they are, as the collector scans them for heap pointers.
+	emit(".section .bss")
+	emit(".balign 8")
+	emit(".Lglobals_start:")
+	for _, global := range collectGlobals(funcMap) {
+		emit(fmt.Sprintf("%s:", global))
+		emit(".zero 8")
+	}
+	emit(".Lglobals_end:")
+
+	// The generated code never needs an executable stack
+	emit(".section .note.GNU-stack,\"\",@progbits")
+
 	return strings.Join(lines, "\n")
 }
 
-func generateFunction(funcName string, instructions []ir.Instruction) []string {
+// collectGlobals returns the global variables used by any function, sorted.
+func collectGlobals(funcMap map[string][]ir.Instruction) []ir.IRVar {
+	var globals []ir.IRVar
+	seen := make(map[ir.IRVar]void)
+	for _, instructions := range funcMap {
+		for _, v := range collectAllVars(instructions) {
+			if _, ok := seen[v]; !ok && ir.IsGlobal(v) {
+				seen[v] = member
+				globals = append(globals, v)
+			}
+		}
+	}
+	sort.Strings(globals)
+	return globals
+}
+
+// collectSourceFiles assigns a DWARF file number to every source file that
+// appears in the instruction locations.
+func collectSourceFiles(funcMap map[string][]ir.Instruction) map[string]int {
+	funcNames := make([]string, 0, len(funcMap))
+	for name := range funcMap {
+		funcNames = append(funcNames, name)
+	}
+	sort.Strings(funcNames)
+
+	files := make(map[string]int)
+	for _, name := range funcNames {
+		for _, ins := range funcMap[name] {
+			loc := instructionLocation(ins)
+			if loc.File == "" {
+				continue
+			}
+			if _, ok := files[loc.File]; !ok {
+				files[loc.File] = len(files) + 1
+			}
+		}
+	}
+	return files
+}
+
+func instructionLocation(ins ir.Instruction) ir.Location {
+	switch i := ins.(type) {
+	case ir.LoadBoolConst:
+		return i.Location
+	case ir.LoadIntConst:
+		return i.Location
+	case ir.LoadStringConst:
+		return i.Location
+	case ir.Copy:
+		return i.Location
+	case ir.Load:
+		return i.Location
+	case ir.Store:
+		return i.Location
+	case ir.Call:
+		return i.Location
+	case ir.CallClosure:
+		return i.Location
+	case ir.LoadFunction:
+		return i.Location
+	case ir.Jump:
+		return i.Location
+	case ir.CondJump:
+		return i.Location
+	case ir.JumpTable:
+		return i.Location
+	case ir.Return:
+		return i.Location
+	case ir.LoadParam:
+		return i.Location
+	case ir.Label:
+		return i.Location
+	}
+	return ir.Location{}
+}
+
+func generateFunction(funcName string, instructions []ir.Instruction, files map[string]int, opts Options) []string {
 	var lines []string
 	emit := func(s string) { lines = append(lines, s) }
 
@@ -82,11 +228,17 @@ func generateFunction(funcName string, instructions []ir.Instruction) []string {
 	locs := Locals{
 		varToLocation: make(map[ir.IRVar]string),
 		stackUsed:     0,
+		funcName:      funcName,
+		opts:          opts,
 	}
 
 	// Gather all variables and assign them stack locations
 	allVars := collectAllVars(instructions)
 	for _, v := range allVars {
+		if ir.IsGlobal(v) {
+			locs.varToLocation[v] = fmt.Sprintf("%s(%%rip)", v)
+			continue
+		}
 		locs.stackUsed++
 		offset := -8 * locs.stackUsed
 		locs.varToLocation[v] = fmt.Sprintf("%d(%%rbp)", offset)
@@ -100,18 +252,41 @@ func generateFunction(funcName string, instructions []ir.Instruction) []string {
 
 	unaryPrint := false
 
-	// Emit function prologue
-	emit(fmt.Sprintf(".global %s", funcName))
+	// Emit function prologue. The code of function values is only reached
+	// through closures and stays local, so leaq can take its address in
+	// position independent code.
+	if !(opts.Library && funcName == "main") && !strings.Contains(funcName, ".") {
+		emit(fmt.Sprintf(".global %s", funcName))
+	}
 	emit(fmt.Sprintf(".type %s, @function", funcName))
 	emit(fmt.Sprintf("%s:", funcName))
+	emit(".cfi_startproc")
 	for k, v := range locs.varToLocation {
 		emit(fmt.Sprintf("# %s in %s", k, v))
 	}
+	if len(instructions) > 0 {
+		emitLoc(emit, files, instructionLocation(instructions[0]))
+	}
 	emit("    pushq %rbp")
+	emit(".cfi_def_cfa_offset 16")
+	emit(".cfi_offset %rbp, -16")
 	emit("    movq %rsp, %rbp")
+	emit(".cfi_def_cfa_register %rbp")
 	emit(fmt.Sprintf("    subq $%d, %%rsp\n", stackFrameSize))
+	if opts.GC && !opts.Library && funcName == "main" {
+		emit("movq %rbp, __stack_base(%rip)")
+		emit("leaq .Lglobals_start(%rip), %rax")
+		emit("movq %rax, __globals_start(%rip)")
+		emit("leaq .Lglobals_end(%rip), %rax")
+		emit("movq %rax, __globals_end(%rip)\n")
+	}
 
+	var lastLoc ir.Location
 	for _, ins := range instructions {
+		if loc := instructionLocation(ins); loc.Line != 0 && loc != lastLoc {
+			emitLoc(emit, files, loc)
+			lastLoc = loc
+		}
 		switch i := ins.(type) {
 
 		case ir.LoadBoolConst:
@@ -126,13 +301,29 @@ func generateFunction(funcName string, instructions []ir.Instruction) []string {
 		case ir.LoadIntConst:
 			emit(fmt.Sprintf("# %s", i.String()))
 			loc := locs.varToLocation[i.Dest]
-			if i.Value > math.MaxUint32 {
-				emit(fmt.Sprintf("movabsq $%d, %%rax", i.Value))
+			// movq only takes a sign extended 32 bit immediate
+			if value := int64(i.Value); value < math.MinInt32 || value > math.MaxInt32 {
+				emit(fmt.Sprintf("movabsq $%d, %%rax", value))
 				emit(fmt.Sprintf("movq %%rax, %s\n", loc))
 			} else {
-				emit(fmt.Sprintf("movq $%d, %s\n", i.Value, loc))
+				emit(fmt.Sprintf("movq $%d, %s\n", value, loc))
 			}
 
+		case ir.LoadStringConst:
+			// The string is its length followed by its bytes, like the
+			// strings the stdlib makes
+			emit(fmt.Sprintf("# %s", i.String()))
+			locs.stringCount++
+			label := fmt.Sprintf(".%s_str_%d", funcName, locs.stringCount)
+			emit(".pushsection .rodata")
+			emit(".balign 8")
+			emit(fmt.Sprintf("%s:", label))
+			emit(fmt.Sprintf(".quad %d", len(i.Value)))
+			emit(fmt.Sprintf(".ascii \"%s\"", asciiEscape(i.Value)))
+			emit(".popsection")
+			emit(fmt.Sprintf("leaq %s(%%rip), %%rax", label))
+			emit(mov("%rax", locs.varToLocation[i.Dest]) + "\n")
+
 		case ir.Label:
 			if i.String() != "" {
 				emit(fmt.Sprintf(".%s_%s:\n", funcName, i.Label))
@@ -147,7 +338,7 @@ func generateFunction(funcName string, instructions []ir.Instruction) []string {
 				if unaryPrint {
 					emit("subq $8, %rsp")
 				}
-				lines = append(lines, generateCall(i.Fun, i.Args, &locs)...)
+				lines = append(lines, generateCall(i.Fun, i.Args, i.Location, &locs)...)
 				emit(mov("%rax", locs.varToLocation[i.Dest]))
 				if unaryPrint {
 					unaryPrint = false
@@ -155,18 +346,52 @@ func generateFunction(funcName string, instructions []ir.Instruction) []string {
 				}
 				emit("\n")
 			} else {
-				lines = append(lines, generateCall(i.Fun, i.Args, &locs)...)
+				lines = append(lines, generateCall(i.Fun, i.Args, i.Location, &locs)...)
 				emit(mov("%rax", locs.varToLocation[i.Dest]))
 				emit("\n")
 
 			}
 
+		case ir.CallClosure:
+			// The record goes first and its first word is the code
+			emit(fmt.Sprintf("# %s", i.String()))
+			paramRegs := []string{"%rsi", "%rdx", "%rcx", "%r8", "%r9"}
+			if len(i.Args) > len(paramRegs) {
+				panic("too many arguments for function call")
+			}
+			emit(mov(locs.varToLocation[i.Closure], "%rdi"))
+			for j, arg := range i.Args {
+				emit(mov(locs.varToLocation[arg], paramRegs[j]))
+			}
+			emit("xorq %rax, %rax")
+			emit("callq *(%rdi)")
+			emit(mov("%rax", locs.varToLocation[i.Dest]) + "\n")
+
+		case ir.LoadFunction:
+			emit(fmt.Sprintf("# %s", i.String()))
+			emit(fmt.Sprintf("leaq %s(%%rip), %%rax", i.Fun))
+			emit(mov("%rax", locs.varToLocation[i.Dest]) + "\n")
+
 		case ir.Copy:
 			emit(fmt.Sprintf("# %s", i.String()))
 			emit(mov(locs.varToLocation[i.Source], "%rax"))
 			emit(mov("%rax", locs.varToLocation[i.Dest]))
 			emit("\n")
 
+		case ir.Load:
+			emit(fmt.Sprintf("# %s", i.String()))
+			emit(mov(locs.varToLocation[i.Address], "%rax"))
+			emit(mov(fmt.Sprintf("%d(%%rax)", i.Offset), "%rax"))
+			emit(mov("%rax", locs.varToLocation[i.Dest]))
+			emit("\n")
+
+		case ir.Store:
+			emit(fmt.Sprintf("# %s", i.String()))
+			emit(mov(locs.varToLocation[i.Address], "%rax"))
+			emit(mov(locs.varToLocation[i.Value], "%rdx"))
+			emit(mov("%rdx", fmt.Sprintf("%d(%%rax)", i.Offset)))
+			emit("\n")
+
 		case ir.CondJump:
 			emit(fmt.Sprintf("# %s", i.String()))
 			emit(fmt.Sprintf("cmpq $0, %s", locs.varToLocation[i.Cond]))
@@ -177,6 +402,25 @@ func generateFunction(funcName string, instructions []ir.Instruction) []string {
 			emit(fmt.Sprintf("# %s", i.String()))
 			emit(fmt.Sprintf("jmp .%s_%s\n", funcName, i.Label.Label))
 
+		case ir.JumpTable:
+			// The table holds the offsets of the labels from the table
+			// itself, which keeps it position independent
+			emit(fmt.Sprintf("# %s", i.String()))
+			locs.tableCount++
+			table := fmt.Sprintf(".%s_table_%d", funcName, locs.tableCount)
+			emit(".pushsection .rodata")
+			emit(".balign 4")
+			emit(fmt.Sprintf("%s:", table))
+			for _, label := range i.Labels {
+				emit(fmt.Sprintf(".long .%s_%s - %s", funcName, label.Label, table))
+			}
+			emit(".popsection")
+			emit(mov(locs.varToLocation[i.Index], "%rax"))
+			emit(fmt.Sprintf("leaq %s(%%rip), %%rdx", table))
+			emit("movslq (%rdx,%rax,4), %rax")
+			emit("addq %rdx, %rax")
+			emit("jmp *%rax\n")
+
 		case ir.LoadParam:
 			emit(fmt.Sprintf("# %s", i.String()))
 			paramRegs := []string{"%rdi", "%rsi", "%rdx", "%rcx", "%r8", "%r9"}
@@ -187,11 +431,18 @@ func generateFunction(funcName string, instructions []ir.Instruction) []string {
 			emit("\n")
 
 		case ir.Return:
+			// Every value fits in %rax. Multi-word values such as tuples
+			// are heap records, so returning one returns its address:
+			// there is no hidden result pointer to pass, and the caller
+			// can keep the tuple as long as it likes.
 			emit(fmt.Sprintf("# %s", i.String()))
 			emit(mov(locs.varToLocation[i.Value], "%rax"))
+			emit(".cfi_remember_state")
 			emit("movq %rbp, %rsp")
 			emit("popq %rbp")
-			emit("ret\n")
+			emit(".cfi_def_cfa %rsp, 8")
+			emit("ret")
+			emit(".cfi_restore_state\n")
 
 		default:
 			emit(fmt.Sprintf("# Unhandled instruction: %v\n", i))
@@ -202,12 +453,25 @@ func generateFunction(funcName string, instructions []ir.Instruction) []string {
 	emit("movq $0, %rax")
 	emit("movq %rbp, %rsp")
 	emit("popq %rbp")
-	emit("ret\n")
+	emit(".cfi_def_cfa %rsp, 8")
+	emit("ret")
+	emit(".cfi_endproc")
+	emit(fmt.Sprintf(".size %s, .-%s\n", funcName, funcName))
 
 	return lines
 }
 
-func generateCall(fun ir.IRVar, args []ir.IRVar, locs *Locals) []string {
+// emitLoc emits a .loc directive mapping the following code to loc.
+// Locations without a file (e.g. code given on the command line) are skipped.
+func emitLoc(emit func(string), files map[string]int, loc ir.Location) {
+	fileNum, ok := files[loc.File]
+	if !ok || loc.Line == 0 {
+		return
+	}
+	emit(fmt.Sprintf(".loc %d %d %d", fileNum, loc.Line, loc.Column))
+}
+
+func generateCall(fun ir.IRVar, args []ir.IRVar, loc ir.Location, locs *Locals) []string {
 	calleeSym, ok := operatorFromStr(fun, len(args))
 	var callee Symbol
 	if ok {
@@ -226,18 +490,35 @@ func generateCall(fun ir.IRVar, args []ir.IRVar, locs *Locals) []string {
 			switch callee.op {
 			case Add:
 				lines = append(lines, binOp(&arg1Loc, &arg2Loc, "addq")...)
+				lines = append(lines, overflowCheck(loc, locs)...)
 			case Sub:
 				lines = append(lines, binOp(&arg1Loc, &arg2Loc, "subq")...)
+				lines = append(lines, overflowCheck(loc, locs)...)
 			case Mul:
 				lines = append(lines, binOp(&arg1Loc, &arg2Loc, "imulq")...)
+				lines = append(lines, overflowCheck(loc, locs)...)
 			case Div:
-				lines = append(lines, mov(arg1Loc, "%rax"), "cqto",
-					fmt.Sprintf("idivq %s", arg2Loc))
+				lines = append(lines, divisionChecks(&arg2Loc, loc, locs)...)
+				lines = append(lines, signedDivision(&arg1Loc, &arg2Loc, false, loc, locs)...)
 			case Mod:
+				lines = append(lines, divisionChecks(&arg2Loc, loc, locs)...)
+				lines = append(lines, signedDivision(&arg1Loc, &arg2Loc, true, loc, locs)...)
+			case UnsignedAdd:
+				lines = append(lines, binOp(&arg1Loc, &arg2Loc, "addq")...)
+			case UnsignedSub:
+				lines = append(lines, binOp(&arg1Loc, &arg2Loc, "subq")...)
+			case UnsignedMul:
+				lines = append(lines, binOp(&arg1Loc, &arg2Loc, "imulq")...)
+			case UnsignedDiv:
+				lines = append(lines, divisionChecks(&arg2Loc, loc, locs)...)
+				lines = append(lines, mov(arg1Loc, "%rax"), "xorq %rdx, %rdx",
+					fmt.Sprintf("divq %s", arg2Loc))
+			case UnsignedMod:
+				lines = append(lines, divisionChecks(&arg2Loc, loc, locs)...)
 				lines = append(lines,
 					mov(arg1Loc, "%rax"),
-					"cqto",
-					fmt.Sprintf("idivq %s", arg2Loc),
+					"xorq %rdx, %rdx",
+					fmt.Sprintf("divq %s", arg2Loc),
 					mov("%rdx", "%rax"),
 				)
 			case Equals:
@@ -252,6 +533,24 @@ func generateCall(fun ir.IRVar, args []ir.IRVar, locs *Locals) []string {
 				lines = append(lines, comparison(&arg1Loc, &arg2Loc, "setl")...)
 			case LTE:
 				lines = append(lines, comparison(&arg1Loc, &arg2Loc, "setle")...)
+			case UnsignedGT:
+				lines = append(lines, comparison(&arg1Loc, &arg2Loc, "seta")...)
+			case UnsignedGTE:
+				lines = append(lines, comparison(&arg1Loc, &arg2Loc, "setae")...)
+			case UnsignedLT:
+				lines = append(lines, comparison(&arg1Loc, &arg2Loc, "setb")...)
+			case UnsignedLTE:
+				lines = append(lines, comparison(&arg1Loc, &arg2Loc, "setbe")...)
+			case Element:
+				// &[](array, index) is the address of the element after
+				// checking the index against the length in the first word
+				lines = append(lines,
+					mov(arg1Loc, "%rax"),
+					mov(arg2Loc, "%rcx"),
+					"cmpq (%rax), %rcx",
+				)
+				lines = append(lines, runtimeError("jb", utils.RuntimeErrorIndexOutOfRange, loc, locs)...)
+				lines = append(lines, "leaq 8(%rax,%rcx,8), %rax")
 			default:
 				panic(fmt.Sprintf("operator %d does not have an intrinsic definition", callee.op))
 			}
@@ -272,6 +571,46 @@ func generateCall(fun ir.IRVar, args []ir.IRVar, locs *Locals) []string {
 				mov(arg1Loc, "%rax"),
 				"negq %rax",
 			)
+			lines = append(lines, overflowCheck(loc, locs)...)
+		case CBool:
+			lines = append(lines,
+				mov(arg1Loc, "%rax"),
+				"movzbq %al, %rax",
+			)
+		case Extend:
+			lines = append(lines,
+				mov(arg1Loc, "%rax"),
+				callee.extend,
+			)
+		case AddressOf:
+			lines = append(lines, fmt.Sprintf("leaq %s, %%rax", arg1Loc))
+		case New:
+			// new(size) allocates size zeroed bytes from the stdlib heap
+			label, position := locationString(loc, locs)
+			lines = append(lines, position...)
+			lines = append(lines,
+				mov(arg1Loc, "%rdi"),
+				fmt.Sprintf("leaq %s(%%rip), %%rsi", label),
+				fmt.Sprintf("movq $%d, %%rdx", len(loc.Position())),
+				"xorq %rax, %rax",
+				fmt.Sprintf("callq %s", callTarget("__alloc", locs)),
+			)
+		case NewArray:
+			label, position := locationString(loc, locs)
+			lines = append(lines, position...)
+			lines = append(lines,
+				mov(arg1Loc, "%rdi"),
+				fmt.Sprintf("leaq %s(%%rip), %%rsi", label),
+				fmt.Sprintf("movq $%d, %%rdx", len(loc.Position())),
+				"xorq %rax, %rax",
+				fmt.Sprintf("callq %s", callTarget("__alloc_array", locs)),
+			)
+		case Delete:
+			lines = append(lines,
+				mov(arg1Loc, "%rdi"),
+				"xorq %rax, %rax",
+				fmt.Sprintf("callq %s", callTarget("__free", locs)),
+			)
 		default:
 			lines = append(lines, fmt.Sprintf("; todo operator %d", callee.op))
 		}
@@ -285,6 +624,94 @@ func generateCall(fun ir.IRVar, args []ir.IRVar, locs *Locals) []string {
 	}
 }
 
+// runtimeError emits a call to the stdlib __runtime_error routine reporting
+// the given error code at loc. skip is the conditional jump that bypasses the
+// error when the preceding check succeeded.
+func runtimeError(skip string, code int, loc ir.Location, locs *Locals) []string {
+	locs.trapCount++
+	okLabel := fmt.Sprintf(".%s_trap_ok_%d", locs.funcName, locs.trapCount)
+	msgLabel, lines := locationString(loc, locs)
+	lines = append([]string{fmt.Sprintf("%s %s", skip, okLabel)}, lines...)
+	return append(lines,
+		fmt.Sprintf("movq $%d, %%rdi", code),
+		fmt.Sprintf("leaq %s(%%rip), %%rsi", msgLabel),
+		fmt.Sprintf("movq $%d, %%rdx", len(loc.Position())),
+		fmt.Sprintf("callq %s", callTarget("__runtime_error", locs)),
+		fmt.Sprintf("%s:", okLabel),
+	)
+}
+
+// locationString emits loc as a string in .rodata for the runtime to report
+// and returns its label.
+func locationString(loc ir.Location, locs *Locals) (string, []string) {
+	locs.locationCount++
+	label := fmt.Sprintf(".%s_loc_%d", locs.funcName, locs.locationCount)
+	return label, []string{
+		".pushsection .rodata",
+		fmt.Sprintf("%s:", label),
+		fmt.Sprintf(".ascii \"%s\"", asciiEscape(loc.Position())),
+		".popsection",
+	}
+}
+
+func overflowCheck(loc ir.Location, locs *Locals) []string {
+	if !locs.opts.CheckOverflow {
+		return nil
+	}
+	return runtimeError("jno", utils.RuntimeErrorOverflow, loc, locs)
+}
+
+// divisionChecks traps on a zero divisor.
+func divisionChecks(b *string, loc ir.Location, locs *Locals) []string {
+	lines := []string{fmt.Sprintf("cmpq $0, %s", *b)}
+	return append(lines, runtimeError("jne", utils.RuntimeErrorDivisionByZero, loc, locs)...)
+}
+
+// signedDivision leaves a / b, or a % b when remainder is set, in %rax.
+// idivq faults on MinInt64 / -1, so a divisor of -1 negates a instead, which
+// wraps around to MinInt64 or traps like unary - does with overflow
+// checking, and its remainder is always 0.
+func signedDivision(a *string, b *string, remainder bool, loc ir.Location, locs *Locals) []string {
+	locs.divisionCount++
+	divide := fmt.Sprintf(".%s_div_%d", locs.funcName, locs.divisionCount)
+	done := fmt.Sprintf(".%s_div_done_%d", locs.funcName, locs.divisionCount)
+	lines := []string{
+		fmt.Sprintf("cmpq $-1, %s", *b),
+		fmt.Sprintf("jne %s", divide),
+	}
+	if remainder {
+		lines = append(lines, "xorq %rax, %rax")
+	} else {
+		lines = append(lines, mov(*a, "%rax"), "negq %rax")
+		lines = append(lines, overflowCheck(loc, locs)...)
+	}
+	lines = append(lines,
+		fmt.Sprintf("jmp %s", done),
+		fmt.Sprintf("%s:", divide),
+		mov(*a, "%rax"),
+		"cqto",
+		fmt.Sprintf("idivq %s", *b),
+	)
+	if remainder {
+		lines = append(lines, mov("%rdx", "%rax"))
+	}
+	return append(lines, fmt.Sprintf("%s:", done))
+}
+
+// asciiEscape escapes s for use inside an .ascii directive.
+func asciiEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x20 && c < 0x7f && c != '"' && c != '\\' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	return b.String()
+}
+
 func generateFunctionCall(fun ir.IRVar, args []ir.IRVar, locs *Locals) []string {
 	lines := []string{}
 	paramRegs := []string{"%rdi", "%rsi", "%rdx", "%rcx", "%r8", "%r9"}
@@ -297,11 +724,22 @@ func generateFunctionCall(fun ir.IRVar, args []ir.IRVar, locs *Locals) []string
 			lines = append(lines, mov(locs.varToLocation[arg], paramRegs[i]))
 		}
 	}
-	lines = append(lines, fmt.Sprintf("callq %s", fun))
+	// %al holds the number of vector registers used by variadic C functions
+	lines = append(lines, "xorq %rax, %rax")
+	lines = append(lines, fmt.Sprintf("callq %s", callTarget(fun, locs)))
 
 	return lines
 }
 
+// callTarget returns the operand for calling fun, going through the PLT in
+// position independent code.
+func callTarget(fun string, locs *Locals) string {
+	if locs.opts.PIC {
+		return fun + "@PLT"
+	}
+	return fun
+}
+
 func operatorFromStr(op string, argCount int) (Symbol, bool) {
 	if argCount == 2 {
 		switch op {
@@ -327,6 +765,26 @@ func operatorFromStr(op string, argCount int) (Symbol, bool) {
 			return Symbol{op: LT}, true
 		case "<=":
 			return Symbol{op: LTE}, true
+		case "&[]":
+			return Symbol{op: Element}, true
+		case "u+":
+			return Symbol{op: UnsignedAdd}, true
+		case "u-":
+			return Symbol{op: UnsignedSub}, true
+		case "u*":
+			return Symbol{op: UnsignedMul}, true
+		case "u/":
+			return Symbol{op: UnsignedDiv}, true
+		case "u%":
+			return Symbol{op: UnsignedMod}, true
+		case "u>":
+			return Symbol{op: UnsignedGT}, true
+		case "u>=":
+			return Symbol{op: UnsignedGTE}, true
+		case "u<":
+			return Symbol{op: UnsignedLT}, true
+		case "u<=":
+			return Symbol{op: UnsignedLTE}, true
 		}
 	} else if argCount == 1 {
 		switch op {
@@ -334,6 +792,29 @@ func operatorFromStr(op string, argCount int) (Symbol, bool) {
 			return Symbol{op: UnarySub}, true
 		case "unary_not":
 			return Symbol{op: Not}, true
+		case "unary_&":
+			return Symbol{op: AddressOf}, true
+		case "__c_bool":
+			return Symbol{op: CBool}, true
+		case "__new":
+			return Symbol{op: New}, true
+		case "__delete":
+			return Symbol{op: Delete}, true
+		case "new[]":
+			return Symbol{op: NewArray}, true
+		case "__as_Int8":
+			return Symbol{op: Extend, extend: "movsbq %al, %rax"}, true
+		case "__as_Int16":
+			return Symbol{op: Extend, extend: "movswq %ax, %rax"}, true
+		case "__as_Int32":
+			return Symbol{op: Extend, extend: "movslq %eax, %rax"}, true
+		case "__as_UInt8":
+			return Symbol{op: Extend, extend: "movzbq %al, %rax"}, true
+		case "__as_UInt16":
+			return Symbol{op: Extend, extend: "movzwq %ax, %rax"}, true
+		case "__as_UInt32":
+			// Writing %eax clears the upper half of %rax
+			return Symbol{op: Extend, extend: "movl %eax, %eax"}, true
 		}
 	}
 	return Symbol{}, false
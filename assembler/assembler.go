@@ -1,18 +1,115 @@
 package assembler
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 )
 
+type OutputKind int
+
+const (
+	// Executable links a standalone program
+	Executable OutputKind = iota
+	// Object produces a relocatable object file containing the program and
+	// the stdlib (without _start and exit) for linking into other programs
+	Object
+	// Shared produces a shared library from position independent assembly
+	Shared
+)
+
+// Options configures the toolchain used to assemble and link a program.
+type Options struct {
+	Output OutputKind
+	// LinkC links the executable with libc through the C compiler driver.
+	// The stdlib is used without _start and exit so that the C runtime
+	// provides them and calls main.
+	LinkC bool
+	// Objects are extra object or archive files given to the linker.
+	Objects []string
+	// AssemblerPath and LinkerPath override the tools found from PATH. The
+	// default linker is ld, or cc when linking with C.
+	AssemblerPath string
+	LinkerPath    string
+	// AssemblerFlags and LinkerFlags are passed to the tools as is.
+	AssemblerFlags []string
+	LinkerFlags    []string
+	// KeepTemps keeps the intermediate files in this directory instead of
+	// a temporary directory that is removed afterwards.
+	KeepTemps string
+	// Target is a target triple such as x86_64-linux-gnu. When set, the
+	// tools default to the prefixed cross tools, e.g. x86_64-linux-gnu-as.
+	Target string
+	// NoStdlibCache assembles the stdlib again instead of reusing the
+	// object built by an earlier call in this process.
+	NoStdlibCache bool
+}
+
+// stdlibCache holds assembled stdlib objects keyed by a hash of the stdlib
+// source and the assembler command, so that repeated compiles (e.g. in
+// serve mode) only pay for assembling the program.
+var stdlibCache = struct {
+	sync.Mutex
+	objects map[string][]byte
+}{objects: make(map[string][]byte)}
+
+// ToolError is returned when the assembler or linker fails. It carries what
+// the tool printed on stderr so that the failure can be diagnosed.
+type ToolError struct {
+	Tool   string
+	Args   []string
+	Err    error
+	Stderr string
+}
+
+func (e *ToolError) Error() string {
+	msg := fmt.Sprintf("%s %s: %v", e.Tool, strings.Join(e.Args, " "), e.Err)
+	if e.Stderr != "" {
+		msg += "\n" + strings.TrimRight(e.Stderr, "\n")
+	}
+	return msg
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
 func Assemble(assemblyCode, outputFile string) ([]byte, error) {
-	tempDir, err := ioutil.TempDir("", "compiler_")
-	if err != nil {
-		return nil, err
+	return AssembleWithOptions(assemblyCode, outputFile, Options{})
+}
+
+func AssembleWithOptions(assemblyCode, outputFile string, opts Options) ([]byte, error) {
+	if opts.Target != "" && !strings.HasPrefix(opts.Target, "x86_64-") {
+		return nil, fmt.Errorf("unsupported target %s: only x86_64 code is generated", opts.Target)
+	}
+
+	var tempDir string
+	if opts.KeepTemps != "" {
+		tempDir = opts.KeepTemps
+		if err := os.MkdirAll(tempDir, 0755); err != nil {
+			return nil, err
+		}
+	} else {
+		dir, err := ioutil.TempDir("", "compiler_")
+		if err != nil {
+			return nil, err
+		}
+		tempDir = dir
+		defer os.RemoveAll(tempDir)
+	}
+
+	stdlib := STDLIB_ASM_CODE
+	if opts.LinkC || opts.Output != Executable {
+		stdlib = stdlibForC()
 	}
-	defer os.RemoveAll(tempDir)
 
 	stdlibS := filepath.Join(tempDir, "stdlib.s")
 	stdlibO := filepath.Join(tempDir, "stdlib.o")
@@ -20,20 +117,44 @@ func Assemble(assemblyCode, outputFile string) ([]byte, error) {
 	programO := filepath.Join(tempDir, "program.o")
 	outputExe := filepath.Join(tempDir, "a.out")
 
-	if err := ioutil.WriteFile(stdlibS, []byte(STDLIB_ASM_CODE), 0644); err != nil {
+	if err := ioutil.WriteFile(stdlibS, []byte(stdlib), 0644); err != nil {
 		return nil, err
 	}
 	if err := ioutil.WriteFile(programS, []byte(assemblyCode), 0644); err != nil {
 		return nil, err
 	}
 
-	if err := exec.Command("as", "-g", "-o", stdlibO, stdlibS).Run(); err != nil {
+	assembler := opts.tool(opts.AssemblerPath, "as")
+	asArgs := func(out, src string) []string {
+		args := append([]string{"-g"}, opts.AssemblerFlags...)
+		return append(args, "-o", out, src)
+	}
+	if err := buildStdlib(assembler, asArgs(stdlibO, stdlibS), stdlib, stdlibS, stdlibO, !opts.NoStdlibCache); err != nil {
 		return nil, err
 	}
-	if err := exec.Command("as", "-g", "-o", programO, programS).Run(); err != nil {
+	if err := run(assembler, asArgs(programO, programS)...); err != nil {
 		return nil, err
 	}
-	if err := exec.Command("ld", "-o", outputExe, "-static", stdlibO, programO).Run(); err != nil {
+
+	linker := opts.tool(opts.LinkerPath, "ld")
+	var linkArgs []string
+	switch {
+	case opts.Output == Object:
+		linkArgs = []string{"-r"}
+	case opts.Output == Shared:
+		linkArgs = []string{"-shared"}
+	case opts.LinkC:
+		linker = opts.tool(opts.LinkerPath, "cc")
+		linkArgs = []string{"-no-pie"}
+	default:
+		linkArgs = []string{"-static"}
+	}
+	linkArgs = append(linkArgs, opts.LinkerFlags...)
+	linkArgs = append(linkArgs, "-o", outputExe, stdlibO, programO)
+	if opts.Output != Object {
+		linkArgs = append(linkArgs, opts.Objects...)
+	}
+	if err := run(linker, linkArgs...); err != nil {
 		return nil, err
 	}
 
@@ -43,29 +164,124 @@ func Assemble(assemblyCode, outputFile string) ([]byte, error) {
 	return ioutil.ReadFile(outputExe)
 }
 
+// buildStdlib assembles the stdlib from stdlibS into stdlibO, or copies the
+// object built earlier in this process for the same source and assembler
+// command.
+func buildStdlib(assembler string, args []string, stdlib, stdlibS, stdlibO string, useCache bool) error {
+	if !useCache {
+		return run(assembler, args...)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(assembler))
+	for _, arg := range args {
+		// Skip the paths of the temp files, they differ for every call and
+		// the source is hashed below
+		if arg == stdlibS || arg == stdlibO {
+			continue
+		}
+		hash.Write([]byte{0})
+		hash.Write([]byte(arg))
+	}
+	hash.Write([]byte{0})
+	hash.Write([]byte(stdlib))
+	key := hex.EncodeToString(hash.Sum(nil))
+
+	stdlibCache.Lock()
+	object, ok := stdlibCache.objects[key]
+	stdlibCache.Unlock()
+	if ok {
+		return ioutil.WriteFile(stdlibO, object, 0644)
+	}
+
+	if err := run(assembler, args...); err != nil {
+		return err
+	}
+	object, err := ioutil.ReadFile(stdlibO)
+	if err != nil {
+		return err
+	}
+	stdlibCache.Lock()
+	stdlibCache.objects[key] = object
+	stdlibCache.Unlock()
+	return nil
+}
+
+// tool returns the configured path of a tool, or its default name prefixed
+// with the target triple.
+func (opts Options) tool(path, name string) string {
+	if path != "" {
+		return path
+	}
+	if opts.Target != "" {
+		return opts.Target + "-" + name
+	}
+	return name
+}
+
+func run(tool string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return &ToolError{Tool: tool, Args: args, Err: err, Stderr: stderr.String()}
+	}
+	return nil
+}
+
+var cSkippedSections = regexp.MustCompile(`(?s)# BEGIN (START|EXIT)\b.*?# END (START|EXIT)\n`)
+
+func stdlibForC() string {
+	return cSkippedSections.ReplaceAllString(STDLIB_ASM_CODE, "")
+}
+
 const STDLIB_ASM_CODE = `
-	.global _start
 	.global print_int
 	.global print_bool
 	.global read_int
+	.global print_string
+	.global concat
+	.global __string_equals
+	.global __runtime_error
+	.global __alloc
+	.global __free
+	.global __alloc_array
+	.global gc_collect
+	.global __stack_base
+	.hidden __stack_base
+	.global __globals_start
+	.hidden __globals_start
+	.global __globals_end
+	.hidden __globals_end
 	.extern main
 	.section .text
 
 # BEGIN START (we skip this part when linking with C)
 # ***** Function '_start' *****
-# Calls function 'main' and halts the program
+	.global _start
+# Calls function 'main' and halts the program with its result as status
 
+	.type _start, @function
 _start:
+	.cfi_startproc
+	.cfi_undefined %rip
 	call main
+	movq %rax, %rdi
 	movq $60, %rax
-	xorq %rdi, %rdi
 	syscall
+	.cfi_endproc
+	.size _start, .-_start
 # END START
 
 # ***** Function 'print_int' *****
+	.type print_int, @function
 print_int:
+	.cfi_startproc
 	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
 	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
 	movq %rdi, %r10
 	decq %rsp
 	movb $10, (%rsp)
@@ -111,21 +327,29 @@ print_int:
 	syscall
 	movq %rbp, %rsp
 	popq %rbp
+	.cfi_def_cfa %rsp, 8
 	movq %r10, %rax
 	ret
+	.cfi_endproc
+	.size print_int, .-print_int
 
 # ***** Function 'print_bool' *****
+	.type print_bool, @function
 print_bool:
+	.cfi_startproc
 	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
 	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
 	movq %rdi, %r10
 	cmpq $0, %rdi
 	jne .Ltrue
-	movq $false_str, %rsi
+	leaq false_str(%rip), %rsi
 	movq $false_str_len, %rdx
 	jmp .Lwrite
 .Ltrue:
-	movq $true_str, %rsi
+	leaq true_str(%rip), %rsi
 	movq $true_str_len, %rdx
 .Lwrite:
 	movq $1, %rax
@@ -133,8 +357,11 @@ print_bool:
 	syscall
 	movq %rbp, %rsp
 	popq %rbp
+	.cfi_def_cfa %rsp, 8
 	movq %r10, %rax
 	ret
+	.cfi_endproc
+	.size print_bool, .-print_bool
 
 true_str:
 	.ascii "true\n"
@@ -144,10 +371,16 @@ false_str:
 false_str_len = . - false_str
 
 # ***** Function 'read_int' *****
+	.type read_int, @function
 read_int:
+	.cfi_startproc
 	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
 	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
 	pushq %r12
+	.cfi_offset %r12, -24
 	pushq $0
 	xorq %r9, %r9
 	xorq %r10, %r10
@@ -188,23 +421,615 @@ read_int:
 	je .Lfinal_negation_done
 	neg %r10
 .Lfinal_negation_done:
-	popq %r12
+	movq -8(%rbp), %r12
 	movq %rbp, %rsp
 	popq %rbp
+	.cfi_remember_state
+	.cfi_def_cfa %rsp, 8
 	movq %r10, %rax
 	ret
+	.cfi_restore_state
 .Lerror:
 	movq $1, %rax
 	movq $2, %rdi
-	movq $read_int_error_str, %rsi
+	leaq read_int_error_str(%rip), %rsi
 	movq $read_int_error_str_len, %rdx
 	syscall
 	movq $60, %rax
 	movq $1, %rdi
 	syscall
+	.cfi_endproc
+	.size read_int, .-read_int
 
 read_int_error_str:
 	.ascii "Error: read_int() failed to read input\\n"
 read_int_error_str_len = . - read_int_error_str
-`
 
+# A string points to its length in bytes, followed by the bytes.
+
+# ***** Function 'print_string' *****
+# Prints the string in %rdi followed by a newline
+	.type print_string, @function
+print_string:
+	.cfi_startproc
+	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
+	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
+	movq (%rdi), %rdx
+	leaq 8(%rdi), %rsi
+	movq $1, %rax
+	movq $1, %rdi
+	syscall
+	movq $1, %rax
+	movq $1, %rdi
+	leaq newline_str(%rip), %rsi
+	movq $1, %rdx
+	syscall
+	movq %rbp, %rsp
+	popq %rbp
+	.cfi_def_cfa %rsp, 8
+	ret
+	.cfi_endproc
+	.size print_string, .-print_string
+
+newline_str:
+	.ascii "\n"
+
+# ***** Function 'concat' *****
+# Returns a new heap string of the string in %rdi followed by the one in %rsi
+	.type concat, @function
+concat:
+	.cfi_startproc
+	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
+	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
+	pushq %rbx
+	pushq %r12
+	.cfi_offset %rbx, -24
+	.cfi_offset %r12, -32
+	movq %rdi, %rbx
+	movq %rsi, %r12
+	movq (%rbx), %rdi
+	addq (%r12), %rdi
+	addq $8, %rdi
+	xorq %rsi, %rsi
+	xorq %rdx, %rdx
+	call __alloc
+	movq (%rbx), %rcx
+	addq (%r12), %rcx
+	movq %rcx, (%rax)
+	leaq 8(%rax), %rdi
+	leaq 8(%rbx), %rsi
+	movq (%rbx), %rcx
+	rep movsb
+	leaq 8(%r12), %rsi
+	movq (%r12), %rcx
+	rep movsb
+	movq -8(%rbp), %rbx
+	movq -16(%rbp), %r12
+	movq %rbp, %rsp
+	popq %rbp
+	.cfi_def_cfa %rsp, 8
+	ret
+	.cfi_endproc
+	.size concat, .-concat
+
+# ***** Function '__string_equals' *****
+# Returns 1 if the strings in %rdi and %rsi have the same bytes, otherwise 0
+	.type __string_equals, @function
+__string_equals:
+	.cfi_startproc
+	xorq %rax, %rax
+	movq (%rdi), %rcx
+	cmpq (%rsi), %rcx
+	jne .Lstring_equals_done
+	# leaq keeps the flags of cmpq for strings of length 0
+	leaq 8(%rdi), %rdi
+	leaq 8(%rsi), %rsi
+	repe cmpsb
+	sete %al
+.Lstring_equals_done:
+	ret
+	.cfi_endproc
+	.size __string_equals, .-__string_equals
+
+# BEGIN EXIT (libc provides exit when linking with C)
+# ***** Function 'exit' *****
+# Halts the program with the status given in %rdi
+	.global exit
+	.type exit, @function
+exit:
+	.cfi_startproc
+	movq $60, %rax
+	syscall
+	.cfi_endproc
+	.size exit, .-exit
+# END EXIT
+
+# ***** Function '__runtime_error' *****
+# Prints "Error: <message> at <location>" to stderr and exits with the
+# error code as status.
+# %rdi = error code, %rsi = location string, %rdx = location length
+	.type __runtime_error, @function
+__runtime_error:
+	.cfi_startproc
+	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
+	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
+	movq %rdi, %r12
+	movq %rsi, %r13
+	movq %rdx, %r14
+	leaq runtime_error_prefix(%rip), %rsi
+	movq $runtime_error_prefix_len, %rdx
+	call .Lwrite_stderr
+	cmpq $3, %r12
+	je .Ldivision_by_zero
+	cmpq $4, %r12
+	je .Loverflow
+	cmpq $5, %r12
+	je .Lout_of_memory
+	cmpq $6, %r12
+	je .Lindex_out_of_range
+	leaq runtime_error_unknown(%rip), %rsi
+	movq $runtime_error_unknown_len, %rdx
+	jmp .Lwrite_message
+.Ldivision_by_zero:
+	leaq runtime_error_division_by_zero(%rip), %rsi
+	movq $runtime_error_division_by_zero_len, %rdx
+	jmp .Lwrite_message
+.Loverflow:
+	leaq runtime_error_overflow(%rip), %rsi
+	movq $runtime_error_overflow_len, %rdx
+	jmp .Lwrite_message
+.Lout_of_memory:
+	leaq runtime_error_out_of_memory(%rip), %rsi
+	movq $runtime_error_out_of_memory_len, %rdx
+	jmp .Lwrite_message
+.Lindex_out_of_range:
+	leaq runtime_error_index_out_of_range(%rip), %rsi
+	movq $runtime_error_index_out_of_range_len, %rdx
+.Lwrite_message:
+	call .Lwrite_stderr
+	cmpq $0, %r14
+	je .Lwrite_newline
+	leaq runtime_error_at(%rip), %rsi
+	movq $runtime_error_at_len, %rdx
+	call .Lwrite_stderr
+	movq %r13, %rsi
+	movq %r14, %rdx
+	call .Lwrite_stderr
+.Lwrite_newline:
+	leaq runtime_error_newline(%rip), %rsi
+	movq $1, %rdx
+	call .Lwrite_stderr
+	movq $60, %rax
+	movq %r12, %rdi
+	syscall
+.Lwrite_stderr:
+	movq $1, %rax
+	movq $2, %rdi
+	syscall
+	ret
+	.cfi_endproc
+	.size __runtime_error, .-__runtime_error
+
+runtime_error_prefix:
+	.ascii "Error: "
+runtime_error_prefix_len = . - runtime_error_prefix
+runtime_error_unknown:
+	.ascii "runtime error"
+runtime_error_unknown_len = . - runtime_error_unknown
+runtime_error_division_by_zero:
+	.ascii "division by zero"
+runtime_error_division_by_zero_len = . - runtime_error_division_by_zero
+runtime_error_overflow:
+	.ascii "integer overflow"
+runtime_error_overflow_len = . - runtime_error_overflow
+runtime_error_out_of_memory:
+	.ascii "out of memory"
+runtime_error_out_of_memory_len = . - runtime_error_out_of_memory
+runtime_error_index_out_of_range:
+	.ascii "index out of range"
+runtime_error_index_out_of_range_len = . - runtime_error_index_out_of_range
+runtime_error_at:
+	.ascii " at "
+runtime_error_at_len = . - runtime_error_at
+runtime_error_newline:
+	.ascii "\n"
+
+# ***** Heap *****
+# The heap is a single mmap'd arena of heap_size bytes, reserved on the first
+# allocation. Blocks are laid out back to back from heap_start to heap_top,
+# each one a 16 byte header followed by the payload:
+#   0(header) = payload size in bytes (a multiple of 16)
+#   8(header) = flags: 1 = in use, 2 = marked, 4 = scanned (GC only)
+# Free blocks are kept on free_list, linked through their first payload word.
+heap_size = 1 << 30
+# The collector runs once gc_threshold bytes have been allocated since the
+# last collection. The threshold is twice the bytes live after collecting,
+# but at least this.
+gc_min_threshold = 1 << 20
+
+# ***** Function '__alloc' *****
+# Returns a pointer to %rdi zeroed bytes. Free blocks are reused first fit,
+# otherwise the heap grows. When the collector is enabled it runs when
+# gc_threshold is reached and once more before giving up. Running out of
+# memory is a runtime error reported at the location in %rsi (length %rdx,
+# may be 0).
+	.type __alloc, @function
+__alloc:
+	.cfi_startproc
+	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
+	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
+	pushq %rbx
+	pushq %r12
+	pushq %r13
+	pushq %r14
+	.cfi_offset %rbx, -24
+	.cfi_offset %r12, -32
+	.cfi_offset %r13, -40
+	.cfi_offset %r14, -48
+	movq %rsi, %r13
+	movq %rdx, %r14
+	cmpq $heap_size, %rdi
+	ja .Lalloc_out_of_memory
+	addq $15, %rdi
+	andq $-16, %rdi
+	jnz .Lalloc_size_ok
+	movq $16, %rdi
+.Lalloc_size_ok:
+	movq %rdi, %rbx
+	cmpq $0, heap_start(%rip)
+	jne .Lalloc_heap_ready
+	call .Lalloc_heap_init
+.Lalloc_heap_ready:
+	cmpq $0, __stack_base(%rip)
+	je .Lalloc_search
+	movq gc_allocated(%rip), %rax
+	cmpq gc_threshold(%rip), %rax
+	jb .Lalloc_search
+	call gc_collect
+.Lalloc_search:
+	movq %rbx, %rdi
+	call .Lalloc_first_fit
+	testq %rax, %rax
+	jnz .Lalloc_found
+	movq heap_top(%rip), %rax
+	leaq 16(%rax,%rbx), %rcx
+	cmpq heap_end(%rip), %rcx
+	ja .Lalloc_full
+	movq %rcx, heap_top(%rip)
+	movq %rbx, (%rax)
+.Lalloc_found:
+	addq %rbx, gc_allocated(%rip)
+	movq $1, 8(%rax)
+	leaq 16(%rax), %r12
+	movq (%rax), %rcx
+	shrq $3, %rcx
+	movq %r12, %rdi
+	xorq %rax, %rax
+	rep stosq
+	movq %r12, %rax
+	movq -8(%rbp), %rbx
+	movq -16(%rbp), %r12
+	movq -24(%rbp), %r13
+	movq -32(%rbp), %r14
+	movq %rbp, %rsp
+	popq %rbp
+	.cfi_remember_state
+	.cfi_def_cfa %rsp, 8
+	ret
+	.cfi_restore_state
+.Lalloc_full:
+	cmpq $0, __stack_base(%rip)
+	je .Lalloc_out_of_memory
+	cmpq $0, gc_allocated(%rip)
+	je .Lalloc_out_of_memory
+	call gc_collect
+	jmp .Lalloc_search
+.Lalloc_out_of_memory:
+	movq $5, %rdi
+	movq %r13, %rsi
+	movq %r14, %rdx
+	call __runtime_error
+
+# Reserves the arena
+.Lalloc_heap_init:
+	movq $9, %rax
+	xorq %rdi, %rdi
+	movq $heap_size, %rsi
+	movq $3, %rdx
+	movq $0x4022, %r10
+	movq $-1, %r8
+	xorq %r9, %r9
+	syscall
+	cmpq $-4096, %rax
+	ja .Lalloc_out_of_memory
+	movq %rax, heap_start(%rip)
+	movq %rax, heap_top(%rip)
+	addq $heap_size, %rax
+	movq %rax, heap_end(%rip)
+	ret
+
+# Returns the header of the first block on the free list of at least %rdi
+# bytes and unlinks it, or returns 0. The rest of the block is split off and
+# takes its place on the list when it fits a block of its own.
+.Lalloc_first_fit:
+	leaq free_list(%rip), %rdx
+.Lalloc_fit_loop:
+	movq (%rdx), %rax
+	testq %rax, %rax
+	jz .Lalloc_fit_done
+	movq (%rax), %rcx
+	cmpq %rdi, %rcx
+	jae .Lalloc_fit_found
+	leaq 16(%rax), %rdx
+	jmp .Lalloc_fit_loop
+.Lalloc_fit_found:
+	movq 16(%rax), %r8
+	subq %rdi, %rcx
+	cmpq $32, %rcx
+	jb .Lalloc_fit_unlink
+	movq %rdi, (%rax)
+	leaq 16(%rax,%rdi), %r9
+	subq $16, %rcx
+	movq %rcx, (%r9)
+	movq $0, 8(%r9)
+	movq %r8, 16(%r9)
+	movq %r9, (%rdx)
+	ret
+.Lalloc_fit_unlink:
+	movq %r8, (%rdx)
+.Lalloc_fit_done:
+	ret
+	.cfi_endproc
+	.size __alloc, .-__alloc
+
+# ***** Function '__free' *****
+# Puts the block of the pointer in %rdi on the free list and takes its size
+# off gc_allocated, which stops at 0 for blocks allocated before the last
+# collection. Null, pointers outside the heap and blocks that are already
+# free are ignored.
+	.type __free, @function
+__free:
+	.cfi_startproc
+	cmpq heap_start(%rip), %rdi
+	jb .Lfree_done
+	cmpq heap_top(%rip), %rdi
+	jae .Lfree_done
+	cmpq $0, -8(%rdi)
+	je .Lfree_done
+	movq $0, -8(%rdi)
+	movq gc_allocated(%rip), %rax
+	subq -16(%rdi), %rax
+	jae .Lfree_counted
+	xorq %rax, %rax
+.Lfree_counted:
+	movq %rax, gc_allocated(%rip)
+	movq free_list(%rip), %rax
+	movq %rax, (%rdi)
+	subq $16, %rdi
+	movq %rdi, free_list(%rip)
+.Lfree_done:
+	ret
+	.cfi_endproc
+	.size __free, .-__free
+
+# ***** Function '__alloc_array' *****
+# Returns a zeroed array of %rdi 8 byte elements. The length is kept in the
+# first word and the elements follow it. Location as for __alloc.
+	.type __alloc_array, @function
+__alloc_array:
+	.cfi_startproc
+	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
+	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
+	pushq %rbx
+	subq $8, %rsp
+	.cfi_offset %rbx, -24
+	movq %rdi, %rbx
+	cmpq $(heap_size / 8), %rdi
+	jbe .Lalloc_array_size_ok
+	# Too long to fit, let __alloc report it
+	movq $-1, %rdi
+	jmp .Lalloc_array_call
+.Lalloc_array_size_ok:
+	leaq 8(,%rdi,8), %rdi
+.Lalloc_array_call:
+	call __alloc
+	movq %rbx, (%rax)
+	movq -8(%rbp), %rbx
+	movq %rbp, %rsp
+	popq %rbp
+	.cfi_def_cfa %rsp, 8
+	ret
+	.cfi_endproc
+	.size __alloc_array, .-__alloc_array
+
+# ***** Function 'gc_collect' *****
+# Conservative mark and sweep. Every word on the stack between %rsp and
+# __stack_base or in the program's globals that points into a block in use
+# marks it, then marked blocks are scanned the same way until no new block
+# gets marked. Unmarked blocks are freed and merged with their free
+# neighbours into a new free list, and a free block at the end of the heap is
+# given back. Does nothing unless the program set __stack_base (compiled
+# with --gc).
+	.type gc_collect, @function
+gc_collect:
+	.cfi_startproc
+	pushq %rbp
+	.cfi_def_cfa_offset 16
+	.cfi_offset %rbp, -16
+	movq %rsp, %rbp
+	.cfi_def_cfa_register %rbp
+	pushq %rbx
+	pushq %r12
+	pushq %r13
+	pushq %r14
+	pushq %r15
+	subq $8, %rsp
+	.cfi_offset %rbx, -24
+	.cfi_offset %r12, -32
+	.cfi_offset %r13, -40
+	.cfi_offset %r14, -48
+	.cfi_offset %r15, -56
+	cmpq $0, __stack_base(%rip)
+	je .Lgc_done
+	cmpq $0, heap_start(%rip)
+	je .Lgc_done
+	movq %rsp, %rdi
+	movq __stack_base(%rip), %rsi
+	call .Lgc_scan_range
+	movq __globals_start(%rip), %rdi
+	movq __globals_end(%rip), %rsi
+	call .Lgc_scan_range
+.Lgc_trace:
+	xorq %r15, %r15
+	movq heap_start(%rip), %rbx
+.Lgc_trace_loop:
+	cmpq heap_top(%rip), %rbx
+	jae .Lgc_trace_done
+	movq 8(%rbx), %rax
+	andq $6, %rax
+	cmpq $2, %rax
+	jne .Lgc_trace_next
+	orq $4, 8(%rbx)
+	leaq 16(%rbx), %rdi
+	movq (%rbx), %rsi
+	addq %rdi, %rsi
+	call .Lgc_scan_range
+	movq $1, %r15
+.Lgc_trace_next:
+	movq (%rbx), %rax
+	leaq 16(%rbx,%rax), %rbx
+	jmp .Lgc_trace_loop
+.Lgc_trace_done:
+	testq %r15, %r15
+	jnz .Lgc_trace
+	movq heap_start(%rip), %rbx
+	xorq %r12, %r12
+	xorq %r15, %r15
+	leaq free_list(%rip), %r13
+	movq $0, (%r13)
+.Lgc_sweep_loop:
+	cmpq heap_top(%rip), %rbx
+	jae .Lgc_sweep_done
+	testq $2, 8(%rbx)
+	jz .Lgc_sweep_free
+	movq $1, 8(%rbx)
+	addq (%rbx), %r15
+	xorq %r12, %r12
+	jmp .Lgc_sweep_next
+.Lgc_sweep_free:
+	movq $0, 8(%rbx)
+	testq %r12, %r12
+	jz .Lgc_sweep_first_free
+	movq (%rbx), %rax
+	addq $16, %rax
+	addq %rax, (%r12)
+	jmp .Lgc_sweep_next
+.Lgc_sweep_first_free:
+	movq %rbx, %r12
+	movq %r13, %r14
+	movq %rbx, (%r13)
+	leaq 16(%rbx), %r13
+	movq $0, (%r13)
+.Lgc_sweep_next:
+	movq (%rbx), %rax
+	leaq 16(%rbx,%rax), %rbx
+	jmp .Lgc_sweep_loop
+.Lgc_sweep_done:
+	testq %r12, %r12
+	jz .Lgc_threshold
+	movq %r12, heap_top(%rip)
+	movq $0, (%r14)
+.Lgc_threshold:
+	movq $0, gc_allocated(%rip)
+	shlq $1, %r15
+	cmpq $gc_min_threshold, %r15
+	jae .Lgc_set_threshold
+	movq $gc_min_threshold, %r15
+.Lgc_set_threshold:
+	movq %r15, gc_threshold(%rip)
+.Lgc_done:
+	movq -8(%rbp), %rbx
+	movq -16(%rbp), %r12
+	movq -24(%rbp), %r13
+	movq -32(%rbp), %r14
+	movq -40(%rbp), %r15
+	movq %rbp, %rsp
+	popq %rbp
+	.cfi_def_cfa %rsp, 8
+	ret
+
+# Marks the blocks in use that the words in [%rdi, %rsi) point into
+.Lgc_scan_range:
+	cmpq %rsi, %rdi
+	jae .Lgc_scan_done
+	movq (%rdi), %rax
+	cmpq heap_top(%rip), %rax
+	jae .Lgc_scan_next
+	movq heap_start(%rip), %rcx
+.Lgc_find_loop:
+	cmpq heap_top(%rip), %rcx
+	jae .Lgc_scan_next
+	leaq 16(%rcx), %rdx
+	cmpq %rdx, %rax
+	jb .Lgc_scan_next
+	addq (%rcx), %rdx
+	cmpq %rdx, %rax
+	jb .Lgc_find_hit
+	movq %rdx, %rcx
+	jmp .Lgc_find_loop
+.Lgc_find_hit:
+	testq $1, 8(%rcx)
+	jz .Lgc_scan_next
+	orq $2, 8(%rcx)
+.Lgc_scan_next:
+	addq $8, %rdi
+	jmp .Lgc_scan_range
+.Lgc_scan_done:
+	ret
+	.cfi_endproc
+	.size gc_collect, .-gc_collect
+
+	.section .data
+	.align 8
+gc_threshold:
+	.quad gc_min_threshold
+
+	.section .bss
+	.align 8
+heap_start:
+	.quad 0
+heap_top:
+	.quad 0
+heap_end:
+	.quad 0
+free_list:
+	.quad 0
+# Bytes allocated since the last collection and not freed since
+gc_allocated:
+	.quad 0
+# Frame of main, the end of the stack area scanned for roots
+__stack_base:
+	.quad 0
+# The program's global variables, also scanned for roots
+__globals_start:
+	.quad 0
+__globals_end:
+	.quad 0
+
+	.section .note.GNU-stack,"",@progbits
+`
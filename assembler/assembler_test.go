@@ -0,0 +1,445 @@
+package assembler
+
+import (
+	"compiler/asmgenerator"
+	"compiler/interpreter"
+	"compiler/ir"
+	"compiler/irgenerator"
+	"compiler/parser"
+	"compiler/tokenizer"
+	"compiler/typechecker"
+	"compiler/utils"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const benchmarkProgram = `
+	fun square(x: Int): Int {
+		return x * x;
+	}
+	var i = 0;
+	while i < 10 do {
+		print_int(square(i));
+		i = i + 1;
+	}
+`
+
+func compile(b *testing.B, opts Options) {
+	tokens := tokenizer.Tokenize(benchmarkProgram, "")
+	res := parser.Parse(tokens)
+	typechecker.Type(res)
+	funcMap := irgenerator.Generate(res)
+	asm := asmgenerator.GenerateASM(funcMap)
+	if _, err := AssembleWithOptions(asm, "", opts); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func requireToolchain(b testing.TB) {
+	for _, tool := range []string{"as", "ld"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			b.Skipf("%s not found", tool)
+		}
+	}
+}
+
+func BenchmarkCompile_UncachedStdlib(b *testing.B) {
+	requireToolchain(b)
+	for i := 0; i < b.N; i++ {
+		compile(b, Options{NoStdlibCache: true})
+	}
+}
+
+func BenchmarkCompile_CachedStdlib(b *testing.B) {
+	requireToolchain(b)
+	compile(b, Options{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compile(b, Options{})
+	}
+}
+
+func TestHeap_CollectsGarbage(t *testing.T) {
+	requireToolchain(t)
+	// Allocates 2 GiB in total, twice the arena, keeping one block alive
+	body := []ir.Instruction{
+		ir.LoadIntConst{Value: 1, Dest: "one"},
+		ir.LoadIntConst{Value: 1 << 16, Dest: "n"},
+		ir.Label{Label: "loop"},
+		ir.Call{Fun: "__new", Args: []ir.IRVar{"n"}, Dest: "p"},
+		ir.Call{Fun: "-", Args: []ir.IRVar{"n", "one"}, Dest: "n"},
+		ir.CondJump{Cond: "n", ThenLabel: ir.Label{Label: "loop"}, ElseLabel: ir.Label{Label: "end"}},
+		ir.Label{Label: "end"},
+		ir.Call{Fun: "__delete", Args: []ir.IRVar{"p"}, Dest: "u"},
+		ir.Call{Fun: "print_int", Args: []ir.IRVar{"one"}, Dest: "u"},
+	}
+	funcMap := map[string][]ir.Instruction{"main": body}
+	exe := filepath.Join(t.TempDir(), "heap")
+
+	asm := asmgenerator.GenerateASMWithOptions(funcMap, asmgenerator.Options{GC: true})
+	if _, err := Assemble(asm, exe); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(exe).Output()
+	if err != nil || string(out) != "1\n" {
+		t.Errorf("Expected 1 but got %q (%v)", out, err)
+	}
+
+	asm = asmgenerator.GenerateASM(funcMap)
+	if _, err := Assemble(asm, exe); err != nil {
+		t.Fatal(err)
+	}
+	err = exec.Command(exe).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != utils.RuntimeErrorOutOfMemory {
+		t.Errorf("Expected out of memory without the collector, got %v", err)
+	}
+}
+
+func TestHeap_FreeGivesBackToTheCollector(t *testing.T) {
+	requireToolchain(t)
+	// A block that is only reachable through an integer that does not point
+	// into the heap is garbage. Allocating and freeing 2 MiB afterwards must
+	// not count towards the 1 MiB that trigger a collection, so the block
+	// stays in use and is not handed out again. Only offsets from the garbage
+	// are kept, as they do not point into the heap either.
+	body := []ir.Instruction{
+		ir.LoadIntConst{Value: 1, Dest: "one"},
+		ir.LoadIntConst{Value: 17, Dest: "header"},
+		ir.LoadIntConst{Value: 1 << 19, Dest: "size"},
+		ir.LoadIntConst{Value: 1 << 16, Dest: "chunk"},
+		ir.LoadIntConst{Value: 32, Dest: "n"},
+		ir.Call{Fun: "__new", Args: []ir.IRVar{"size"}, Dest: "p"},
+		ir.Call{Fun: "-", Args: []ir.IRVar{"p", "header"}, Dest: "garbage"},
+		ir.Label{Label: "loop"},
+		ir.Call{Fun: "__new", Args: []ir.IRVar{"chunk"}, Dest: "p"},
+		ir.Call{Fun: "-", Args: []ir.IRVar{"p", "garbage"}, Dest: "offset"},
+		ir.Call{Fun: "__delete", Args: []ir.IRVar{"p"}, Dest: "u"},
+		ir.Call{Fun: "-", Args: []ir.IRVar{"n", "one"}, Dest: "n"},
+		ir.CondJump{Cond: "n", ThenLabel: ir.Label{Label: "loop"}, ElseLabel: ir.Label{Label: "end"}},
+		ir.Label{Label: "end"},
+		ir.Call{Fun: "==", Args: []ir.IRVar{"offset", "header"}, Dest: "reused"},
+		ir.Call{Fun: "print_bool", Args: []ir.IRVar{"reused"}, Dest: "u"},
+	}
+	exe := filepath.Join(t.TempDir(), "heap")
+	asm := asmgenerator.GenerateASMWithOptions(map[string][]ir.Instruction{"main": body}, asmgenerator.Options{GC: true})
+	if _, err := Assemble(asm, exe); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(exe).Output()
+	if err != nil || string(out) != "false\n" {
+		t.Errorf("Expected the garbage block to stay in use, got %q (%v)", out, err)
+	}
+}
+
+func TestHeap_GcCollectBuiltin(t *testing.T) {
+	requireToolchain(t)
+	// Allocates 64 blocks of 32 MiB, twice the arena. gc_collect can be
+	// called either way but only collects with the collector enabled.
+	program := `
+		var i = 0;
+		var collect = gc_collect;
+		while i < 64 do {
+			var p = new Array[Int](4194304);
+			p[0] = i;
+			gc_collect();
+			collect();
+			i = i + 1;
+		}
+		print_int(i);
+	`
+	funcMap := irgenerator.Generate(typechecker.Infer(parser.Parse(tokenizer.Tokenize(program, ""))))
+	exe := filepath.Join(t.TempDir(), "heap")
+	for _, gc := range []bool{true, false} {
+		asm := asmgenerator.GenerateASMWithOptions(funcMap, asmgenerator.Options{GC: gc})
+		if _, err := Assemble(asm, exe); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(exe).Output()
+		if gc && (err != nil || string(out) != "64\n") {
+			t.Errorf("Expected 64 with the collector but got %q (%v)", out, err)
+		}
+		if exitErr, ok := err.(*exec.ExitError); !gc && (!ok || exitErr.ExitCode() != utils.RuntimeErrorOutOfMemory) {
+			t.Errorf("Expected out of memory without the collector, got %q (%v)", out, err)
+		}
+	}
+}
+
+// sameAsInterpreter compiles and runs program and checks that it prints
+// what the interpreter prints for it
+func sameAsInterpreter(t *testing.T, program string) {
+	t.Helper()
+	requireToolchain(t)
+	typed := typechecker.Infer(parser.Parse(tokenizer.Tokenize(program, "")))
+
+	exe := filepath.Join(t.TempDir(), "prog")
+	asm := asmgenerator.GenerateASM(irgenerator.Generate(typed))
+	if _, err := Assemble(asm, exe); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := exec.Command(exe).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	interpreter.Interpret(typed)
+	os.Stdout = stdout
+	w.Close()
+	interpreted, _ := io.ReadAll(r)
+
+	if string(compiled) != string(interpreted) {
+		t.Errorf("Compiled program printed %q, the interpreter %q", compiled, interpreted)
+	}
+}
+
+func TestIntegers_SameAsInterpreter(t *testing.T) {
+	t.Run("Negative numbers compare and divide as signed", func(t *testing.T) {
+		sameAsInterpreter(t, `
+			print_bool(-1 < 0);
+			print_int(-7 / 2);
+			print_int(-7 % 2);
+			print_int(7 / -2);
+			var m = -9223372036854775807 - 1;
+			print_bool(m < 1);
+			print_int(m - 1);
+			var minusOne = -1;
+			print_int(m / minusOne);
+			print_int(m % minusOne);
+			print_int(7 / minusOne);
+		`)
+	})
+	t.Run("Sized signed integers wrap around", func(t *testing.T) {
+		sameAsInterpreter(t, `
+			var a: Int8 = 127;
+			print_int((a + 1) as Int);
+			var b: Int16 = -32768;
+			print_int((b - 1) as Int);
+			var c: Int32 = 65536;
+			print_int((c * c) as Int);
+			var d: Int8 = -128;
+			print_int((-d) as Int);
+			print_int((d / -1) as Int);
+		`)
+	})
+	t.Run("Unsigned integers wrap around and compare as unsigned", func(t *testing.T) {
+		sameAsInterpreter(t, `
+			var a: UInt8 = 250;
+			print_int((a + 10) as Int);
+			var b: UInt32 = 0;
+			print_int((b - 1) as Int);
+			var c: UInt64 = 0;
+			c = c - 1;
+			print_bool(c > 1);
+			print_int((c / 2) as Int);
+			print_int((c % 10) as Int);
+			print_bool((1 as UInt16) >= 65535);
+		`)
+	})
+	t.Run("Casts keep the low bits", func(t *testing.T) {
+		sameAsInterpreter(t, `
+			var x = 300;
+			print_int((x as UInt8) as Int);
+			print_int((x as Int8) as Int);
+			print_int((-1 as UInt32) as Int);
+			var y: Int16 = -2;
+			print_int((y as UInt16) as Int);
+			print_int((y as UInt64 / 2) as Int);
+			const K: Int32 = 2147483647;
+			print_int((K + 1) as Int);
+		`)
+	})
+	t.Run("Hex, binary, octal and character literals", func(t *testing.T) {
+		sameAsInterpreter(t, `
+			var mask: UInt8 = 0b1111_0000;
+			print_int((mask / 0x10) as Int);
+			var all: UInt64 = 0xFFFF_FFFF_FFFF_FFFF;
+			print_int((all % 0o777) as Int);
+			print_int('z' - 'a' + 1_000);
+		`)
+	})
+	t.Run("Constants between 2^31 and 2^32", func(t *testing.T) {
+		sameAsInterpreter(t, `
+			var e: UInt32 = 4000000000;
+			print_int(e as Int);
+			print_int(0xFFFF_FFFF);
+			print_int(2147483648);
+			print_int(-2147483648);
+			print_int(-2147483649);
+			var f: UInt32 = 0xFFFF_FFFF;
+			print_bool(f > e);
+		`)
+	})
+}
+
+func TestIntrinsicNames_SameAsInterpreter(t *testing.T) {
+	t.Run("A function named c_bool", func(t *testing.T) {
+		sameAsInterpreter(t, `
+			fun c_bool(x: Int): Int { x + 1 }
+			print_int(c_bool(200));
+			print_bool(1 < 2 and c_bool(1) == 2);
+		`)
+	})
+
+	t.Run("A function named as_Int8", func(t *testing.T) {
+		sameAsInterpreter(t, `
+			fun as_Int8(x: Int): Int { x * 2 }
+			var b: Int8 = 100;
+			print_int(as_Int8(200));
+			print_int((b + b) as Int);
+		`)
+	})
+}
+
+func TestStdlibCache(t *testing.T) {
+	requireToolchain(t)
+	program := asmgenerator.GenerateASM(irgenerator.Generate(typechecker.Infer(parser.Parse(tokenizer.Tokenize("print_int(42);", "")))))
+	stdlibCache.Lock()
+	stdlibCache.objects = make(map[string][]byte)
+	stdlibCache.Unlock()
+	cached := func() int {
+		stdlibCache.Lock()
+		defer stdlibCache.Unlock()
+		return len(stdlibCache.objects)
+	}
+
+	t.Run("A cache hit links a working executable", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			exe := filepath.Join(t.TempDir(), "prog")
+			if _, err := Assemble(program, exe); err != nil {
+				t.Fatal(err)
+			}
+			out, err := exec.Command(exe).Output()
+			if err != nil || string(out) != "42\n" {
+				t.Errorf("Expected 42 from compile %d but got %q (%v)", i+1, out, err)
+			}
+		}
+		if cached() != 1 {
+			t.Errorf("Expected the stdlib to be cached once, got %d objects", cached())
+		}
+	})
+
+	t.Run("Flags with paths in the temp dir are part of the key", func(t *testing.T) {
+		dir := t.TempDir()
+		before := cached()
+		for _, include := range []string{"a", "b"} {
+			opts := Options{KeepTemps: dir, AssemblerFlags: []string{"-I", filepath.Join(dir, include)}}
+			if _, err := AssembleWithOptions(program, filepath.Join(dir, "prog"), opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cached() != before+2 {
+			t.Errorf("Expected an object for each include dir, got %d new objects", cached()-before)
+		}
+	})
+}
+
+func TestToolError(t *testing.T) {
+	t.Run("Invalid assembly reports the assembler's stderr", func(t *testing.T) {
+		requireToolchain(t)
+		_, err := Assemble("\tnot_an_instruction %rax\n", "")
+		var toolErr *ToolError
+		if !errors.As(err, &toolErr) {
+			t.Fatalf("Expected a ToolError, got %v", err)
+		}
+		if toolErr.Tool != "as" || !strings.Contains(toolErr.Stderr, "not_an_instruction") {
+			t.Errorf("Expected the stderr of as, got %q from %s", toolErr.Stderr, toolErr.Tool)
+		}
+		msg := err.Error()
+		if !strings.HasPrefix(msg, "as ") || !strings.Contains(msg, "exit status 1") || !strings.HasSuffix(msg, strings.TrimRight(toolErr.Stderr, "\n")) {
+			t.Errorf("Expected the tool, exit status and stderr in the message, got %q", msg)
+		}
+	})
+
+	t.Run("A missing assembler", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "no-such-as")
+		_, err := AssembleWithOptions("", "", Options{AssemblerPath: path, NoStdlibCache: true})
+		var toolErr *ToolError
+		if !errors.As(err, &toolErr) || toolErr.Tool != path {
+			t.Fatalf("Expected a ToolError for %s, got %v", path, err)
+		}
+		if !errors.Is(err, os.ErrNotExist) || !strings.HasPrefix(err.Error(), path+" ") {
+			t.Errorf("Expected the missing tool in the error, got %v", err)
+		}
+	})
+}
+
+func TestKeepTemps(t *testing.T) {
+	requireToolchain(t)
+	files := []string{"stdlib.s", "stdlib.o", "program.s", "program.o"}
+
+	t.Run("The intermediate files are kept", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "temps")
+		program := asmgenerator.GenerateASM(irgenerator.Generate(typechecker.Infer(parser.Parse(tokenizer.Tokenize("print_int(1);", "")))))
+		if _, err := AssembleWithOptions(program, filepath.Join(t.TempDir(), "prog"), Options{KeepTemps: dir}); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range files {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("Expected %s to be kept: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("The program is kept when it fails to assemble", func(t *testing.T) {
+		dir := t.TempDir()
+		program := "\tnot_an_instruction %rax\n"
+		if _, err := AssembleWithOptions(program, "", Options{KeepTemps: dir}); err == nil {
+			t.Fatal("Expected the assembler to fail")
+		}
+		kept, err := os.ReadFile(filepath.Join(dir, "program.s"))
+		if err != nil || string(kept) != program {
+			t.Errorf("Expected program.s to hold the program, got %q (%v)", kept, err)
+		}
+	})
+}
+
+func TestDebugInfo(t *testing.T) {
+	source := "fun square(x: Int): Int {\n  x * x\n}\nprint_int(square(3));\n"
+	generate := func(file string) string {
+		typed := typechecker.Infer(parser.Parse(tokenizer.Tokenize(source, file)))
+		return asmgenerator.GenerateASM(irgenerator.Generate(typed))
+	}
+
+	t.Run("Source lines and call frames", func(t *testing.T) {
+		asm := generate("square.src")
+		lines := strings.Split(asm, "\n")
+		for _, directive := range []string{`.file 1 "square.src"`, ".loc 1 2 3", ".loc 1 4 10"} {
+			if !slices.Contains(lines, directive) {
+				t.Errorf("Expected the directive %s in\n%s", directive, asm)
+			}
+		}
+		for _, name := range []string{"square", "main"} {
+			start := slices.Index(lines, name+":")
+			if start < 0 || lines[start+1] != ".cfi_startproc" {
+				t.Errorf("Expected %s to start with .cfi_startproc", name)
+				continue
+			}
+			end := slices.Index(lines[start:], ".cfi_endproc")
+			if end < 0 || slices.Contains(lines[start+2:start+end], ".cfi_startproc") {
+				t.Errorf("Expected %s to end with .cfi_endproc", name)
+			}
+		}
+		requireToolchain(t)
+		if _, err := AssembleWithOptions(asm, filepath.Join(t.TempDir(), "square.o"), Options{Output: Object}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("No line info without a file", func(t *testing.T) {
+		asm := generate("")
+		if strings.Contains(asm, ".file ") || strings.Contains(asm, ".loc ") {
+			t.Errorf("Expected no .file or .loc directives in\n%s", asm)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package ast
 
 import (
 	"compiler/tokenizer"
+	"reflect"
 )
 
 type Location = tokenizer.SourceLocation
@@ -11,6 +12,50 @@ type Expression interface {
 	GetLocation() Location
 }
 
+// Walk calls visit for expr and every expression nested in it, parents
+// before their children.
+func Walk(expr Expression, visit func(Expression)) {
+	if expr == nil {
+		return
+	}
+	visit(expr)
+	value := reflect.ValueOf(expr)
+	for i := 0; i < value.NumField(); i++ {
+		switch field := value.Field(i).Interface().(type) {
+		case Expression:
+			Walk(field, visit)
+		case []Expression:
+			for _, e := range field {
+				Walk(e, visit)
+			}
+		}
+	}
+}
+
+// Map returns a copy of expr where f has replaced every expression directly
+// nested in it.
+func Map(expr Expression, f func(Expression) Expression) Expression {
+	value := reflect.New(reflect.TypeOf(expr)).Elem()
+	value.Set(reflect.ValueOf(expr))
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		switch child := field.Interface().(type) {
+		case Expression:
+			field.Set(reflect.ValueOf(f(child)))
+		case []Expression:
+			if child == nil {
+				continue
+			}
+			mapped := make([]Expression, len(child))
+			for j, e := range child {
+				mapped[j] = f(e)
+			}
+			field.Set(reflect.ValueOf(mapped))
+		}
+	}
+	return value.Interface().(Expression)
+}
+
 type Literal struct {
 	Value    any
 	Location Location
@@ -55,6 +100,17 @@ func (i IfExpression) GetLocation() Location {
 	return i.Location
 }
 
+// StringLiteral is a string constant with its escape sequences decoded
+type StringLiteral struct {
+	Value    string
+	Location Location
+}
+
+func (StringLiteral) isExpression() {}
+func (s StringLiteral) GetLocation() Location {
+	return s.Location
+}
+
 type BooleanLiteral struct {
 	Boolean  string
 	Location Location
@@ -92,6 +148,10 @@ type Declaration struct {
 	Value    Expression
 	Typed    Expression
 	Location Location
+	// Kind is the keyword the variable is declared with: var, val for a
+	// variable that cannot be assigned to, or const for a top-level value
+	// known at compile time
+	Kind string
 }
 
 func (Declaration) isExpression() {}
@@ -103,6 +163,9 @@ type WhileLoop struct {
 	Condition Expression
 	Looping   Expression
 	Location  Location
+	// Label names the loop for break and continue (outer: while ...), empty
+	// when the loop has none
+	Label string
 }
 
 func (WhileLoop) isExpression() {}
@@ -110,6 +173,24 @@ func (w WhileLoop) GetLocation() Location {
 	return w.Location
 }
 
+// ForLoop is for (Init; Condition; Step) Body. Step also runs after a
+// continue. Init, Condition and Step can be nil; the variables Init declares
+// are only visible in the loop. The parser turns for i in a..b do Body into a
+// ForLoop as well.
+type ForLoop struct {
+	Init      Expression
+	Condition Expression
+	Step      Expression
+	Body      Expression
+	Location  Location
+	Label     string
+}
+
+func (ForLoop) isExpression() {}
+func (f ForLoop) GetLocation() Location {
+	return f.Location
+}
+
 type FunctionCall struct {
 	Name     Expression
 	Args     []Expression
@@ -125,6 +206,10 @@ type Module struct {
 	Functions []Expression
 	Block     Expression
 	Location  Location
+	Externs   []Expression
+	Structs   []Expression
+	Imports   []Expression
+	Enums     []Expression
 }
 
 // Module is not actually expression but the sake of GO it has to be done like this
@@ -154,8 +239,12 @@ func (r ReturnExpression) GetLocation() Location {
 	return r.Location
 }
 
+// BreakExpression leaves the innermost loop, or the one named Label. A
+// break with a Value makes that the value of the loop.
 type BreakExpression struct {
 	Location Location
+	Label    string
+	Value    Expression
 }
 
 func (BreakExpression) isExpression() {}
@@ -165,6 +254,7 @@ func (b BreakExpression) GetLocation() Location {
 
 type ContinueExpression struct {
 	Location Location
+	Label    string
 }
 
 func (ContinueExpression) isExpression() {}
@@ -179,6 +269,11 @@ type FunctionDefinition struct {
 	ResultType Expression
 	Body       Expression
 	Location   Location
+	// Public functions (pub fun) can be called from files that import this one
+	Public bool
+	// TypeParams name the type parameters of a generic function,
+	// fun id[T](x: T): T. They are Identifiers.
+	TypeParams []Expression
 }
 
 func (FunctionDefinition) isExpression() {}
@@ -186,6 +281,269 @@ func (f FunctionDefinition) GetLocation() Location {
 	return f.Location
 }
 
+// Lambda is an anonymous function: fun (x: Int): Int { x + n }. It captures
+// the values of the variables it uses when it is evaluated. ResultType is nil
+// when the result type is left to the body.
+type Lambda struct {
+	Params     []Expression
+	ResultType Expression
+	Body       Expression
+	Location   Location
+}
+
+func (Lambda) isExpression() {}
+func (l Lambda) GetLocation() Location {
+	return l.Location
+}
+
+// Import makes the public functions of another file available: import "math.src"
+type Import struct {
+	Path     string
+	Location Location
+}
+
+func (Import) isExpression() {}
+func (i Import) GetLocation() Location {
+	return i.Location
+}
+
+// ExternFunction declares a function defined outside the program, e.g. in C
+type ExternFunction struct {
+	Name       Expression
+	Params     []Expression
+	ResultType Expression
+	Location   Location
+}
+
+func (ExternFunction) isExpression() {}
+func (e ExternFunction) GetLocation() Location {
+	return e.Location
+}
+
+// PointerType is a type annotation such as Int*
+type PointerType struct {
+	Elem     Expression
+	Location Location
+}
+
+func (PointerType) isExpression() {}
+func (p PointerType) GetLocation() Location {
+	return p.Location
+}
+
+// ArrayType is a type annotation such as Array[Int]
+type ArrayType struct {
+	Elem     Expression
+	Location Location
+}
+
+func (ArrayType) isExpression() {}
+func (a ArrayType) GetLocation() Location {
+	return a.Location
+}
+
+// ArrayLiteral creates an array holding Elements: [1, 2, 3]
+type ArrayLiteral struct {
+	Elements []Expression
+	Location Location
+}
+
+func (ArrayLiteral) isExpression() {}
+func (a ArrayLiteral) GetLocation() Location {
+	return a.Location
+}
+
+// IndexExpression is an element of an array: a[i]
+type IndexExpression struct {
+	Array    Expression
+	Index    Expression
+	Location Location
+}
+
+func (IndexExpression) isExpression() {}
+func (i IndexExpression) GetLocation() Location {
+	return i.Location
+}
+
+// StructDefinition declares a record type: struct Point { x: Int, y: Int }.
+// Fields are Params.
+type StructDefinition struct {
+	Name     Expression
+	Fields   []Expression
+	Location Location
+}
+
+func (StructDefinition) isExpression() {}
+func (s StructDefinition) GetLocation() Location {
+	return s.Location
+}
+
+// EnumDefinition declares a tagged union: enum Shape { Circle(Int),
+// Rect(Int, Int), Empty }. Variants are EnumVariants.
+type EnumDefinition struct {
+	Name     Expression
+	Variants []Expression
+	Location Location
+}
+
+func (EnumDefinition) isExpression() {}
+func (e EnumDefinition) GetLocation() Location {
+	return e.Location
+}
+
+// EnumVariant is one case of an enum. Fields holds the types of its values.
+type EnumVariant struct {
+	Name     Expression
+	Fields   []Expression
+	Location Location
+}
+
+func (EnumVariant) isExpression() {}
+func (e EnumVariant) GetLocation() Location {
+	return e.Location
+}
+
+// MatchExpression picks the arm for the variant of Value:
+// match s { Circle(r) => r * r, _ => 0 }. Arms are MatchArms.
+type MatchExpression struct {
+	Value    Expression
+	Arms     []Expression
+	Location Location
+}
+
+func (MatchExpression) isExpression() {}
+func (m MatchExpression) GetLocation() Location {
+	return m.Location
+}
+
+// MatchArm runs Body when the value is the variant Variant, with Bindings
+// naming its fields. A Variant or binding named _ matches anything.
+type MatchArm struct {
+	Variant  Expression
+	Bindings []Expression
+	Body     Expression
+	Location Location
+}
+
+func (MatchArm) isExpression() {}
+func (m MatchArm) GetLocation() Location {
+	return m.Location
+}
+
+// StructLiteral creates a struct value: Point { x: 1, y: 2 }. Fields holds
+// the field names and Values the value given to each.
+type StructLiteral struct {
+	Name     Expression
+	Fields   []Expression
+	Values   []Expression
+	Location Location
+}
+
+func (StructLiteral) isExpression() {}
+func (s StructLiteral) GetLocation() Location {
+	return s.Location
+}
+
+// FieldAccess is a field of a struct value: p.x. Shape.Empty, with the name
+// of an enum, is a variant without fields, and Shape.Circle(1) calls the
+// variant to build one with fields.
+type FieldAccess struct {
+	Object   Expression
+	Field    Expression
+	Location Location
+}
+
+func (FieldAccess) isExpression() {}
+func (f FieldAccess) GetLocation() Location {
+	return f.Location
+}
+
+// TupleLiteral creates a tuple holding Elements: (1, true)
+type TupleLiteral struct {
+	Elements []Expression
+	Location Location
+}
+
+func (TupleLiteral) isExpression() {}
+func (t TupleLiteral) GetLocation() Location {
+	return t.Location
+}
+
+// TupleElement is an element of a tuple: t.0
+type TupleElement struct {
+	Tuple    Expression
+	Index    int
+	Location Location
+}
+
+func (TupleElement) isExpression() {}
+func (t TupleElement) GetLocation() Location {
+	return t.Location
+}
+
+// Destructuring declares a variable for each element of a tuple:
+// var (a, b) = f(). A name _ skips the element.
+type Destructuring struct {
+	Variables []Expression
+	Value     Expression
+	Location  Location
+	// Kind is var or val, like the Kind of a Declaration
+	Kind string
+}
+
+func (Destructuring) isExpression() {}
+func (d Destructuring) GetLocation() Location {
+	return d.Location
+}
+
+// TupleType is a type annotation such as (Int, Bool)
+type TupleType struct {
+	Elems    []Expression
+	Location Location
+}
+
+func (TupleType) isExpression() {}
+func (t TupleType) GetLocation() Location {
+	return t.Location
+}
+
+// Cast converts an integer to another integer type: x as UInt8. A value
+// that does not fit the type wraps around.
+type Cast struct {
+	Value    Expression
+	Type     Expression
+	Location Location
+}
+
+func (Cast) isExpression() {}
+func (c Cast) GetLocation() Location {
+	return c.Location
+}
+
+// NewExpression allocates a heap cell holding Value: new Int(42), or an
+// array of Value elements: new Array[Int](10)
+type NewExpression struct {
+	Type     Expression
+	Value    Expression
+	Location Location
+}
+
+func (NewExpression) isExpression() {}
+func (n NewExpression) GetLocation() Location {
+	return n.Location
+}
+
+// DeleteExpression frees the heap cell a pointer points to: delete p
+type DeleteExpression struct {
+	Value    Expression
+	Location Location
+}
+
+func (DeleteExpression) isExpression() {}
+func (d DeleteExpression) GetLocation() Location {
+	return d.Location
+}
+
 type FunType struct {
 	Params   []Expression
 	ResType  Expression
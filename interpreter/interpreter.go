@@ -4,107 +4,390 @@ import (
 	"compiler/ast"
 	"compiler/utils"
 	"fmt"
+	"math"
+	"reflect"
 )
 
 type Value = any
 
 type SymTab = utils.SymTab[Value]
 
-type breakSignal struct{}
-type continueSignal struct{}
+// Exit is returned by Interpret when the program called exit(code).
+type Exit struct {
+	Code int64
+}
+
+// breakSignal and continueSignal leave the innermost loop, or the loop named
+// label
+type breakSignal struct {
+	label string
+	value Value
+}
+type continueSignal struct {
+	label string
+}
 
 type returnSignal struct {
 	value Value
 }
 
+// RuntimeError is raised when the interpreted program fails at runtime, the
+// same way a compiled program would report it through __runtime_error.
+type RuntimeError struct {
+	Message  string
+	Location ast.Location
+	Status   int
+}
+
+func (e RuntimeError) Error() string {
+	return fmt.Sprintf("%s at %s", e.Message, e.Location.Position())
+}
+
 type userFunc struct {
 	params []string
 	body   ast.Expression
 	symTab *SymTab
 }
 
-func interpret(node ast.Expression, symTab *SymTab) Value {
+type externFunc struct {
+	name string
+}
+
+// builtinFunc is a function of the stdlib, which can also be used as a value.
+type builtinFunc struct {
+	name string
+}
+
+var builtins = []string{"print_int", "print_bool", "read_int", "print_string", "concat", "exit", "gc_collect"}
+
+func (b builtinFunc) call(args []Value) Value {
+	switch b.name {
+	case "print_int":
+		fmt.Println(args[0])
+		return args[0]
+	case "print_bool":
+		fmt.Println(args[0].(bool))
+		return args[0]
+	case "read_int":
+		return int64(0)
+	case "print_string":
+		fmt.Println(args[0].(string))
+		return nil
+	case "concat":
+		return args[0].(string) + args[1].(string)
+	case "exit":
+		panic(Exit{Code: args[0].(int64)})
+	case "gc_collect":
+		// The Go runtime collects the interpreter's values
+		return nil
+	}
+	panic(fmt.Sprintf("Unknown builtin %s", b.name))
+}
+
+// call applies a function value to its evaluated arguments.
+func (in *interpreter) call(fnVal Value, args []Value) Value {
+	switch f := fnVal.(type) {
+	case builtinFunc:
+		return f.call(args)
+	case externFunc:
+		panic(fmt.Sprintf("Extern function %s cannot be interpreted", f.name))
+	case userFunc:
+		fnTab := utils.NewSymTab(f.symTab)
+		for i, paramName := range f.params {
+			fnTab.Table[paramName] = args[i]
+		}
+		var result Value
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					if ret, ok := r.(returnSignal); ok {
+						result = ret.value
+					} else {
+						panic(r)
+					}
+				}
+			}()
+			result = in.interpret(f.body, fnTab)
+		}()
+		return result
+	}
+	panic(fmt.Sprintf("Not a function: %v", fnVal))
+}
+
+// capture copies the variables visible from symTab into a scope of their own
+// on top of the outermost one, which holds the functions. A lambda sees the
+// values its variables had when it was made, like a compiled closure.
+func capture(symTab *SymTab) *SymTab {
+	root := symTab
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	captured := utils.NewSymTab(root)
+	for cur := symTab; cur != root; cur = cur.Parent {
+		for name, value := range cur.Table {
+			if _, shadowed := captured.Table[name]; !shadowed {
+				captured.Table[name] = value
+			}
+		}
+	}
+	return captured
+}
+
+func paramNames(params []ast.Expression) []string {
+	var names []string
+	for _, p := range params {
+		names = append(names, p.(ast.Param).Name.(ast.Identifier).Name)
+	}
+	return names
+}
+
+// pointer refers to a variable by the scope it lives in. Cells made with
+// new live in a scope of their own and are the only ones delete frees.
+type pointer struct {
+	tab  *SymTab
+	name string
+	heap bool
+}
+
+func (p pointer) load() Value {
+	value, ok := p.tab.Table[p.name]
+	if !ok {
+		panic(fmt.Sprintf("Use of deleted pointer to %s", p.name))
+	}
+	return value
+}
+
+// array is shared by every value referring to it, like the heap array of the
+// compiled program.
+type array struct {
+	elems []Value
+}
+
+// record is a struct value. Fields are kept in words at the positions
+// StructLayout gives them in memory, and like arrays it is shared by every
+// value referring to it.
+type record struct {
+	layout *utils.StructLayout
+	words  []Value
+}
+
+// field returns the index of a field in the words of r.
+func (r *record) field(name ast.Expression) int {
+	offset, _ := r.layout.Offset(name.(ast.Identifier).Name)
+	return offset / 8
+}
+
+// tuple is a tuple value. Tuples cannot change, so unlike records they can be
+// shared freely.
+type tuple []Value
+
+// enumValue is a value of an enum: the tag of its variant and the values of
+// the variant's fields.
+type enumValue struct {
+	layout *utils.EnumLayout
+	tag    int
+	fields []Value
+}
+
+// enumVariant tells whether expr is a variant of an enum such as
+// Shape.Circle, which a variable called Shape would hide, and returns a value
+// of the variant without its fields.
+func enumVariant(expr ast.Expression, symTab *SymTab) (*enumValue, bool) {
+	access, ok := expr.(ast.FieldAccess)
+	if !ok {
+		return nil, false
+	}
+	object, ok := access.Object.(ast.Identifier)
+	if !ok {
+		return nil, false
+	}
+	if _, exists := definingScope(symTab, object.Name).Table[object.Name]; exists {
+		return nil, false
+	}
+	name := "enum " + object.Name
+	layout, ok := definingScope(symTab, name).Table[name].(*utils.EnumLayout)
+	if !ok {
+		return nil, false
+	}
+	tag, _ := layout.Tag(access.Field.(ast.Identifier).Name)
+	return &enumValue{layout: layout, tag: tag}, true
+}
+
+// match runs the first arm naming the variant of the value, or _, with the
+// fields the arm binds in a scope of their own.
+func (in *interpreter) match(n ast.MatchExpression, symTab *SymTab) Value {
+	value := in.interpret(n.Value, symTab).(*enumValue)
+	for _, a := range n.Arms {
+		arm := a.(ast.MatchArm)
+		name := arm.Variant.(ast.Identifier).Name
+		if name != "_" && name != value.layout.Variants[value.tag] {
+			continue
+		}
+		tab := utils.NewSymTab(symTab)
+		for i, b := range arm.Bindings {
+			if binding := b.(ast.Identifier).Name; binding != "_" {
+				tab.Table[binding] = value.fields[i]
+			}
+		}
+		return in.interpret(arm.Body, tab)
+	}
+	panic(fmt.Sprintf("No match arm for %s at %v", value.layout.Variants[value.tag], n.Location))
+}
+
+// maxArrayLength is the longest array that fits the compiled program's heap.
+const maxArrayLength = (1 << 30) / 8
+
+// element returns the array and index of a[i], raising a runtime error when
+// the index is out of range.
+func (in *interpreter) element(n ast.IndexExpression, symTab *SymTab) (*array, int64) {
+	a := in.interpret(n.Array, symTab).(*array)
+	index := in.interpret(n.Index, symTab).(int64)
+	if uint64(index) >= uint64(len(a.elems)) {
+		panic(RuntimeError{
+			Message:  "index out of range",
+			Location: n.Location,
+			Status:   utils.RuntimeErrorIndexOutOfRange,
+		})
+	}
+	return a, index
+}
+
+// zeroValue is the value of a fresh array element of the given type.
+func zeroValue(typed ast.Expression) Value {
+	if identifier, ok := typed.(ast.Identifier); ok {
+		if intType, ok := utils.IntTypes[identifier.Name]; ok {
+			return intType.Value(0)
+		}
+		if identifier.Name == "Bool" {
+			return false
+		}
+	}
+	return nil
+}
+
+// definingScope returns the scope where name is declared, or symTab if it
+// is not declared anywhere.
+func definingScope(symTab *SymTab, name string) *SymTab {
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if _, exists := cur.Table[name]; exists {
+			return cur
+		}
+	}
+	return symTab
+}
+
+func (in *interpreter) interpret(node ast.Expression, symTab *SymTab) Value {
 	switch n := node.(type) {
 
 	case ast.Module:
+		if len(n.Imports) > 0 {
+			imp := n.Imports[0].(ast.Import)
+			panic(fmt.Sprintf("Unresolved import %q at %v", imp.Path, imp.Location))
+		}
+		// Struct layouts are kept next to variables under "struct <name>"
+		for _, st := range n.Structs {
+			sd := st.(ast.StructDefinition)
+			layout := &utils.StructLayout{Name: sd.Name.(ast.Identifier).Name}
+			for _, f := range sd.Fields {
+				layout.Fields = append(layout.Fields, f.(ast.Param).Name.(ast.Identifier).Name)
+			}
+			symTab.Table["struct "+layout.Name] = layout
+		}
+		// Enum layouts are kept under "enum <name>"
+		for _, en := range n.Enums {
+			ed := en.(ast.EnumDefinition)
+			layout := &utils.EnumLayout{Name: ed.Name.(ast.Identifier).Name}
+			for _, v := range ed.Variants {
+				layout.Variants = append(layout.Variants, v.(ast.EnumVariant).Name.(ast.Identifier).Name)
+			}
+			symTab.Table["enum "+layout.Name] = layout
+		}
+		for _, ext := range n.Externs {
+			name := ext.(ast.ExternFunction).Name.(ast.Identifier).Name
+			symTab.Table[name] = externFunc{name: name}
+		}
 		for _, fn := range n.Functions {
 			fd := fn.(ast.FunctionDefinition)
 			name := fd.Name.(ast.Identifier).Name
-			var paramNames []string
-			for _, p := range fd.Params {
-				paramNames = append(paramNames, p.(ast.Param).Name.(ast.Identifier).Name)
-			}
 			symTab.Table[name] = userFunc{
-				params: paramNames,
+				params: paramNames(fd.Params),
 				body:   fd.Body,
 				symTab: symTab,
 			}
 		}
-		return interpret(n.Block, symTab)
+		return in.interpretTopLevel(n.Block, symTab)
 
 	case ast.Literal:
 
 		value, ok := n.Value.(uint64)
 		if ok {
-			return value
+			return int64(value)
 		} else {
 			panic(fmt.Sprintf("Unknown literal type %s", n.Value))
 		}
 
 	case ast.BinaryOp:
-		left := interpret(n.Left, symTab)
-		right := interpret(n.Right, symTab)
+		if n.Op == "=" {
+			right := in.interpret(n.Right, symTab)
+			if target, ok := n.Left.(ast.Unary); ok && target.Op == "*" {
+				ptr := in.interpret(target.Exp, symTab).(pointer)
+				ptr.load() // panics if the cell was deleted
+				ptr.tab.Table[ptr.name] = right
+				return right
+			}
+			if target, ok := n.Left.(ast.FieldAccess); ok {
+				r := in.interpret(target.Object, symTab).(*record)
+				r.words[r.field(target.Field)] = right
+				return right
+			}
+			if target, ok := n.Left.(ast.IndexExpression); ok {
+				a, index := in.element(target, symTab)
+				a.elems[index] = right
+				return right
+			}
+			name := n.Left.(ast.Identifier).Name
+			definingScope(symTab, name).Table[name] = right
+			return right
+		}
+		left := in.interpret(n.Left, symTab)
+		right := in.interpret(n.Right, symTab)
 
 		switch n.Op {
-		case "+":
-			return left.(uint64) + right.(uint64)
-		case "-":
-			return left.(uint64) - right.(uint64)
-		case "*":
-			return left.(uint64) * right.(uint64)
-		case "/":
-			return left.(uint64) / right.(uint64)
-		case "%":
-			return left.(uint64) % right.(uint64)
-		case "<":
-			return left.(uint64) < right.(uint64)
-		case ">":
-			return left.(uint64) > right.(uint64)
-		case ">=":
-			return left.(uint64) >= right.(uint64)
-		case "<=":
-			return left.(uint64) <= right.(uint64)
+		case "+", "-", "*", "<", ">", ">=", "<=":
+			in.checkOverflow(n.Op, left, right, n.Location)
+			return utils.IntOp(n.Op, left, right)
+		case "/", "%":
+			checkDivisor(right, n.Location)
+			in.checkOverflow(n.Op, left, right, n.Location)
+			return utils.IntOp(n.Op, left, right)
 		case "!=":
-			return left.(uint64) != right.(uint64)
+			return left != right
 		case "==":
-			return left.(uint64) == right.(uint64)
+			return left == right
 		case "and":
 			return left.(bool) && right.(bool)
 		case "or":
 			return left.(bool) || right.(bool)
-		case "=": // asserttion handled differently
-			symTab.Table[n.Left.(ast.Identifier).Name] = right.(uint64)
-			return right
 		}
 
 	case ast.IfExpression:
-		if interpret(n.Condition, symTab).(bool) {
+		if in.interpret(n.Condition, symTab).(bool) {
 			t := n.Then.(ast.Block)
 			for _, expr := range t.Expressions {
-				interpret(expr, symTab)
+				in.interpret(expr, symTab)
 			}
-			return interpret(t.Result, symTab)
+			return in.interpret(t.Result, symTab)
 		} else if n.Else != nil {
 			e := n.Else.(ast.Block)
 			for _, expr := range e.Expressions {
-				interpret(expr, symTab)
+				in.interpret(expr, symTab)
 			}
-			return interpret(e.Result, symTab)
+			return in.interpret(e.Result, symTab)
 		}
 		return nil
 
 	case ast.Declaration:
-		value := interpret(n.Value, symTab)
+		value := in.interpret(n.Value, symTab)
 		var str string
 		if identifier, ok := n.Variable.(ast.Identifier); ok {
 			str = identifier.Name
@@ -112,13 +395,13 @@ func interpret(node ast.Expression, symTab *SymTab) Value {
 		if _, exists := symTab.Table[str]; exists {
 			panic(fmt.Sprintf("%s already declared", n.Variable))
 		}
-		if n.Typed != nil {
-			if n.Typed.(ast.Identifier).Name == "Bool" {
+		if typed, ok := n.Typed.(ast.Identifier); ok {
+			if typed.Name == "Bool" {
 				if _, ok := value.(bool); !ok {
 					panic("Must be boolean")
 				}
-			} else if n.Typed.(ast.Identifier).Name == "Int" {
-				if _, ok := value.(uint64); !ok {
+			} else if intType, ok := utils.IntTypes[typed.Name]; ok {
+				if reflect.TypeOf(value) != reflect.TypeOf(intType.Value(0)) {
 					panic("Must be integer")
 				}
 			}
@@ -139,12 +422,112 @@ func interpret(node ast.Expression, symTab *SymTab) Value {
 		}
 
 	case ast.Unary:
-		value := interpret(n.Exp, symTab)
+		if n.Op == "&" {
+			if inner, ok := n.Exp.(ast.Unary); ok && inner.Op == "*" {
+				return in.interpret(inner.Exp, symTab)
+			}
+			name := n.Exp.(ast.Identifier).Name
+			return pointer{tab: definingScope(symTab, name), name: name}
+		}
+		value := in.interpret(n.Exp, symTab)
+		if n.Op == "*" {
+			return value.(pointer).load()
+		}
 		if _, ok := value.(utils.Bool); !ok && n.Op == "not" {
 			panic(fmt.Sprintf("Not allowed Unary %v", value))
 		}
+		if n.Op == "-" {
+			intType, _ := utils.IntOf(value)
+			in.checkOverflow("-", intType.Value(0), value, n.Location)
+			return utils.IntOp("-", intType.Value(0), value)
+		}
 		return value
 
+	case ast.Cast:
+		_, word := utils.IntOf(in.interpret(n.Value, symTab))
+		return utils.IntTypes[n.Type.(ast.Identifier).Name].Value(word)
+
+	case ast.NewExpression:
+		if typed, ok := n.Type.(ast.ArrayType); ok {
+			length := in.interpret(n.Value, symTab).(int64)
+			if uint64(length) > maxArrayLength {
+				panic(RuntimeError{
+					Message:  "out of memory",
+					Location: n.Location,
+					Status:   utils.RuntimeErrorOutOfMemory,
+				})
+			}
+			a := &array{elems: make([]Value, length)}
+			for i := range a.elems {
+				a.elems[i] = zeroValue(typed.Elem)
+			}
+			return a
+		}
+		cell := utils.NewSymTab[Value](nil)
+		cell.Table["new"] = in.interpret(n.Value, symTab)
+		return pointer{tab: cell, name: "new", heap: true}
+
+	case ast.ArrayLiteral:
+		a := &array{}
+		for _, e := range n.Elements {
+			a.elems = append(a.elems, in.interpret(e, symTab))
+		}
+		return a
+
+	case ast.StructLiteral:
+		name := "struct " + n.Name.(ast.Identifier).Name
+		layout := definingScope(symTab, name).Table[name].(*utils.StructLayout)
+		r := &record{layout: layout, words: make([]Value, len(layout.Fields))}
+		for i, f := range n.Fields {
+			r.words[r.field(f)] = in.interpret(n.Values[i], symTab)
+		}
+		return r
+
+	case ast.FieldAccess:
+		if value, ok := enumVariant(n, symTab); ok {
+			return value
+		}
+		r := in.interpret(n.Object, symTab).(*record)
+		return r.words[r.field(n.Field)]
+
+	case ast.TupleLiteral:
+		t := make(tuple, len(n.Elements))
+		for i, e := range n.Elements {
+			t[i] = in.interpret(e, symTab)
+		}
+		return t
+
+	case ast.TupleElement:
+		return in.interpret(n.Tuple, symTab).(tuple)[n.Index]
+
+	case ast.Destructuring:
+		t := in.interpret(n.Value, symTab).(tuple)
+		for i, v := range n.Variables {
+			name := v.(ast.Identifier).Name
+			if name == "_" {
+				continue
+			}
+			if _, exists := symTab.Table[name]; exists {
+				panic(fmt.Sprintf("%s already declared", name))
+			}
+			symTab.Table[name] = t[i]
+		}
+		return nil
+
+	case ast.IndexExpression:
+		a, index := in.element(n, symTab)
+		return a.elems[index]
+
+	case ast.DeleteExpression:
+		// Like the compiled runtime, delete ignores pointers to variables
+		if ptr := in.interpret(n.Value, symTab).(pointer); ptr.heap {
+			delete(ptr.tab.Table, ptr.name)
+		}
+		return nil
+
+	case ast.StringLiteral:
+		return n.Value
+
 	case ast.BooleanLiteral:
 		if n.Boolean == "true" {
 			return true
@@ -152,104 +535,197 @@ func interpret(node ast.Expression, symTab *SymTab) Value {
 		return false
 
 	case ast.FunctionCall:
-		name := n.Name.(ast.Identifier).Name
-		if name == "print_int" {
-			for _, a := range n.Args {
-				v := interpret(a, symTab).(uint64)
-				fmt.Println(v)
-				return v
+		if name, ok := n.Name.(ast.Identifier); ok && name.Name == "len" {
+			value := in.interpret(n.Args[0], symTab)
+			if str, ok := value.(string); ok {
+				return int64(len(str))
 			}
-		} else if name == "print_bool" {
+			return int64(len(value.(*array).elems))
+		}
+		if value, ok := enumVariant(n.Name, symTab); ok {
 			for _, a := range n.Args {
-				v := interpret(a, symTab).(bool)
-				fmt.Println(v)
-				return v
+				value.fields = append(value.fields, in.interpret(a, symTab))
 			}
-		} else if name == "read_int" {
-			return uint64(0)
+			return value
 		}
-		// Look up user-defined function
-		fnVal := interpret(n.Name, symTab)
-		uf, ok := fnVal.(userFunc)
-		if !ok {
-			panic(fmt.Sprintf("Not a function: %s", name))
+		fnVal := in.interpret(n.Name, symTab)
+		var args []Value
+		for _, a := range n.Args {
+			args = append(args, in.interpret(a, symTab))
 		}
-		fnTab := utils.NewSymTab(uf.symTab)
-		for i, paramName := range uf.params {
-			fnTab.Table[paramName] = interpret(n.Args[i], symTab)
+		return in.call(fnVal, args)
+
+	case ast.MatchExpression:
+		return in.match(n, symTab)
+
+	case ast.Lambda:
+		return userFunc{
+			params: paramNames(n.Params),
+			body:   n.Body,
+			symTab: capture(symTab),
 		}
-		var result Value
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					if ret, ok := r.(returnSignal); ok {
-						result = ret.value
-					} else {
-						panic(r)
-					}
-				}
-			}()
-			result = interpret(uf.body, fnTab)
-		}()
-		return result
 
 	case ast.Block:
 		tab := utils.NewSymTab(symTab)
 		for _, expr := range n.Expressions {
-			_ = interpret(expr, tab)
+			_ = in.interpret(expr, tab)
 		}
-		return interpret(n.Result, tab)
+		return in.interpret(n.Result, tab)
 
 	case ast.WhileLoop:
-		block := n.Looping.(ast.Block)
-		for interpret(n.Condition, symTab).(bool) {
-			brk := false
-			cont := false
-			allExprs := append(block.Expressions, block.Result)
-			for _, expr := range allExprs {
-				if expr == nil {
-					continue
-				}
-				func() {
-					defer func() {
-						if r := recover(); r != nil {
-							switch r.(type) {
-							case breakSignal:
-								brk = true
-							case continueSignal:
-								cont = true
-							default:
-								panic(r)
-							}
-						}
-					}()
-					_ = interpret(expr, symTab)
-				}()
-				if brk || cont {
-					break
-				}
+		for in.interpret(n.Condition, symTab).(bool) {
+			if brk, value := in.runLoopBody(n.Looping, symTab, n.Label); brk {
+				return value
 			}
-			if brk {
-				break
+		}
+		return nil
+
+	case ast.ForLoop:
+		tab := utils.NewSymTab(symTab)
+		if n.Init != nil {
+			in.interpret(n.Init, tab)
+		}
+		for n.Condition == nil || in.interpret(n.Condition, tab).(bool) {
+			if brk, value := in.runLoopBody(n.Body, tab, n.Label); brk {
+				return value
+			}
+			if n.Step != nil {
+				in.interpret(n.Step, tab)
 			}
 		}
 		return nil
 
 	case ast.BreakExpression:
-		panic(breakSignal{})
+		var value Value
+		if n.Value != nil {
+			value = in.interpret(n.Value, symTab)
+		}
+		panic(breakSignal{label: n.Label, value: value})
 
 	case ast.ContinueExpression:
-		panic(continueSignal{})
+		panic(continueSignal{label: n.Label})
 
 	case ast.ReturnExpression:
-		val := interpret(n.Result, symTab)
+		val := in.interpret(n.Result, symTab)
 		panic(returnSignal{value: val})
 	}
 	return nil
 }
 
+// runLoopBody runs one iteration of the loop named label and reports whether
+// it ended with break, and with which value. A continue just ends the
+// iteration. Signals for an outer loop are passed on.
+func (in *interpreter) runLoopBody(body ast.Expression, symTab *SymTab, label string) (brk bool, value Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch signal := r.(type) {
+			case breakSignal:
+				if signal.label != "" && signal.label != label {
+					panic(r)
+				}
+				brk, value = true, signal.value
+			case continueSignal:
+				if signal.label != "" && signal.label != label {
+					panic(r)
+				}
+			default:
+				panic(r)
+			}
+		}
+	}()
+	in.interpret(body, symTab)
+	return false, nil
+}
+
+// interpretTopLevel runs the top-level block of the program. Variables
+// declared directly in it are globals and go into the outermost scope, where
+// functions see them and lambdas do not copy them.
+func (in *interpreter) interpretTopLevel(node ast.Expression, symTab *SymTab) Value {
+	block, ok := node.(ast.Block)
+	if !ok {
+		return in.interpret(node, symTab)
+	}
+	for _, expr := range block.Expressions {
+		in.interpret(expr, symTab)
+	}
+	return in.interpret(block.Result, symTab)
+}
+
+func checkDivisor(divisor Value, loc ast.Location) {
+	if _, word := utils.IntOf(divisor); word == 0 {
+		panic(RuntimeError{
+			Message:  "division by zero",
+			Location: loc,
+			Status:   utils.RuntimeErrorDivisionByZero,
+		})
+	}
+}
+
+// checkOverflow raises a runtime error when the Int arithmetic a op b
+// overflows and overflow checking is on, as the compiled code does with
+// --check-overflow. The other integer types wrap around.
+func (in *interpreter) checkOverflow(op string, a Value, b Value, loc ast.Location) {
+	if !in.opts.CheckOverflow {
+		return
+	}
+	x, ok := a.(int64)
+	if !ok {
+		return
+	}
+	y := b.(int64)
+	var overflows bool
+	switch op {
+	case "+":
+		overflows = (y > 0 && x > math.MaxInt64-y) || (y < 0 && x < math.MinInt64-y)
+	case "-":
+		overflows = (y < 0 && x > math.MaxInt64+y) || (y > 0 && x < math.MinInt64+y)
+	case "*":
+		product := x * y
+		overflows = x != 0 && (product/x != y || (x == -1 && y == math.MinInt64))
+	case "/":
+		overflows = x == math.MinInt64 && y == -1
+	}
+	if overflows {
+		panic(RuntimeError{
+			Message:  "integer overflow",
+			Location: loc,
+			Status:   utils.RuntimeErrorOverflow,
+		})
+	}
+}
+
+// Options controls how programs are interpreted.
+type Options struct {
+	// CheckOverflow makes signed overflow of Int arithmetic a runtime error
+	CheckOverflow bool
+}
+
+// interpreter is the state of one run of a program
+type interpreter struct {
+	opts Options
+}
+
 func Interpret(nodes ast.Expression) Value {
+	return InterpretWithOptions(nodes, Options{})
+}
+
+func InterpretWithOptions(nodes ast.Expression, opts Options) (res Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			if exit, ok := r.(Exit); ok {
+				res = exit
+				return
+			}
+			panic(r)
+		}
+	}()
+	in := &interpreter{opts: opts}
 	tab := utils.NewSymTab[Value](nil)
-	res := interpret(nodes, tab)
-	return res
+	for _, name := range builtins {
+		tab.Table[name] = builtinFunc{name: name}
+	}
+	if _, ok := nodes.(ast.Module); ok {
+		return in.interpret(nodes, tab)
+	}
+	return in.interpretTopLevel(nodes, tab)
 }
@@ -3,6 +3,8 @@ package interpreter
 import (
 	"compiler/parser"
 	"compiler/tokenizer"
+	"compiler/typechecker"
+	"compiler/utils"
 	"fmt"
 	"testing"
 )
@@ -162,3 +164,374 @@ func TestInterpreter_MutualRecursion(t *testing.T) {
 		t.Errorf("Expected %v but got %v", expected, res)
 	}
 }
+
+func TestInterpreter_DivisionByZero(t *testing.T) {
+	defer func() {
+		r := recover()
+		rtErr, ok := r.(RuntimeError)
+		if !ok {
+			t.Fatalf("Expected RuntimeError, got %v", r)
+		}
+		expected := "division by zero at 1:24"
+		if rtErr.Error() != expected {
+			t.Errorf("Expected %v but got %v", expected, rtErr.Error())
+		}
+		if rtErr.Status != utils.RuntimeErrorDivisionByZero {
+			t.Errorf("Expected status %d but got %d", utils.RuntimeErrorDivisionByZero, rtErr.Status)
+		}
+	}()
+	helper("var x = 10; var y = 0; x % y")
+}
+
+func TestInterpreter_Exit(t *testing.T) {
+	res := helper("print_int(1); exit(7); print_int(2)")
+	if exit, ok := res.(Exit); !ok || exit.Code != 7 {
+		t.Errorf("Expected Exit{7} but got %v", res)
+	}
+}
+
+func TestInterpreter_GcCollect(t *testing.T) {
+	res := helper("var p = new Int(5); gc_collect(); var c = gc_collect; c(); *p")
+	if fmt.Sprintf("%v", res) != "5" {
+		t.Errorf("Expected 5 but got %v", res)
+	}
+}
+
+func TestInterpreter_Pointers(t *testing.T) {
+	res := helper(`
+		fun swap(a: Int*, b: Int*): Unit {
+			var t = *a;
+			*a = *b;
+			*b = t;
+		}
+		var x = 1;
+		var y = 2;
+		swap(&x, &y);
+		var c = new Int(x * 10);
+		*c = *c + y;
+		delete c;
+		x * 100 + y
+	`)
+	expected := "201"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_Arrays(t *testing.T) {
+	res := helper(`
+		fun sum(a: Array[Int]): Int {
+			var total = 0;
+			var i = 0;
+			while i < len(a) do {
+				total = total + a[i];
+				i = i + 1;
+			}
+			return total;
+		}
+		var a = new Array[Int](4);
+		var i = 0;
+		while i < len(a) do {
+			a[i] = i * i;
+			i = i + 1;
+		}
+		var m = [a, [10, 20]];
+		m[1][0] = 100;
+		sum(a) + m[1][0] + m[0][3]
+	`)
+	expected := "123"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_IndexOutOfRange(t *testing.T) {
+	defer func() {
+		r := recover()
+		rtErr, ok := r.(RuntimeError)
+		if !ok {
+			t.Fatalf("Expected RuntimeError, got %v", r)
+		}
+		expected := "index out of range at 1:26"
+		if rtErr.Error() != expected {
+			t.Errorf("Expected %v but got %v", expected, rtErr.Error())
+		}
+		if rtErr.Status != utils.RuntimeErrorIndexOutOfRange {
+			t.Errorf("Expected status %d but got %d", utils.RuntimeErrorIndexOutOfRange, rtErr.Status)
+		}
+	}()
+	helper("var a = [1, 2]; var b = a[2]; b")
+}
+
+func TestInterpreter_Structs(t *testing.T) {
+	res := helper(`
+		struct Point { x: Int, y: Int }
+		struct Line { from: Point, to: Point }
+		fun width(l: Line): Int {
+			return l.to.x - l.from.x;
+		}
+		var a = Point { y: 2, x: 1 };
+		var l = Line { from: a, to: Point { x: 5, y: 5 } };
+		a.x = 0;
+		l.to.y = width(l);
+		l.to.y * 10 + l.from.y
+	`)
+	expected := "52"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_Strings(t *testing.T) {
+	res := helper(`
+		var greeting = concat("Hello, ", "world");
+		if greeting == "Hello, world" and greeting != "" then {
+			len(greeting) * 10 + len("\n")
+		} else {
+			0
+		}
+	`)
+	expected := "121"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_Closures(t *testing.T) {
+	res := helper(`
+		fun adder(n: Int): (Int) => Int {
+			fun(x: Int): Int { x + n }
+		}
+		fun twice(f: (Int) => Int, x: Int): Int {
+			f(f(x))
+		}
+		fun scaler(): (Int) => Int {
+			var k = 3;
+			var scale = fun(x: Int) { x * k };
+			k = 100;
+			scale
+		}
+		var scale = scaler();
+		var count = new Int(0);
+		var tick = fun() { *count = *count + 1 };
+		tick();
+		tick();
+		twice(adder(10), scale(2)) + adder(*count)(0) * 1000
+	`)
+	expected := "2026"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_Globals(t *testing.T) {
+	res := helper(`
+		fun bump(by: Int): Unit {
+			total = total + by;
+		}
+		var total = 1;
+		var add = fun(x: Int) { bump(x); total };
+		bump(10);
+		add(100) * 10 + total
+	`)
+	expected := "1221"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_ForLoops(t *testing.T) {
+	res := helper(`
+		var visited = 0;
+		for i in 0..10 do {
+			if i == 3 then { continue }
+			if i == 8 then { break }
+			var bit = 1;
+			visited = visited + i * bit;
+		}
+		var steps = 0;
+		for (var j = 0; j < 10; j = j + 1) {
+			steps = steps + 1;
+			if j < 5 then { continue }
+			j = j + 1;
+		}
+		visited * 100 + steps
+	`)
+	// 0+1+2+4+5+6+7, and j takes 0 to 5, 7 and 9 as continue still steps
+	expected := "2508"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_LabeledLoops(t *testing.T) {
+	res := helper(`
+		var grid = [[1, 2, 3], [4, 5, 6], [7, 8, 9]];
+		var sum = 0;
+		rows: for r in 0..3 do {
+			for c in 0..3 do {
+				if grid[r][c] == 5 then { continue rows }
+				if grid[r][c] == 8 then { break rows }
+				sum = sum + grid[r][c];
+			}
+		}
+		var r = 0;
+		var first = while true do {
+			if grid[r][0] > 3 then { break grid[r][0] }
+			r = r + 1;
+		};
+		sum * 10 + first
+	`)
+	// 1+2+3+4+7, then the first row starting above 3 starts with 4
+	expected := "174"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_Enums(t *testing.T) {
+	res := helper(`
+		enum Shape { Circle(Int), Rect(Int, Int), Empty }
+		enum List { Nil, Cons(Shape, List) }
+		fun area(s: Shape): Int {
+			match s {
+				Circle(r) => 3 * r * r,
+				Rect(w, h) => w * h,
+				Empty => 0,
+			}
+		}
+		fun total(l: List): Int {
+			match l { Cons(s, rest) => area(s) + total(rest), _ => 0 }
+		}
+		var shapes = List.Cons(Shape.Circle(2), List.Cons(Shape.Empty, List.Cons(Shape.Rect(3, 4), List.Nil)));
+		total(shapes)
+	`)
+	expected := "24"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_Tuples(t *testing.T) {
+	res := helper(`
+		fun divmod(a: Int, b: Int): (Int, Int) { (a / b, a % b) }
+		fun swap(p: (Int, Bool)): (Bool, Int) { (p.1, p.0) }
+		var (q, r) = divmod(17, 5);
+		var (_, n) = swap((q, true));
+		var nested = ((q, r), n);
+		nested.0.1 * 10 + nested.1
+	`)
+	expected := "23"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_Generics(t *testing.T) {
+	res := helper(`
+		fun id[T](x: T): T { x }
+		fun apply[T, R](f: (T) => R, x: T): R { f(x) }
+		fun fill[T](n: Int, value: T): Array[T] {
+			var xs = new Array[T](n);
+			for i in 0..n do { xs[i] = value }
+			xs
+		}
+		var names = fill(2, id("ab"));
+		apply(fun(s: String): Int { len(s) }, names[1]) + len(fill(3, true)) * id(10)
+	`)
+	expected := "32"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_Inference(t *testing.T) {
+	res := helper(`
+		fun compose(f: (Int) => Int, g: (Int) => Int) { fun(x) { g(f(x)) } }
+		fun square(x: Int) { x * x }
+		var inc = fun(x) { x + 1 };
+		compose(inc, square)(6)
+	`)
+	expected := "49"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_ValAndConst(t *testing.T) {
+	res := helper(`
+		fun scaled(x: Int): Int { x * SCALE + OFFSET }
+		const SCALE = 10;
+		const OFFSET = 0 - SCALE / 3;
+		val (q, r) = (17 / 5, 17 % 5);
+		scaled(q) + r
+	`)
+	expected := "29"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_SignedIntegers(t *testing.T) {
+	res := helper("var a = -7; print_bool(a < 0); (a / 2) * 10 + a % 2")
+	expected := "-31"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_SizedIntegers(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		fun next(x: UInt8): UInt8 { x + 1 }
+		var small: Int8 = 127;
+		small = small + 1;
+		next(255) as Int * 1000 + small as Int
+	`, "")
+	res := Interpret(typechecker.Infer(parser.Parse(tokens)))
+	expected := "-128"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_IntLiterals(t *testing.T) {
+	res := helper("0x10 + 0b11 * 0o10 + 1_000 + 'A'")
+	expected := "1105"
+	if fmt.Sprintf("%v", res) != expected {
+		t.Errorf("Expected %v but got %v", expected, res)
+	}
+}
+
+func TestInterpreter_CheckOverflow(t *testing.T) {
+	overflow := func(program string) (err any) {
+		defer func() {
+			err = recover()
+		}()
+		tokens := tokenizer.Tokenize(program, "")
+		InterpretWithOptions(typechecker.Infer(parser.Parse(tokens)), Options{CheckOverflow: true})
+		return nil
+	}
+	t.Run("Int overflow is a runtime error", func(t *testing.T) {
+		r := overflow("var m = 9223372036854775807; print_int(1); m * 2")
+		rtErr, ok := r.(RuntimeError)
+		if !ok || rtErr.Error() != "integer overflow at 1:44" || rtErr.Status != utils.RuntimeErrorOverflow {
+			t.Errorf("Expected integer overflow at 1:44, got %v", r)
+		}
+	})
+	t.Run("MinInt64 / -1 overflows", func(t *testing.T) {
+		if _, ok := overflow("var m = -9223372036854775807 - 1; var d = -1; m / d").(RuntimeError); !ok {
+			t.Errorf("Expected an overflow")
+		}
+	})
+	t.Run("Other integer types wrap around", func(t *testing.T) {
+		if r := overflow("var a: Int8 = 127; var b: UInt64 = 0; (a + 1) as Int + (b - 1) as Int"); r != nil {
+			t.Errorf("Expected no error, got %v", r)
+		}
+	})
+	t.Run("Without the option Int wraps around", func(t *testing.T) {
+		res := helper("var m = 9223372036854775807; m + 1")
+		if fmt.Sprintf("%v", res) != "-9223372036854775808" {
+			t.Errorf("Expected -9223372036854775808 but got %v", res)
+		}
+	})
+}
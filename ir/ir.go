@@ -24,6 +24,17 @@ func (BaseInstruction) isInstruction() {}
 
 type IRVar = string
 
+// Global returns the IR variable of a module-level variable. Globals are
+// shared by all functions and kept in static memory instead of a frame.
+func Global(name string) IRVar {
+	return "global." + name
+}
+
+// IsGlobal reports whether v is a module-level variable.
+func IsGlobal(v IRVar) bool {
+	return strings.HasPrefix(v, "global.")
+}
+
 type LoadBoolConst struct {
 	BaseInstruction
 	Value bool
@@ -52,6 +63,21 @@ func (l LoadIntConst) GetVars() []IRVar {
 	return []IRVar{l.Dest}
 }
 
+// LoadStringConst points Dest to a constant string
+type LoadStringConst struct {
+	BaseInstruction
+	Value string
+	Dest  IRVar
+}
+
+func (l LoadStringConst) String() string {
+	return fmt.Sprintf("LoadStringConst(%q, %v)", l.Value, l.Dest)
+}
+
+func (l LoadStringConst) GetVars() []IRVar {
+	return []IRVar{l.Dest}
+}
+
 type Copy struct {
 	BaseInstruction
 	Source IRVar
@@ -83,6 +109,78 @@ func (c Call) GetVars() []IRVar {
 	return append([]IRVar{c.Dest}, c.Args...)
 }
 
+// CallClosure calls a function value. Closure points to a record whose first
+// word is the code to call, which gets the record itself before Args so it
+// can load the values it captured.
+type CallClosure struct {
+	BaseInstruction
+	Closure IRVar
+	Args    []IRVar
+	Dest    IRVar
+}
+
+func (c CallClosure) String() string {
+	return fmt.Sprintf("CallClosure(%v, [%s], %v)", c.Closure, strings.Join(c.Args, ", "), c.Dest)
+}
+
+func (c CallClosure) GetVars() []IRVar {
+	return append([]IRVar{c.Closure, c.Dest}, c.Args...)
+}
+
+// LoadFunction puts the address of the code of function Fun into Dest
+type LoadFunction struct {
+	BaseInstruction
+	Fun  string
+	Dest IRVar
+}
+
+func (l LoadFunction) String() string {
+	return fmt.Sprintf("LoadFunction(%v, %v)", l.Fun, l.Dest)
+}
+
+func (l LoadFunction) GetVars() []IRVar {
+	return []IRVar{l.Dest}
+}
+
+// Load reads the value Offset bytes past Address into Dest
+type Load struct {
+	BaseInstruction
+	Address IRVar
+	Offset  int
+	Dest    IRVar
+}
+
+func (l Load) String() string {
+	return fmt.Sprintf("Load(%v, %v)", withOffset(l.Address, l.Offset), l.Dest)
+}
+
+func (l Load) GetVars() []IRVar {
+	return []IRVar{l.Address, l.Dest}
+}
+
+// Store writes Value to the memory Offset bytes past Address
+type Store struct {
+	BaseInstruction
+	Value   IRVar
+	Address IRVar
+	Offset  int
+}
+
+func (s Store) String() string {
+	return fmt.Sprintf("Store(%v, %v)", s.Value, withOffset(s.Address, s.Offset))
+}
+
+func (s Store) GetVars() []IRVar {
+	return []IRVar{s.Value, s.Address}
+}
+
+func withOffset(address IRVar, offset int) string {
+	if offset == 0 {
+		return address
+	}
+	return fmt.Sprintf("%v+%d", address, offset)
+}
+
 type Jump struct {
 	BaseInstruction
 	Label Label
@@ -111,6 +209,25 @@ func (c CondJump) GetVars() []IRVar {
 	return []IRVar{c.Cond}
 }
 
+// JumpTable jumps to Labels[Index]. Index must be in range.
+type JumpTable struct {
+	BaseInstruction
+	Index  IRVar
+	Labels []Label
+}
+
+func (j JumpTable) String() string {
+	labels := make([]string, len(j.Labels))
+	for i, l := range j.Labels {
+		labels[i] = l.String()
+	}
+	return fmt.Sprintf("JumpTable(%v, [%s])", j.Index, strings.Join(labels, ", "))
+}
+
+func (j JumpTable) GetVars() []IRVar {
+	return []IRVar{j.Index}
+}
+
 type Return struct {
 	BaseInstruction
 	Value IRVar
@@ -5,7 +5,9 @@ import (
 	"compiler/ir"
 	"compiler/utils"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 type IRVar = ir.IRVar
@@ -13,12 +15,60 @@ type Type = utils.Type
 type SymTab = utils.SymTab[IRVar]
 
 type IRGenerator struct {
-	varTypes        map[IRVar]Type
-	rootTypes       map[IRVar]Type
-	instructions    []ir.Instruction
-	loopStartLabel  *ir.Label
-	loopEndLabel    *ir.Label
+	varTypes     map[IRVar]Type
+	rootTypes    map[IRVar]Type
+	instructions []ir.Instruction
+	// loops are the loops around the code being generated, innermost last
+	loops           []*loop
 	funcReturnTypes map[string]Type
+	externFuncs     map[string]utils.Fun
+	structs         map[string]utils.Struct
+	enums           map[string]utils.Enum
+	module          *module
+	// typeArgs are the types the type parameters stand for in an instance of
+	// a generic function
+	typeArgs map[string]Type
+}
+
+// loop is a loop being generated: continue jumps to next and break to end.
+// result holds the value the loop is left with by break with a value.
+type loop struct {
+	label  string
+	next   ir.Label
+	end    ir.Label
+	result IRVar
+}
+
+// module is shared by the generators of all functions of a program. Besides
+// the program's own functions, funcs collects the ones made for function
+// values: one for every lambda and a wrapper for every named function used as
+// a value. Their code gets the closure record as its first parameter.
+type module struct {
+	funcs      map[string][]ir.Instruction
+	types      map[string]map[IRVar]Type
+	rootSymTab *SymTab
+	funcSigs   map[string]utils.Fun
+	// globals are the types of the variables declared in the top-level block
+	globals map[IRVar]Type
+	lambdas int
+	// generics are the generic functions by name. A generic function is only
+	// generated as instances, one for every list of types it is called with:
+	// instances maps such a call, like pair[Int, Bool], to the name of its
+	// instance and pending holds the instances still to be generated.
+	generics  map[string]ast.FunctionDefinition
+	instances map[string]IRVar
+	pending   []instance
+	// constants are the values of the consts of the top-level block, an
+	// uint64 or a bool, by the name the root scope gives them. A use of a
+	// const loads its value instead of reading a variable.
+	constants map[IRVar]any
+}
+
+// instance is an instance of a generic function waiting to be generated
+type instance struct {
+	name     IRVar
+	fd       ast.FunctionDefinition
+	typeArgs map[string]Type
 }
 
 func new(rootTypes map[IRVar]Type) *IRGenerator {
@@ -34,7 +84,21 @@ func new(rootTypes map[IRVar]Type) *IRGenerator {
 	return gen
 }
 
+// Options controls how the top level of the program is lowered.
+type Options struct {
+	// ExitWithResult makes an Int result of the top-level block the exit
+	// status of the program instead of printing it.
+	ExitWithResult bool
+}
+
 func Generate(rootExpr ast.Expression) map[string][]ir.Instruction {
+	funcs, _ := GenerateWithTypes(rootExpr, Options{})
+	return funcs
+}
+
+// GenerateWithTypes is like Generate but also returns the IR variable types
+// tracked while generating each function, keyed by function name.
+func GenerateWithTypes(rootExpr ast.Expression, opts Options) (map[string][]ir.Instruction, map[string]map[IRVar]Type) {
 	rootTypes := map[IRVar]utils.Type{
 		"+":          utils.Int{},
 		"*":          utils.Int{},
@@ -52,98 +116,204 @@ func Generate(rootExpr ast.Expression) map[string][]ir.Instruction {
 		"print_int":  utils.Fun{Params: []utils.Type{utils.Int{}}, Res: utils.Unit{}},
 		"print_bool": utils.Fun{Params: []utils.Type{utils.Bool{}}, Res: utils.Unit{}},
 		"read_int":   utils.Fun{Params: []utils.Type{}, Res: utils.Int{}},
+		"exit":       utils.Fun{Params: []utils.Type{utils.Int{}}, Res: utils.Unit{}},
+		"gc_collect": utils.Fun{Params: []utils.Type{}, Res: utils.Unit{}},
+
+		"print_string":    utils.Fun{Params: []utils.Type{utils.String{}}, Res: utils.Unit{}},
+		"concat":          utils.Fun{Params: []utils.Type{utils.String{}, utils.String{}}, Res: utils.String{}},
+		"__string_equals": utils.Fun{Params: []utils.Type{utils.String{}, utils.String{}}, Res: utils.Bool{}},
 	}
 
 	funcs := make(map[string][]ir.Instruction)
+	types := make(map[string]map[IRVar]Type)
+	rootSymTab := utils.NewSymTab[IRVar](nil)
+	for v := range rootTypes {
+		rootSymTab.Table[v] = v
+	}
+	shared := &module{
+		funcs:      funcs,
+		types:      types,
+		rootSymTab: rootSymTab,
+		funcSigs:   make(map[string]utils.Fun),
+		globals:    make(map[IRVar]Type),
+		generics:   make(map[string]ast.FunctionDefinition),
+		instances:  make(map[string]IRVar),
+		constants:  make(map[IRVar]any),
+	}
 
 	// Handle Module: generate IR for each function definition
 	if mod, ok := rootExpr.(ast.Module); ok {
-		rootSymTab := utils.NewSymTab[IRVar](nil)
-		for v := range rootTypes {
-			rootSymTab.Table[v] = v
-		}
 
-		// Collect function type info (return types)
+		structs, enums := defineIRTypes(mod.Structs, mod.Enums)
+
+		// Collect function type info (return types and signatures)
 		funcTypes := make(map[string]utils.Type)
+		funcSigs := shared.funcSigs
 		for _, fn := range mod.Functions {
 			fd := fn.(ast.FunctionDefinition)
 			name := fd.Name.(ast.Identifier).Name
 			rootSymTab.Table[name] = name
-			retType := resolveIRType(fd.ResultType.(ast.Identifier).Name)
+			if len(fd.TypeParams) > 0 {
+				shared.generics[name] = fd
+				continue
+			}
+			retType := resolveIRTypeExpr(fd.ResultType, structs, enums)
 			funcTypes[name] = retType
-		}
-
-		for _, fn := range mod.Functions {
-			fd := fn.(ast.FunctionDefinition)
-			name := fd.Name.(ast.Identifier).Name
-
-			g := new(rootTypes)
-			g.funcReturnTypes = funcTypes
-			// Copy function names into this generator's varTypes
-			for _, fn2 := range mod.Functions {
-				fd2 := fn2.(ast.FunctionDefinition)
-				n2 := fd2.Name.(ast.Identifier).Name
-				g.varTypes[n2] = utils.Fun{}
+			var paramTypes []utils.Type
+			for _, p := range fd.Params {
+				paramTypes = append(paramTypes, resolveIRTypeExpr(p.(ast.Param).Type, structs, enums))
 			}
-
-			fnSymTab := utils.NewSymTab(rootSymTab)
-			for i, p := range fd.Params {
-				param := p.(ast.Param)
-				pName := param.Name.(ast.Identifier).Name
-				pType := resolveIRType(param.Type.(ast.Identifier).Name)
-				paramVar := g.newVar(pType)
-				fnSymTab.Table[pName] = paramVar
-				g.instructions = append(g.instructions, ir.LoadParam{
-					BaseInstruction: ir.BaseInstruction{Location: param.GetLocation()},
-					Index:           i,
-					Dest:            paramVar,
-				})
-				fnSymTab.Table[pName] = paramVar
+			funcSigs[name] = utils.Fun{Params: paramTypes, Res: retType}
+		}
+		externFuncs := make(map[string]utils.Fun)
+		for _, ext := range mod.Externs {
+			ef := ext.(ast.ExternFunction)
+			name := ef.Name.(ast.Identifier).Name
+			rootSymTab.Table[name] = name
+			var paramTypes []utils.Type
+			for _, p := range ef.Params {
+				paramTypes = append(paramTypes, resolveIRTypeExpr(p.(ast.Param).Type, structs, enums))
 			}
-			g.visit(fnSymTab, fd.Body)
-			funcs[name] = g.instructions
+			externFuncs[name] = utils.Fun{Params: paramTypes, Res: resolveIRTypeExpr(ef.ResultType, structs, enums)}
+			funcSigs[name] = externFuncs[name]
 		}
 
-		// Generate main
-		g := new(rootTypes)
-		g.funcReturnTypes = funcTypes
+		top := new(rootTypes)
+		top.funcReturnTypes = funcTypes
+		top.externFuncs = externFuncs
+		top.structs = structs
+		top.enums = enums
+		top.module = shared
+
+		// Main goes first: the functions can use the globals it declares
+		g := top.spawn()
+		result := g.topLevel(mod.Block)
+		emitTopLevelResult(g, result, rootExpr, opts)
+		funcs["main"] = g.instructions
+		types["main"] = g.varTypes
+
 		for _, fn := range mod.Functions {
 			fd := fn.(ast.FunctionDefinition)
-			name := fd.Name.(ast.Identifier).Name
-			g.varTypes[name] = utils.Fun{}
+			if len(fd.TypeParams) == 0 {
+				top.spawn().function(fd.Name.(ast.Identifier).Name, fd)
+			}
 		}
-		mainSymTab := utils.NewSymTab(rootSymTab)
-		result := g.visit(mainSymTab, mod.Block)
-		emitTopLevelPrint(g, result, rootExpr)
-		funcs["main"] = g.instructions
+		// The calls above ask for instances of the generic functions, and
+		// the instances can ask for more
+		for len(shared.pending) > 0 {
+			inst := shared.pending[0]
+			shared.pending = shared.pending[1:]
+			g := top.spawn()
+			g.typeArgs = inst.typeArgs
+			g.function(inst.name, inst.fd)
+		}
+
 	} else {
 		// No module, just a top-level expression
 		g := new(rootTypes)
-		rootSymTab := utils.NewSymTab[IRVar](nil)
-		for v := range g.varTypes {
-			rootSymTab.Table[v] = v
-		}
-		result := g.visit(rootSymTab, rootExpr)
-		emitTopLevelPrint(g, result, rootExpr)
+		g.module = shared
+		result := g.topLevel(rootExpr)
+		emitTopLevelResult(g, result, rootExpr, opts)
 		funcs["main"] = g.instructions
+		types["main"] = g.varTypes
 	}
 
-	return funcs
+	return funcs, types
 }
 
 func resolveIRType(name string) utils.Type {
+	if intType, ok := utils.IntTypes[name]; ok {
+		return intType
+	}
 	switch name {
-	case "Int":
-		return utils.Int{Name: "Int"}
 	case "Bool":
 		return utils.Bool{Name: "Bool"}
+	case "String":
+		return utils.String{Name: "String"}
+	case "Unit":
+		return utils.Unit{Name: "Unit"}
 	default:
-		return utils.Unit{Name: name}
+		// The typechecker has made sure any other name is a type parameter
+		return utils.TypeParam{Name: name}
+	}
+}
+
+func resolveIRTypeExpr(expr ast.Expression, structs map[string]utils.Struct, enums map[string]utils.Enum) utils.Type {
+	switch typed := expr.(type) {
+	case ast.PointerType:
+		return utils.Pointer{Elem: resolveIRTypeExpr(typed.Elem, structs, enums)}
+	case ast.ArrayType:
+		return utils.Array{Elem: resolveIRTypeExpr(typed.Elem, structs, enums)}
+	case ast.FunType:
+		var params []utils.Type
+		for _, p := range typed.Params {
+			params = append(params, resolveIRTypeExpr(p, structs, enums))
+		}
+		return utils.Fun{Params: params, Res: resolveIRTypeExpr(typed.ResType, structs, enums)}
+	case ast.TupleType:
+		var elems []utils.Type
+		for _, e := range typed.Elems {
+			elems = append(elems, resolveIRTypeExpr(e, structs, enums))
+		}
+		return utils.Tuple{Elems: elems}
+	}
+	name := expr.(ast.Identifier).Name
+	if structType, ok := structs[name]; ok {
+		return structType
+	}
+	if enumType, ok := enums[name]; ok {
+		return enumType
 	}
+	return resolveIRType(name)
 }
 
-func emitTopLevelPrint(g *IRGenerator, result IRVar, rootExpr ast.Expression) {
-	if _, ok := g.varTypes[result].(utils.Int); ok {
+// defineIRTypes lays out the struct and enum types of a module by name. All
+// names are known before the fields are resolved, as the types can refer to
+// each other.
+func defineIRTypes(structDefs []ast.Expression, enumDefs []ast.Expression) (map[string]utils.Struct, map[string]utils.Enum) {
+	structs := make(map[string]utils.Struct)
+	for _, def := range structDefs {
+		name := def.(ast.StructDefinition).Name.(ast.Identifier).Name
+		structs[name] = utils.Struct{StructLayout: &utils.StructLayout{Name: name}}
+	}
+	enums := make(map[string]utils.Enum)
+	for _, def := range enumDefs {
+		name := def.(ast.EnumDefinition).Name.(ast.Identifier).Name
+		enums[name] = utils.Enum{EnumLayout: &utils.EnumLayout{Name: name}}
+	}
+	for _, def := range structDefs {
+		sd := def.(ast.StructDefinition)
+		layout := structs[sd.Name.(ast.Identifier).Name].StructLayout
+		for _, f := range sd.Fields {
+			field := f.(ast.Param)
+			layout.Fields = append(layout.Fields, field.Name.(ast.Identifier).Name)
+			layout.Types = append(layout.Types, resolveIRTypeExpr(field.Type, structs, enums))
+		}
+	}
+	for _, def := range enumDefs {
+		ed := def.(ast.EnumDefinition)
+		layout := enums[ed.Name.(ast.Identifier).Name].EnumLayout
+		for _, v := range ed.Variants {
+			variant := v.(ast.EnumVariant)
+			var fields []utils.Type
+			for _, f := range variant.Fields {
+				fields = append(fields, resolveIRTypeExpr(f, structs, enums))
+			}
+			layout.Variants = append(layout.Variants, variant.Name.(ast.Identifier).Name)
+			layout.Fields = append(layout.Fields, fields)
+		}
+	}
+	return structs, enums
+}
+
+func emitTopLevelResult(g *IRGenerator, result IRVar, rootExpr ast.Expression, opts Options) {
+	if _, ok := g.varTypes[result].(utils.Int); ok && opts.ExitWithResult {
+		g.instructions = append(g.instructions, ir.Return{
+			BaseInstruction: ir.BaseInstruction{Location: rootExpr.GetLocation()},
+			Value:           result,
+		})
+	} else if intType, ok := g.varTypes[result].(utils.Int); ok && !(intType.Unsigned && intType.Width() == 64) {
+		// print_int cannot print the upper half of UInt64
 		g.instructions = append(g.instructions, ir.Call{
 			BaseInstruction: ir.BaseInstruction{Location: rootExpr.GetLocation()},
 			Fun:             "print_int",
@@ -157,7 +327,232 @@ func emitTopLevelPrint(g *IRGenerator, result IRVar, rootExpr ast.Expression) {
 			Args:            []IRVar{result},
 			Dest:            g.newVar(utils.Unit{}),
 		})
+	} else if _, ok := g.varTypes[result].(utils.String); ok {
+		g.instructions = append(g.instructions, ir.Call{
+			BaseInstruction: ir.BaseInstruction{Location: rootExpr.GetLocation()},
+			Fun:             "print_string",
+			Args:            []IRVar{result},
+			Dest:            g.newVar(utils.Unit{}),
+		})
+	}
+}
+
+// spawn returns a generator for another function of the same module.
+func (g *IRGenerator) spawn() *IRGenerator {
+	child := new(g.rootTypes)
+	child.funcReturnTypes = g.funcReturnTypes
+	child.externFuncs = g.externFuncs
+	child.structs = g.structs
+	child.enums = g.enums
+	child.module = g.module
+	child.typeArgs = g.typeArgs
+	// Copy function names into the new generator's varTypes
+	for name, sig := range g.module.funcSigs {
+		child.varTypes[name] = sig
+	}
+	for global, t := range g.module.globals {
+		child.varTypes[global] = t
+	}
+	return child
+}
+
+// function generates the function fd under the name name. Its parameters
+// are in the root scope, next to the functions and globals.
+func (g *IRGenerator) function(name string, fd ast.FunctionDefinition) {
+	fnSymTab := utils.NewSymTab(g.module.rootSymTab)
+	for i, p := range fd.Params {
+		param := p.(ast.Param)
+		pName := param.Name.(ast.Identifier).Name
+		paramVar := g.newVar(g.resolveType(param.Type))
+		g.instructions = append(g.instructions, ir.LoadParam{
+			BaseInstruction: ir.BaseInstruction{Location: param.GetLocation()},
+			Index:           i,
+			Dest:            paramVar,
+		})
+		fnSymTab.Table[pName] = paramVar
+	}
+	result := g.visit(fnSymTab, fd.Body)
+	g.returnResult(result, g.resolveType(fd.ResultType), fd.Body.GetLocation())
+	g.module.funcs[name] = g.instructions
+	g.module.types[name] = g.varTypes
+}
+
+// resolveType resolves a type annotation in the function being generated,
+// where the type parameters of a generic function stand for its type
+// arguments.
+func (g *IRGenerator) resolveType(expr ast.Expression) Type {
+	return utils.Substitute(resolveIRTypeExpr(expr, g.structs, g.enums), g.typeArgs)
+}
+
+// topLevel generates the top-level block of the program. Variables declared
+// directly in it are globals, kept in the root scope where every function
+// sees them.
+func (g *IRGenerator) topLevel(expr ast.Expression) IRVar {
+	root := g.module.rootSymTab
+	block, ok := expr.(ast.Block)
+	if !ok {
+		return g.visit(utils.NewSymTab(root), expr)
+	}
+	for _, e := range block.Expressions {
+		g.topLevelExpression(e)
+	}
+	if block.Result == nil {
+		return "unit"
+	}
+	return g.topLevelExpression(block.Result)
+}
+
+func (g *IRGenerator) topLevelExpression(expr ast.Expression) IRVar {
+	root := g.module.rootSymTab
+	switch decl := expr.(type) {
+	case ast.Declaration:
+		if decl.Kind == "const" {
+			g.declareConstant(decl.Variable.(ast.Identifier).Name, g.constant(decl.Value))
+			return "unit"
+		}
+		value := g.visit(root, decl.Value)
+		g.declareGlobal(decl.Variable.(ast.Identifier).Name, value, decl.GetLocation())
+		return "unit"
+	case ast.Destructuring:
+		for i, element := range g.destructure(root, decl) {
+			if name := decl.Variables[i].(ast.Identifier).Name; name != "_" {
+				g.declareGlobal(name, element, decl.GetLocation())
+			}
+		}
+		return "unit"
+	}
+	return g.visit(root, expr)
+}
+
+// declareGlobal makes name a global holding value
+func (g *IRGenerator) declareGlobal(name string, value IRVar, loc ir.Location) {
+	root := g.module.rootSymTab
+	if _, exists := root.Table[name]; exists {
+		panic(fmt.Sprintf("%v already declared", name))
+	}
+	if _, isUnit := g.varTypes[value].(utils.Unit); isUnit {
+		root.Table[name] = "unit"
+		return
+	}
+	global := ir.Global(name)
+	g.varTypes[global] = g.varTypes[value]
+	g.module.globals[global] = g.varTypes[value]
+	root.Table[name] = global
+	g.instructions = append(g.instructions, ir.Copy{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Source:          value,
+		Dest:            global,
+	})
+}
+
+// declareConstant makes name a const with the given value
+func (g *IRGenerator) declareConstant(name string, value any) {
+	root := g.module.rootSymTab
+	if _, exists := root.Table[name]; exists {
+		panic(fmt.Sprintf("%v already declared", name))
+	}
+	constant := IRVar("const." + name)
+	root.Table[name] = constant
+	g.module.constants[constant] = value
+}
+
+// constant is the value of a const, which the typechecker has folded into
+// a literal, cast to its type unless it is an Int
+func (g *IRGenerator) constant(expr ast.Expression) any {
+	switch e := expr.(type) {
+	case ast.Literal:
+		return int64(e.Value.(uint64))
+	case ast.BooleanLiteral:
+		return e.Boolean == "true"
+	case ast.Cast:
+		_, word := utils.IntOf(g.constant(e.Value))
+		return utils.IntTypes[e.Type.(ast.Identifier).Name].Value(word)
+	}
+	panic(fmt.Sprintf("The const value at %v is not folded, type check the program first", expr.GetLocation()))
+}
+
+// loadConstant loads the value of a const into a new variable
+func (g *IRGenerator) loadConstant(value any, loc ir.Location) IRVar {
+	if b, ok := value.(bool); ok {
+		variable := g.newVar(utils.Bool{Name: "Bool"})
+		g.instructions = append(g.instructions, ir.LoadBoolConst{
+			BaseInstruction: ir.BaseInstruction{Location: loc},
+			Value:           b,
+			Dest:            variable,
+		})
+		return variable
 	}
+	intType, word := utils.IntOf(value)
+	variable := g.newVar(intType)
+	g.instructions = append(g.instructions, ir.LoadIntConst{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Value:           word,
+		Dest:            variable,
+	})
+	return variable
+}
+
+// unsignedOps are the integer operators that have an unsigned variant, named
+// with a u in front, for the unsigned types
+var unsignedOps = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "%": true,
+	"<": true, "<=": true, ">": true, ">=": true,
+}
+
+// wrap makes the result of arithmetic on a type narrower than 64 bits wrap
+// around at its width, sign or zero extending it back to a word
+func (g *IRGenerator) wrap(value IRVar, loc ir.Location) IRVar {
+	intType, ok := g.varTypes[value].(utils.Int)
+	if !ok || intType.Width() == 64 {
+		return value
+	}
+	dest := g.newVar(intType)
+	g.instructions = append(g.instructions, ir.Call{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Fun:             "__as_" + intType.String(),
+		Args:            []IRVar{value},
+		Dest:            dest,
+	})
+	return dest
+}
+
+// cast converts an integer to another integer type. Between the 64 bit types
+// the word stays the same; the narrower ones keep its low bits.
+func (g *IRGenerator) cast(st *SymTab, e ast.Cast) IRVar {
+	target := utils.IntTypes[e.Type.(ast.Identifier).Name]
+	if literal, ok := e.Value.(ast.Literal); ok {
+		_, word := utils.IntOf(target.Value(literal.Value.(uint64)))
+		dest := g.newVar(target)
+		g.instructions = append(g.instructions, ir.LoadIntConst{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Value:           word,
+			Dest:            dest,
+		})
+		return dest
+	}
+	value := g.visit(st, e.Value)
+	dest := g.newVar(target)
+	g.instructions = append(g.instructions, ir.Copy{
+		BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+		Source:          value,
+		Dest:            dest,
+	})
+	return g.wrap(dest, e.GetLocation())
+}
+
+// returnResult returns the value a function body ends in, unless the
+// function returns Unit.
+func (g *IRGenerator) returnResult(result IRVar, resType Type, loc ir.Location) {
+	if _, isUnit := resType.(utils.Unit); isUnit {
+		return
+	}
+	if _, isUnit := g.varTypes[result].(utils.Unit); isUnit {
+		return
+	}
+	g.instructions = append(g.instructions, ir.Return{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Value:           result,
+	})
 }
 
 func (g *IRGenerator) newVar(t Type) IRVar {
@@ -191,6 +586,35 @@ func (g *IRGenerator) newLabel() ir.Label {
 	}
 }
 
+// findLoop returns the loop that break or continue with label leaves: the
+// innermost one when label is empty.
+func (g *IRGenerator) findLoop(label string, keyword string) *loop {
+	for i := len(g.loops) - 1; i >= 0; i-- {
+		if label == "" || g.loops[i].label == label {
+			return g.loops[i]
+		}
+	}
+	panic(fmt.Sprintf("%s outside of loop", keyword))
+}
+
+// value is the variable holding the value of the loop
+func (l *loop) value() IRVar {
+	if l.result == "" {
+		return "unit"
+	}
+	return l.result
+}
+
+// newScope returns a symbol table for the variables of a block inside st.
+// The builtins and operators are copied into every scope.
+func (g *IRGenerator) newScope(st *SymTab) *SymTab {
+	scope := utils.NewSymTab(st)
+	for v := range g.rootTypes {
+		scope.Table[v] = v
+	}
+	return scope
+}
+
 func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 	switch e := expr.(type) {
 	case ast.Literal:
@@ -207,6 +631,15 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 		}
 		panic(fmt.Sprintf("Unsupported literal: %v", e.Value))
 
+	case ast.StringLiteral:
+		variable := g.newVar(utils.String{Name: "String"})
+		g.instructions = append(g.instructions, ir.LoadStringConst{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Value:           e.Value,
+			Dest:            variable,
+		})
+		return variable
+
 	case ast.BooleanLiteral:
 		if e.Boolean == "true" || e.Boolean == "false" {
 			value, _ := strconv.ParseBool(e.Boolean)
@@ -228,9 +661,47 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 		} else if !exists {
 			panic(fmt.Sprintf("Undefined variable: %s, in location %v", e.Name, e.GetLocation()))
 		}
+		if g.isFunction(value) {
+			return g.functionValue(value, e.GetLocation())
+		}
+		if constant, ok := g.module.constants[value]; ok {
+			return g.loadConstant(constant, e.GetLocation())
+		}
 		return value
 
 	case ast.BinaryOp:
+		if target, ok := e.Left.(ast.Unary); ok && e.Op == "=" && target.Op == "*" {
+			address := g.visit(st, target.Exp)
+			right := g.visit(st, e.Right)
+			g.instructions = append(g.instructions, ir.Store{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Value:           right,
+				Address:         address,
+			})
+			return right
+		}
+		if target, ok := e.Left.(ast.IndexExpression); ok && e.Op == "=" {
+			address := g.element(st, target)
+			right := g.visit(st, e.Right)
+			g.instructions = append(g.instructions, ir.Store{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Value:           right,
+				Address:         address,
+			})
+			return right
+		}
+		if target, ok := e.Left.(ast.FieldAccess); ok && e.Op == "=" {
+			object := g.visit(st, target.Object)
+			right := g.visit(st, e.Right)
+			offset, _ := g.varTypes[object].(utils.Struct).Offset(target.Field.(ast.Identifier).Name)
+			g.instructions = append(g.instructions, ir.Store{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Value:           right,
+				Address:         object,
+				Offset:          offset,
+			})
+			return right
+		}
 		left := g.visit(st, e.Left)
 		if e.Op == "=" {
 			right := g.visit(st, e.Right)
@@ -296,18 +767,31 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 			return newVar
 		}
 		right := g.visit(st, e.Right)
+		if _, isString := g.varTypes[left].(utils.String); isString && (e.Op == "==" || e.Op == "!=") {
+			return g.stringEquals(left, right, e.Op == "!=", e.GetLocation())
+		}
 		varOp, exists := st.Table[e.Op]
 		if !exists {
 			panic(fmt.Sprintf("Unknown operator: %s", e.Op))
 		}
 		res := g.newVar(g.varTypes[varOp])
+		fun := varOp
+		intType, isInt := g.varTypes[left].(utils.Int)
+		if isInt && unsignedOps[e.Op] {
+			if intType.Unsigned {
+				fun = "u" + e.Op
+			}
+			if _, arithmetic := g.varTypes[varOp].(utils.Int); arithmetic {
+				g.varTypes[res] = intType
+			}
+		}
 		g.instructions = append(g.instructions, ir.Call{
 			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
-			Fun:             varOp,
+			Fun:             fun,
 			Args:            []IRVar{left, right},
 			Dest:            res,
 		})
-		return res
+		return g.wrap(res, e.GetLocation())
 
 	case ast.Declaration:
 		value := g.visit(st, e.Value)
@@ -318,10 +802,6 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 		if _, exists := st.Table[name]; exists {
 			panic(fmt.Sprintf("%v already declared", e.Variable))
 		}
-		if _, isFun := g.varTypes[value].(utils.Fun); isFun {
-			st.Table[name] = value
-			return "unit"
-		}
 		newVar := g.newVar(g.varTypes[value])
 		st.Table[name] = newVar
 		g.instructions = append(g.instructions, ir.Copy{
@@ -339,19 +819,6 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 			elseLabel = g.newLabel()
 		}
 		condVar := g.visit(st, e.Condition)
-		copyVar := "unit"
-		switch e.Then.(type) {
-		case ast.Block:
-			copyVar = g.newVar(utils.Unit{})
-		case ast.Literal:
-			copyVar = g.newVar(utils.Int{})
-		case ast.BinaryOp:
-			copyVar = g.newVar(utils.Int{})
-		case ast.BooleanLiteral:
-			copyVar = g.newVar(utils.Bool{})
-		case ast.IfExpression:
-			copyVar = g.newVar(utils.Int{})
-		}
 		g.instructions = append(g.instructions, ir.CondJump{
 			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
 			Cond:            condVar,
@@ -362,6 +829,7 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 		thenVar := g.visit(st, e.Then)
 		res := "unit"
 		if e.Else != nil {
+			copyVar := g.newVar(g.varTypes[thenVar])
 			g.instructions = append(g.instructions, ir.Copy{
 				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
 				Source:          thenVar,
@@ -399,46 +867,84 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 			ElseLabel:       whileEndLabel,
 		})
 		g.instructions = append(g.instructions, whileBodyLabel)
-		prevStart := g.loopStartLabel
-		prevEnd := g.loopEndLabel
-		g.loopStartLabel = &whileStartLabel
-		g.loopEndLabel = &whileEndLabel
+		l := &loop{label: e.Label, next: whileStartLabel, end: whileEndLabel}
+		g.loops = append(g.loops, l)
 		g.visit(st, e.Looping)
-		g.loopStartLabel = prevStart
-		g.loopEndLabel = prevEnd
+		g.loops = g.loops[:len(g.loops)-1]
 		g.instructions = append(g.instructions, ir.Jump{
 			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
 			Label:           whileStartLabel,
 		})
 		g.instructions = append(g.instructions, whileEndLabel)
-		return "unit"
+		return l.value()
+
+	case ast.ForLoop:
+		// continue jumps to the step, which jumps back to the condition
+		loopTable := g.newScope(st)
+		if e.Init != nil {
+			g.visit(loopTable, e.Init)
+		}
+		forStartLabel := g.newLabel()
+		forBodyLabel := g.newLabel()
+		forStepLabel := g.newLabel()
+		forEndLabel := g.newLabel()
+		g.instructions = append(g.instructions, forStartLabel)
+		if e.Condition != nil {
+			condVar := g.visit(loopTable, e.Condition)
+			if _, ok := g.varTypes[condVar].(utils.Bool); !ok {
+				panic(fmt.Sprintf("Conditional should be boolean %s", g.varTypes[condVar]))
+			}
+			g.instructions = append(g.instructions, ir.CondJump{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Cond:            condVar,
+				ThenLabel:       forBodyLabel,
+				ElseLabel:       forEndLabel,
+			})
+		}
+		g.instructions = append(g.instructions, forBodyLabel)
+		l := &loop{label: e.Label, next: forStepLabel, end: forEndLabel}
+		g.loops = append(g.loops, l)
+		g.visit(loopTable, e.Body)
+		g.loops = g.loops[:len(g.loops)-1]
+		g.instructions = append(g.instructions, forStepLabel)
+		if e.Step != nil {
+			g.visit(loopTable, e.Step)
+		}
+		g.instructions = append(g.instructions, ir.Jump{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Label:           forStartLabel,
+		})
+		g.instructions = append(g.instructions, forEndLabel)
+		return l.value()
 
 	case ast.BreakExpression:
-		if g.loopEndLabel == nil {
-			panic("break outside of loop")
+		l := g.findLoop(e.Label, "break")
+		if e.Value != nil {
+			value := g.visit(st, e.Value)
+			if l.result == "" {
+				l.result = g.newVar(g.varTypes[value])
+			}
+			g.instructions = append(g.instructions, ir.Copy{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Source:          value,
+				Dest:            l.result,
+			})
 		}
 		g.instructions = append(g.instructions, ir.Jump{
 			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
-			Label:           *g.loopEndLabel,
+			Label:           l.end,
 		})
 		return "unit"
 
 	case ast.ContinueExpression:
-		if g.loopStartLabel == nil {
-			panic("continue outside of loop")
-		}
 		g.instructions = append(g.instructions, ir.Jump{
 			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
-			Label:           *g.loopStartLabel,
+			Label:           g.findLoop(e.Label, "continue").next,
 		})
 		return "unit"
 
 	case ast.Block:
-		innerTable := utils.NewSymTab(st)
-
-		for v := range g.rootTypes {
-			innerTable.Table[v] = v
-		}
+		innerTable := g.newScope(st)
 
 		for _, expr := range e.Expressions {
 			g.visit(innerTable, expr)
@@ -450,24 +956,60 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 		return res
 
 	case ast.FunctionCall:
+		// The length of an array is kept in its first word
+		if name, ok := e.Name.(ast.Identifier); ok && name.Name == "len" {
+			array := g.visit(st, e.Args[0])
+			dest := g.newVar(utils.Int{Name: "Int"})
+			g.instructions = append(g.instructions, ir.Load{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Address:         array,
+				Dest:            dest,
+			})
+			return dest
+		}
+		if enumType, tag, ok := g.enumVariant(st, e.Name); ok {
+			var args []IRVar
+			for _, arg := range e.Args {
+				args = append(args, g.visit(st, arg))
+			}
+			return g.enumValue(enumType, tag, args, e.GetLocation())
+		}
+		if name, ok := e.Name.(ast.Identifier); ok {
+			if fun, ok := lookup(st, name.Name); ok && g.isFunction(fun) {
+				var args []IRVar
+				for _, arg := range e.Args {
+					args = append(args, g.visit(st, arg))
+				}
+				if _, generic := g.module.generics[fun]; generic {
+					fun = g.instantiate(fun, args, e.GetLocation())
+				}
+				return g.callDirect(fun, args, e.GetLocation())
+			}
+		}
+		// Anything else is a function value
+		closure := g.visit(st, e.Name)
 		var args []IRVar
 		for _, arg := range e.Args {
 			args = append(args, g.visit(st, arg))
 		}
-		funName := g.visit(st, e.Name)
-		destType := utils.Type(utils.Unit{})
-		if retType, ok := g.funcReturnTypes[funName]; ok {
-			destType = retType
-		}
-		dest := g.newVar(destType)
-		g.instructions = append(g.instructions, ir.Call{
+		dest := g.newVar(g.varTypes[closure].(utils.Fun).Res)
+		g.instructions = append(g.instructions, ir.CallClosure{
 			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
-			Fun:             funName,
+			Closure:         closure,
 			Args:            args,
 			Dest:            dest,
 		})
 		return dest
 
+	case ast.Lambda:
+		return g.lambda(st, e)
+
+	case ast.Cast:
+		return g.cast(st, e)
+
+	case ast.MatchExpression:
+		return g.match(st, e)
+
 	case ast.ReturnExpression:
 		val := g.visit(st, e.Result)
 		g.instructions = append(g.instructions, ir.Return{
@@ -477,6 +1019,31 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 		return "unit"
 
 	case ast.Unary:
+		if e.Op == "&" {
+			// &*p is p itself
+			if inner, ok := e.Exp.(ast.Unary); ok && inner.Op == "*" {
+				return g.visit(st, inner.Exp)
+			}
+			target := g.visit(st, e.Exp)
+			dest := g.newVar(utils.Pointer{Elem: g.varTypes[target]})
+			g.instructions = append(g.instructions, ir.Call{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Fun:             "unary_&",
+				Args:            []IRVar{target},
+				Dest:            dest,
+			})
+			return dest
+		}
+		if e.Op == "*" {
+			address := g.visit(st, e.Exp)
+			dest := g.newVar(g.varTypes[address].(utils.Pointer).Elem)
+			g.instructions = append(g.instructions, ir.Load{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Address:         address,
+				Dest:            dest,
+			})
+			return dest
+		}
 		var args []IRVar
 		args = append(args, g.visit(st, e.Exp))
 		dest := g.newVar(g.varTypes[args[0]])
@@ -487,9 +1054,747 @@ func (g *IRGenerator) visit(st *SymTab, expr ast.Expression) IRVar {
 			Dest:            dest,
 		})
 
+		return g.wrap(dest, e.GetLocation())
+
+	case ast.NewExpression:
+		if array, ok := e.Type.(ast.ArrayType); ok {
+			length := g.visit(st, e.Value)
+			dest := g.newVar(g.resolveType(array))
+			g.instructions = append(g.instructions, ir.Call{
+				BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+				Fun:             "new[]",
+				Args:            []IRVar{length},
+				Dest:            dest,
+			})
+			return dest
+		}
+		value := g.visit(st, e.Value)
+		// Every value is one 8 byte word
+		size := g.newVar(utils.Int{})
+		g.instructions = append(g.instructions, ir.LoadIntConst{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Value:           8,
+			Dest:            size,
+		})
+		dest := g.newVar(utils.Pointer{Elem: g.resolveType(e.Type)})
+		g.instructions = append(g.instructions, ir.Call{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Fun:             "__new",
+			Args:            []IRVar{size},
+			Dest:            dest,
+		})
+		g.instructions = append(g.instructions, ir.Store{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Value:           value,
+			Address:         dest,
+		})
 		return dest
 
+	case ast.ArrayLiteral:
+		var elements []IRVar
+		for _, element := range e.Elements {
+			elements = append(elements, g.visit(st, element))
+		}
+		length := g.newVar(utils.Int{Name: "Int"})
+		g.instructions = append(g.instructions, ir.LoadIntConst{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Value:           uint64(len(elements)),
+			Dest:            length,
+		})
+		dest := g.newVar(utils.Array{Elem: g.varTypes[elements[0]]})
+		g.instructions = append(g.instructions, ir.Call{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Fun:             "new[]",
+			Args:            []IRVar{length},
+			Dest:            dest,
+		})
+		for i, element := range elements {
+			index := g.newVar(utils.Int{Name: "Int"})
+			g.instructions = append(g.instructions, ir.LoadIntConst{
+				BaseInstruction: ir.BaseInstruction{Location: e.Elements[i].GetLocation()},
+				Value:           uint64(i),
+				Dest:            index,
+			})
+			address := g.newVar(utils.Pointer{Elem: g.varTypes[element]})
+			g.instructions = append(g.instructions, ir.Call{
+				BaseInstruction: ir.BaseInstruction{Location: e.Elements[i].GetLocation()},
+				Fun:             "&[]",
+				Args:            []IRVar{dest, index},
+				Dest:            address,
+			})
+			g.instructions = append(g.instructions, ir.Store{
+				BaseInstruction: ir.BaseInstruction{Location: e.Elements[i].GetLocation()},
+				Value:           element,
+				Address:         address,
+			})
+		}
+		return dest
+
+	case ast.StructLiteral:
+		structType := g.structs[e.Name.(ast.Identifier).Name]
+		var values []IRVar
+		for _, value := range e.Values {
+			values = append(values, g.visit(st, value))
+		}
+		size := g.newVar(utils.Int{Name: "Int"})
+		g.instructions = append(g.instructions, ir.LoadIntConst{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Value:           uint64(structType.Size()),
+			Dest:            size,
+		})
+		dest := g.newVar(structType)
+		g.instructions = append(g.instructions, ir.Call{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Fun:             "__new",
+			Args:            []IRVar{size},
+			Dest:            dest,
+		})
+		for i, field := range e.Fields {
+			offset, _ := structType.Offset(field.(ast.Identifier).Name)
+			g.instructions = append(g.instructions, ir.Store{
+				BaseInstruction: ir.BaseInstruction{Location: e.Values[i].GetLocation()},
+				Value:           values[i],
+				Address:         dest,
+				Offset:          offset,
+			})
+		}
+		return dest
+
+	case ast.FieldAccess:
+		if enumType, tag, ok := g.enumVariant(st, e); ok {
+			return g.enumValue(enumType, tag, nil, e.GetLocation())
+		}
+		object := g.visit(st, e.Object)
+		structType := g.varTypes[object].(utils.Struct)
+		fieldName := e.Field.(ast.Identifier).Name
+		offset, _ := structType.Offset(fieldName)
+		dest := g.newVar(structType.FieldType(fieldName))
+		g.instructions = append(g.instructions, ir.Load{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Address:         object,
+			Offset:          offset,
+			Dest:            dest,
+		})
+		return dest
+
+	case ast.TupleLiteral:
+		var elements []IRVar
+		var types []Type
+		for _, element := range e.Elements {
+			value := g.visit(st, element)
+			elements = append(elements, value)
+			types = append(types, g.varTypes[value])
+		}
+		size := g.newVar(utils.Int{Name: "Int"})
+		g.instructions = append(g.instructions, ir.LoadIntConst{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Value:           uint64(8 * len(elements)),
+			Dest:            size,
+		})
+		dest := g.newVar(utils.Tuple{Elems: types})
+		g.instructions = append(g.instructions, ir.Call{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Fun:             "__new",
+			Args:            []IRVar{size},
+			Dest:            dest,
+		})
+		for i, element := range elements {
+			g.instructions = append(g.instructions, ir.Store{
+				BaseInstruction: ir.BaseInstruction{Location: e.Elements[i].GetLocation()},
+				Value:           element,
+				Address:         dest,
+				Offset:          8 * i,
+			})
+		}
+		return dest
+
+	case ast.TupleElement:
+		tuple := g.visit(st, e.Tuple)
+		return g.tupleElement(tuple, e.Index, e.GetLocation())
+
+	case ast.Destructuring:
+		for i, element := range g.destructure(st, e) {
+			name := e.Variables[i].(ast.Identifier).Name
+			if name == "_" {
+				continue
+			}
+			if _, exists := st.Table[name]; exists {
+				panic(fmt.Sprintf("%v already declared", name))
+			}
+			st.Table[name] = element
+		}
+		return "unit"
+
+	case ast.IndexExpression:
+		address := g.element(st, e)
+		dest := g.newVar(g.varTypes[address].(utils.Pointer).Elem)
+		g.instructions = append(g.instructions, ir.Load{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Address:         address,
+			Dest:            dest,
+		})
+		return dest
+
+	case ast.DeleteExpression:
+		address := g.visit(st, e.Value)
+		g.instructions = append(g.instructions, ir.Call{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Fun:             "__delete",
+			Args:            []IRVar{address},
+			Dest:            g.newVar(utils.Unit{}),
+		})
+		return "unit"
+
 	default:
 		return ""
 	}
 }
+
+// lookup finds the IR variable of name in st or its parents.
+func lookup(st *SymTab, name string) (IRVar, bool) {
+	for cur := st; cur != nil; cur = cur.Parent {
+		if value, exists := cur.Table[name]; exists {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// isFunction reports whether v names a function rather than holding a value.
+func (g *IRGenerator) isFunction(v IRVar) bool {
+	if _, ok := g.module.funcSigs[v]; ok {
+		return true
+	}
+	if _, ok := g.module.generics[v]; ok {
+		return true
+	}
+	_, ok := g.rootTypes[v].(utils.Fun)
+	return ok
+}
+
+// callDirect calls the function fun by its name.
+func (g *IRGenerator) callDirect(fun IRVar, args []IRVar, loc ir.Location) IRVar {
+	destType := utils.Type(utils.Unit{})
+	if retType, ok := g.funcReturnTypes[fun]; ok {
+		destType = retType
+	} else if ft, ok := g.varTypes[fun].(utils.Fun); ok && ft.Res != nil {
+		destType = ft.Res
+	}
+	dest := g.newVar(destType)
+	g.instructions = append(g.instructions, ir.Call{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Fun:             fun,
+		Args:            args,
+		Dest:            dest,
+	})
+	// C only defines the low byte of a returned bool
+	if ext, ok := g.externFuncs[fun]; ok {
+		if _, isBool := ext.Res.(utils.Bool); isBool {
+			normalized := g.newVar(destType)
+			g.instructions = append(g.instructions, ir.Call{
+				BaseInstruction: ir.BaseInstruction{Location: loc},
+				Fun:             "__c_bool",
+				Args:            []IRVar{dest},
+				Dest:            normalized,
+			})
+			return normalized
+		}
+	}
+	return dest
+}
+
+// maxInstanceSize limits the size of the types an instance is made for,
+// which only a generic function calling itself with ever larger types
+// reaches
+const maxInstanceSize = 256
+
+// instantiate returns the name of the instance of the generic function fun
+// for the types of args, queueing it to be generated the first time. The
+// name, such as pair.Int.Bool, contains a '.' so it cannot clash with the
+// program's own functions.
+func (g *IRGenerator) instantiate(fun IRVar, args []IRVar, loc ir.Location) IRVar {
+	fd := g.module.generics[fun]
+	typeArgs := make(map[string]Type)
+	for i, p := range fd.Params {
+		utils.Bind(resolveIRTypeExpr(p.(ast.Param).Type, g.structs, g.enums), g.varTypes[args[i]], typeArgs)
+	}
+	var keys, symbols []string
+	for _, tp := range fd.TypeParams {
+		typeArg := typeArgs[tp.(ast.Identifier).Name]
+		if typeSize(typeArg, maxInstanceSize) > maxInstanceSize {
+			panic(fmt.Sprintf("Generic function %s is called with ever larger types at %v", fun, loc))
+		}
+		key := typeKey(typeArg)
+		keys = append(keys, key)
+		symbols = append(symbols, strings.Trim(nonSymbol.Replace(key), "_"))
+	}
+	key := fun + "[" + strings.Join(keys, ", ") + "]"
+	name, exists := g.module.instances[key]
+	if !exists {
+		name = fun + "." + strings.Join(symbols, ".")
+		if _, taken := g.module.funcSigs[name]; taken {
+			name = fmt.Sprintf("%s.%d", name, len(g.module.instances))
+		}
+		g.module.instances[key] = name
+		var params []Type
+		for _, p := range fd.Params {
+			params = append(params, utils.Substitute(resolveIRTypeExpr(p.(ast.Param).Type, g.structs, g.enums), typeArgs))
+		}
+		res := utils.Substitute(resolveIRTypeExpr(fd.ResultType, g.structs, g.enums), typeArgs)
+		g.module.funcSigs[name] = utils.Fun{Params: params, Res: res}
+		g.module.pending = append(g.module.pending, instance{name: name, fd: fd, typeArgs: typeArgs})
+	}
+	g.varTypes[name] = g.module.funcSigs[name]
+	return name
+}
+
+// nonSymbol folds the punctuation of type names into characters symbols can
+// hold
+var nonSymbol = strings.NewReplacer("[", "_", "]", "_", "(", "_", ")", "_", ", ", "_", " => ", "_to_", "*", "_ptr")
+
+// typeSize counts the types t is made of, stopping once there are more than
+// limit
+func typeSize(t Type, limit int) int {
+	var parts []Type
+	switch tt := t.(type) {
+	case utils.Pointer:
+		parts = []Type{tt.Elem}
+	case utils.Array:
+		parts = []Type{tt.Elem}
+	case utils.Tuple:
+		parts = tt.Elems
+	case utils.Fun:
+		parts = append([]Type{tt.Res}, tt.Params...)
+	}
+	size := 1
+	for _, part := range parts {
+		if size > limit {
+			break
+		}
+		size += typeSize(part, limit-size)
+	}
+	return size
+}
+
+// typeKey writes a type the way the program does: Int, Array[Int],
+// (Int, Bool), (Int) => Bool or Int*
+func typeKey(t Type) string {
+	switch tt := t.(type) {
+	case utils.Int:
+		return tt.String()
+	case utils.Bool:
+		return "Bool"
+	case utils.String:
+		return "String"
+	case utils.Unit:
+		return "Unit"
+	case utils.Pointer:
+		return typeKey(tt.Elem) + "*"
+	case utils.Array:
+		return "Array[" + typeKey(tt.Elem) + "]"
+	case utils.Struct:
+		return tt.Name
+	case utils.Enum:
+		return tt.Name
+	case utils.Tuple:
+		elems := make([]string, len(tt.Elems))
+		for i, e := range tt.Elems {
+			elems[i] = typeKey(e)
+		}
+		return "(" + strings.Join(elems, ", ") + ")"
+	case utils.Fun:
+		params := make([]string, len(tt.Params))
+		for i, p := range tt.Params {
+			params[i] = typeKey(p)
+		}
+		return "(" + strings.Join(params, ", ") + ") => " + typeKey(tt.Res)
+	}
+	panic(fmt.Sprintf("Unknown type %v", t))
+}
+
+// codeSignature is the signature of the code of a function value of type
+// sig, which takes the closure record before the arguments.
+func codeSignature(sig utils.Fun) utils.Fun {
+	return utils.Fun{Params: append([]Type{sig}, sig.Params...), Res: sig.Res}
+}
+
+// functionValue makes a closure of the named function fun. Its code is a
+// wrapper, generated once per function, that drops the record and calls fun.
+// Names of generated functions contain a '.' so they cannot clash with the
+// program's own.
+func (g *IRGenerator) functionValue(fun IRVar, loc ir.Location) IRVar {
+	sig := g.varTypes[fun].(utils.Fun)
+	code := fun + ".closure"
+	if _, exists := g.module.funcs[code]; !exists {
+		w := g.spawn()
+		self := w.newVar(sig)
+		w.instructions = append(w.instructions, ir.LoadParam{
+			BaseInstruction: ir.BaseInstruction{Location: loc},
+			Index:           0,
+			Dest:            self,
+		})
+		var args []IRVar
+		for i, p := range sig.Params {
+			arg := w.newVar(p)
+			w.instructions = append(w.instructions, ir.LoadParam{
+				BaseInstruction: ir.BaseInstruction{Location: loc},
+				Index:           i + 1,
+				Dest:            arg,
+			})
+			args = append(args, arg)
+		}
+		w.returnResult(w.callDirect(fun, args, loc), sig.Res, loc)
+		w.varTypes[code] = codeSignature(sig)
+		g.module.funcs[code] = w.instructions
+		g.module.types[code] = w.varTypes
+	}
+	return g.makeClosure(code, sig, nil, loc)
+}
+
+// lambda converts a lambda into a function of its own, which loads the
+// values it captured from the closure record, and makes the closure. The
+// lambda captures the local variables its body names; globals are used
+// directly.
+func (g *IRGenerator) lambda(st *SymTab, e ast.Lambda) IRVar {
+	g.module.lambdas++
+	code := fmt.Sprintf("lambda.%d", g.module.lambdas)
+	l := g.spawn()
+	lambdaTab := utils.NewSymTab(g.module.rootSymTab)
+
+	self := l.newVar(utils.Fun{})
+	l.instructions = append(l.instructions, ir.LoadParam{
+		BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+		Index:           0,
+		Dest:            self,
+	})
+	var sig utils.Fun
+	for i, p := range e.Params {
+		param := p.(ast.Param)
+		pType := g.resolveType(param.Type)
+		paramVar := l.newVar(pType)
+		l.instructions = append(l.instructions, ir.LoadParam{
+			BaseInstruction: ir.BaseInstruction{Location: param.GetLocation()},
+			Index:           i + 1,
+			Dest:            paramVar,
+		})
+		lambdaTab.Table[param.Name.(ast.Identifier).Name] = paramVar
+		sig.Params = append(sig.Params, pType)
+	}
+
+	used := make(map[string]bool)
+	ast.Walk(e.Body, func(expr ast.Expression) {
+		if identifier, ok := expr.(ast.Identifier); ok {
+			used[identifier.Name] = true
+		}
+	})
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var captured []IRVar
+	for _, name := range names {
+		value, exists := lookup(st, name)
+		if _, isParam := lambdaTab.Table[name]; !exists || isParam || g.isFunction(value) || ir.IsGlobal(value) {
+			continue
+		}
+		if _, isUnit := g.varTypes[value].(utils.Unit); isUnit {
+			lambdaTab.Table[name] = "unit"
+			continue
+		}
+		copied := l.newVar(g.varTypes[value])
+		l.instructions = append(l.instructions, ir.Load{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Address:         self,
+			Offset:          8 * (len(captured) + 1),
+			Dest:            copied,
+		})
+		lambdaTab.Table[name] = copied
+		captured = append(captured, value)
+	}
+
+	result := l.visit(lambdaTab, e.Body)
+	if e.ResultType != nil {
+		sig.Res = g.resolveType(e.ResultType)
+	} else {
+		sig.Res = l.varTypes[result]
+	}
+	l.returnResult(result, sig.Res, e.Body.GetLocation())
+	l.varTypes[self] = sig
+	l.varTypes[code] = codeSignature(sig)
+	g.module.funcs[code] = l.instructions
+	g.module.types[code] = l.varTypes
+	return g.makeClosure(code, sig, captured, e.GetLocation())
+}
+
+// makeClosure allocates the record of a function value: the address of its
+// code followed by the values it captured, one word each.
+func (g *IRGenerator) makeClosure(code string, sig utils.Fun, captured []IRVar, loc ir.Location) IRVar {
+	size := g.newVar(utils.Int{Name: "Int"})
+	g.instructions = append(g.instructions, ir.LoadIntConst{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Value:           uint64(8 * (len(captured) + 1)),
+		Dest:            size,
+	})
+	dest := g.newVar(sig)
+	g.instructions = append(g.instructions, ir.Call{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Fun:             "__new",
+		Args:            []IRVar{size},
+		Dest:            dest,
+	})
+	address := g.newVar(utils.Int{Name: "Int"})
+	g.instructions = append(g.instructions, ir.LoadFunction{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Fun:             code,
+		Dest:            address,
+	})
+	g.instructions = append(g.instructions, ir.Store{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Value:           address,
+		Address:         dest,
+	})
+	for i, value := range captured {
+		g.instructions = append(g.instructions, ir.Store{
+			BaseInstruction: ir.BaseInstruction{Location: loc},
+			Value:           value,
+			Address:         dest,
+			Offset:          8 * (i + 1),
+		})
+	}
+	return dest
+}
+
+// enumVariant tells whether expr is a variant of an enum such as
+// Shape.Circle, which a variable called Shape would hide.
+func (g *IRGenerator) enumVariant(st *SymTab, expr ast.Expression) (utils.Enum, int, bool) {
+	access, ok := expr.(ast.FieldAccess)
+	if !ok {
+		return utils.Enum{}, 0, false
+	}
+	object, ok := access.Object.(ast.Identifier)
+	if !ok {
+		return utils.Enum{}, 0, false
+	}
+	if _, exists := lookup(st, object.Name); exists {
+		return utils.Enum{}, 0, false
+	}
+	enumType, ok := g.enums[object.Name]
+	if !ok {
+		return utils.Enum{}, 0, false
+	}
+	tag, _ := enumType.Tag(access.Field.(ast.Identifier).Name)
+	return enumType, tag, true
+}
+
+// enumValue allocates the record of an enum value: the tag of the variant
+// followed by its fields.
+func (g *IRGenerator) enumValue(enumType utils.Enum, tag int, fields []IRVar, loc ir.Location) IRVar {
+	size := g.newVar(utils.Int{Name: "Int"})
+	g.instructions = append(g.instructions, ir.LoadIntConst{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Value:           uint64(8 * (len(fields) + 1)),
+		Dest:            size,
+	})
+	dest := g.newVar(enumType)
+	g.instructions = append(g.instructions, ir.Call{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Fun:             "__new",
+		Args:            []IRVar{size},
+		Dest:            dest,
+	})
+	tagVar := g.newVar(utils.Int{Name: "Int"})
+	g.instructions = append(g.instructions, ir.LoadIntConst{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Value:           uint64(tag),
+		Dest:            tagVar,
+	})
+	g.instructions = append(g.instructions, ir.Store{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Value:           tagVar,
+		Address:         dest,
+	})
+	for i, field := range fields {
+		g.instructions = append(g.instructions, ir.Store{
+			BaseInstruction: ir.BaseInstruction{Location: loc},
+			Value:           field,
+			Address:         dest,
+			Offset:          enumType.Offset(i),
+		})
+	}
+	return dest
+}
+
+// jumpTableMin is the number of arms from which a match jumps through a
+// table indexed by the tag instead of comparing the tag with each variant.
+const jumpTableMin = 4
+
+// match jumps to the arm for the tag of the value. Each arm loads the fields
+// it binds and leaves its value in the result of the match. The typechecker
+// made sure the arms cover every variant, so the last arm needs no test.
+func (g *IRGenerator) match(st *SymTab, e ast.MatchExpression) IRVar {
+	value := g.visit(st, e.Value)
+	enumType := g.varTypes[value].(utils.Enum)
+	tag := g.newVar(utils.Int{Name: "Int"})
+	g.instructions = append(g.instructions, ir.Load{
+		BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+		Address:         value,
+		Dest:            tag,
+	})
+
+	armLabels := make([]ir.Label, len(e.Arms))
+	targets := make([]ir.Label, len(enumType.Variants))
+	for i, a := range e.Arms {
+		armLabels[i] = g.newLabel()
+		if variant, ok := enumType.Tag(a.(ast.MatchArm).Variant.(ast.Identifier).Name); ok {
+			targets[variant] = armLabels[i]
+		}
+	}
+	// Variants without an arm of their own go to _
+	for variant := range targets {
+		if targets[variant].Label == "" {
+			targets[variant] = armLabels[len(armLabels)-1]
+		}
+	}
+	endLabel := g.newLabel()
+
+	if len(e.Arms) >= jumpTableMin {
+		g.instructions = append(g.instructions, ir.JumpTable{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Index:           tag,
+			Labels:          targets,
+		})
+	} else {
+		for i, a := range e.Arms[:len(e.Arms)-1] {
+			variant, _ := enumType.Tag(a.(ast.MatchArm).Variant.(ast.Identifier).Name)
+			variantTag := g.newVar(utils.Int{Name: "Int"})
+			g.instructions = append(g.instructions, ir.LoadIntConst{
+				BaseInstruction: ir.BaseInstruction{Location: a.GetLocation()},
+				Value:           uint64(variant),
+				Dest:            variantTag,
+			})
+			isVariant := g.newVar(utils.Bool{Name: "Bool"})
+			g.instructions = append(g.instructions, ir.Call{
+				BaseInstruction: ir.BaseInstruction{Location: a.GetLocation()},
+				Fun:             "==",
+				Args:            []IRVar{tag, variantTag},
+				Dest:            isVariant,
+			})
+			nextLabel := g.newLabel()
+			g.instructions = append(g.instructions, ir.CondJump{
+				BaseInstruction: ir.BaseInstruction{Location: a.GetLocation()},
+				Cond:            isVariant,
+				ThenLabel:       armLabels[i],
+				ElseLabel:       nextLabel,
+			})
+			g.instructions = append(g.instructions, nextLabel)
+		}
+		g.instructions = append(g.instructions, ir.Jump{
+			BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+			Label:           armLabels[len(armLabels)-1],
+		})
+	}
+
+	res := IRVar("unit")
+	for i, a := range e.Arms {
+		arm := a.(ast.MatchArm)
+		g.instructions = append(g.instructions, armLabels[i])
+		armTable := g.newScope(st)
+		if variant, ok := enumType.Tag(arm.Variant.(ast.Identifier).Name); ok {
+			for j, b := range arm.Bindings {
+				name := b.(ast.Identifier).Name
+				if name == "_" {
+					continue
+				}
+				field := g.newVar(enumType.Fields[variant][j])
+				g.instructions = append(g.instructions, ir.Load{
+					BaseInstruction: ir.BaseInstruction{Location: b.GetLocation()},
+					Address:         value,
+					Offset:          enumType.Offset(j),
+					Dest:            field,
+				})
+				armTable.Table[name] = field
+			}
+		}
+		armVar := g.visit(armTable, arm.Body)
+		if _, isUnit := g.varTypes[armVar].(utils.Unit); !isUnit {
+			if res == "unit" {
+				res = g.newVar(g.varTypes[armVar])
+			}
+			g.instructions = append(g.instructions, ir.Copy{
+				BaseInstruction: ir.BaseInstruction{Location: arm.Body.GetLocation()},
+				Source:          armVar,
+				Dest:            res,
+			})
+		}
+		g.instructions = append(g.instructions, ir.Jump{
+			BaseInstruction: ir.BaseInstruction{Location: arm.Body.GetLocation()},
+			Label:           endLabel,
+		})
+	}
+	g.instructions = append(g.instructions, endLabel)
+	return res
+}
+
+// tupleElement loads element index of a tuple
+func (g *IRGenerator) tupleElement(tuple IRVar, index int, loc ir.Location) IRVar {
+	dest := g.newVar(g.varTypes[tuple].(utils.Tuple).Elems[index])
+	g.instructions = append(g.instructions, ir.Load{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Address:         tuple,
+		Offset:          8 * index,
+		Dest:            dest,
+	})
+	return dest
+}
+
+// destructure loads the elements of the tuple of var (a, b) = value into
+// fresh variables, leaving out the ones named _
+func (g *IRGenerator) destructure(st *SymTab, e ast.Destructuring) []IRVar {
+	tuple := g.visit(st, e.Value)
+	elements := make([]IRVar, len(e.Variables))
+	for i, v := range e.Variables {
+		if v.(ast.Identifier).Name != "_" {
+			elements[i] = g.tupleElement(tuple, i, e.GetLocation())
+		}
+	}
+	return elements
+}
+
+// element returns the address of an array element. The &[] op checks the
+// index against the length of the array.
+func (g *IRGenerator) element(st *SymTab, e ast.IndexExpression) IRVar {
+	array := g.visit(st, e.Array)
+	index := g.visit(st, e.Index)
+	address := g.newVar(utils.Pointer{Elem: g.varTypes[array].(utils.Array).Elem})
+	g.instructions = append(g.instructions, ir.Call{
+		BaseInstruction: ir.BaseInstruction{Location: e.GetLocation()},
+		Fun:             "&[]",
+		Args:            []IRVar{array, index},
+		Dest:            address,
+	})
+	return address
+}
+
+// stringEquals compares two strings by their bytes, negating the result for
+// !=.
+func (g *IRGenerator) stringEquals(left IRVar, right IRVar, negate bool, loc ir.Location) IRVar {
+	res := g.newVar(utils.Bool{Name: "Bool"})
+	g.instructions = append(g.instructions, ir.Call{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Fun:             "__string_equals",
+		Args:            []IRVar{left, right},
+		Dest:            res,
+	})
+	if !negate {
+		return res
+	}
+	negated := g.newVar(utils.Bool{Name: "Bool"})
+	g.instructions = append(g.instructions, ir.Call{
+		BaseInstruction: ir.BaseInstruction{Location: loc},
+		Fun:             "unary_not",
+		Args:            []IRVar{res},
+		Dest:            negated,
+	})
+	return negated
+}
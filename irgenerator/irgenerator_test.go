@@ -1,8 +1,12 @@
 package irgenerator
 
 import (
+	"compiler/ir"
 	"compiler/parser"
 	"compiler/tokenizer"
+	"compiler/typechecker"
+	"compiler/utils"
+	"fmt"
 	"testing"
 )
 
@@ -95,4 +99,422 @@ func TestIr(t *testing.T) {
 			t.Errorf("Expected 3 function entries (add, double, main), got %d", len(generated))
 		}
 	})
+	t.Run("Types are tracked per function", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun is_pos(x: Int): Bool {
+				return x > 0;
+			}
+			var n = read_int();
+			if is_pos(n) then { 1 } else { 2 }
+		`, "")
+		parsed := parser.Parse(tokens)
+		generated, types := GenerateWithTypes(parsed, Options{})
+		sig, ok := types["main"]["is_pos"].(utils.Fun)
+		if !ok || len(sig.Params) != 1 {
+			t.Fatalf("Expected signature for is_pos, got %v", types["main"]["is_pos"])
+		}
+		if _, ok := sig.Res.(utils.Bool); !ok {
+			t.Errorf("Expected is_pos to return Bool, got %v", sig.Res)
+		}
+		for _, ins := range generated["main"] {
+			if call, ok := ins.(ir.Call); ok && call.Fun == "read_int" {
+				if _, ok := types["main"][call.Dest].(utils.Int); !ok {
+					t.Errorf("Expected read_int result to be Int, got %v", types["main"][call.Dest])
+				}
+			}
+		}
+		last := generated["main"][len(generated["main"])-1].(ir.Call)
+		if last.Fun != "print_int" {
+			t.Errorf("Expected if result to be printed as Int, got %v", last)
+		}
+	})
+	t.Run("Exit with result returns the top-level Int", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var x = 3; x * 14", "")
+		parsed := parser.Parse(tokens)
+		generated, _ := GenerateWithTypes(parsed, Options{ExitWithResult: true})
+		main := generated["main"]
+		if _, ok := main[len(main)-1].(ir.Return); !ok {
+			t.Errorf("Expected main to end with Return, got %v", main[len(main)-1])
+		}
+	})
+	t.Run("Pointers use Load and Store", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var x = 1; var p = &x; *p = 2; *p", "")
+		parsed := parser.Parse(tokens)
+		generated, types := GenerateWithTypes(parsed, Options{})
+		var loads, stores int
+		for _, ins := range generated["main"] {
+			switch i := ins.(type) {
+			case ir.Load:
+				loads++
+				if _, ok := types["main"][i.Address].(utils.Pointer); !ok {
+					t.Errorf("Expected Load from a pointer, got %v", types["main"][i.Address])
+				}
+			case ir.Store:
+				stores++
+			}
+		}
+		if loads != 1 || stores != 1 {
+			t.Errorf("Expected one Load and one Store, got %d and %d", loads, stores)
+		}
+	})
+
+	t.Run("Array elements are checked addresses", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var a = [1, 2]; a[1] = a[0]; len(a)", "")
+		parsed := parser.Parse(tokens)
+		generated, types := GenerateWithTypes(parsed, Options{})
+		var elements, loads, stores int
+		for _, ins := range generated["main"] {
+			switch i := ins.(type) {
+			case ir.Call:
+				if i.Fun == "&[]" {
+					elements++
+					if _, ok := types["main"][i.Args[0]].(utils.Array); !ok {
+						t.Errorf("Expected &[] of an array, got %v", types["main"][i.Args[0]])
+					}
+				}
+			case ir.Load:
+				loads++
+			case ir.Store:
+				stores++
+			}
+		}
+		// Two for the literal, one for each side of the assignment
+		if elements != 4 {
+			t.Errorf("Expected 4 element addresses, got %d", elements)
+		}
+		// a[0] and len(a)
+		if loads != 2 || stores != 3 {
+			t.Errorf("Expected 2 Loads and 3 Stores, got %d and %d", loads, stores)
+		}
+	})
+
+	t.Run("Struct fields use offsets from the layout", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("struct P { x: Int, y: Bool }\nvar p = P { y: true, x: 1 }; p.y", "")
+		parsed := parser.Parse(tokens)
+		generated, types := GenerateWithTypes(parsed, Options{})
+		var storeOffsets []int
+		var load ir.Load
+		for _, ins := range generated["main"] {
+			switch i := ins.(type) {
+			case ir.Store:
+				storeOffsets = append(storeOffsets, i.Offset)
+			case ir.Load:
+				load = i
+			}
+		}
+		if fmt.Sprintf("%v", storeOffsets) != "[8 0]" {
+			t.Errorf("Expected stores to y then x at [8 0], got %v", storeOffsets)
+		}
+		if load.Offset != 8 {
+			t.Errorf("Expected p.y to load at offset 8, got %v", load)
+		}
+		if _, ok := types["main"][load.Dest].(utils.Bool); !ok {
+			t.Errorf("Expected p.y to be Bool, got %v", types["main"][load.Dest])
+		}
+	})
+
+	t.Run("Strings compare by content", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`"a" != concat("a", "")`, "")
+		parsed := parser.Parse(tokens)
+		generated := Generate(parsed)
+		var funs []string
+		for _, ins := range generated["main"] {
+			if call, ok := ins.(ir.Call); ok {
+				funs = append(funs, call.Fun)
+			}
+		}
+		expected := "[concat __string_equals unary_not print_bool]"
+		if fmt.Sprintf("%v", funs) != expected {
+			t.Errorf("Expected calls %v but got %v", expected, funs)
+		}
+	})
+
+	t.Run("Lambdas become closures", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun square(x: Int): Int {
+				x * x
+			}
+			fun make(): Int {
+				var n = 1;
+				var f = fun(x: Int): Int { square(x) + n };
+				var g = square;
+				f(2) + g(3)
+			}
+			make()
+		`, "")
+		parsed := parser.Parse(tokens)
+		generated, types := GenerateWithTypes(parsed, Options{})
+		var loadFunctions []string
+		var closureCalls int
+		for _, ins := range generated["make"] {
+			switch i := ins.(type) {
+			case ir.LoadFunction:
+				loadFunctions = append(loadFunctions, i.Fun)
+			case ir.CallClosure:
+				closureCalls++
+			}
+		}
+		if fmt.Sprintf("%v", loadFunctions) != "[lambda.1 square.closure]" || closureCalls != 2 {
+			t.Errorf("Expected closures of lambda.1 and square.closure called twice, got %v and %d", loadFunctions, closureCalls)
+		}
+		// n is loaded from the record after the code, square is called directly
+		var captured []string
+		var calls []string
+		for _, ins := range generated["lambda.1"] {
+			switch i := ins.(type) {
+			case ir.Load:
+				captured = append(captured, fmt.Sprintf("%d %v", i.Offset, types["lambda.1"][i.Dest]))
+			case ir.Call:
+				calls = append(calls, i.Fun)
+			}
+		}
+		if fmt.Sprintf("%v", captured) != "[8 Int]" {
+			t.Errorf("Expected n to be loaded at offset 8, got %v", captured)
+		}
+		if fmt.Sprintf("%v", calls) != "[square +]" {
+			t.Errorf("Expected a direct call to square, got %v", calls)
+		}
+		if _, ok := generated["square.closure"]; !ok {
+			t.Errorf("Expected a wrapper for square")
+		}
+	})
+
+	t.Run("Top-level variables are globals", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun bump(): Unit {
+				n = n + 1;
+			}
+			var n = 1;
+			{ var local = n; bump(); local }
+		`, "")
+		parsed := parser.Parse(tokens)
+		generated := Generate(parsed)
+		var globals []string
+		for _, name := range []string{"main", "bump"} {
+			for _, ins := range generated[name] {
+				if c, ok := ins.(ir.Copy); ok && ir.IsGlobal(c.Dest) {
+					globals = append(globals, name+" "+c.Dest)
+				}
+			}
+		}
+		expected := "[main global.n bump global.n]"
+		if fmt.Sprintf("%v", globals) != expected {
+			t.Errorf("Expected assignments %v but got %v", expected, globals)
+		}
+	})
+
+	t.Run("Continue in a for loop runs the step", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("for (var i = 0; i < 3; i = i + 1) { if i == 1 then { continue } }", "")
+		parsed := parser.Parse(tokens)
+		main := Generate(parsed)["main"]
+		var target string
+		for _, ins := range main {
+			if jump, ok := ins.(ir.Jump); ok && target == "" {
+				target = jump.Label.Label
+			}
+		}
+		// Everything after the label continue jumps to
+		var after []string
+		for i, ins := range main {
+			if label, ok := ins.(ir.Label); ok && label.Label == target {
+				for _, rest := range main[i+1:] {
+					switch r := rest.(type) {
+					case ir.Call:
+						after = append(after, r.Fun)
+					case ir.Jump:
+						after = append(after, "jump "+r.Label.Label)
+					}
+				}
+			}
+		}
+		expected := fmt.Sprintf("[+ jump %v]", main[2].(ir.Label).Label)
+		if fmt.Sprintf("%v", after) != expected {
+			t.Errorf("Expected continue to reach %v, got %v", expected, after)
+		}
+	})
+
+	t.Run("Labeled break leaves the outer loop with its value", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("outer: while true do { while true do { break outer 42 } }", "")
+		parsed := parser.Parse(tokens)
+		main := Generate(parsed)["main"]
+		var jumps []string
+		var labels []string
+		var copied string
+		for _, ins := range main {
+			switch i := ins.(type) {
+			case ir.Jump:
+				jumps = append(jumps, i.Label.Label)
+			case ir.Label:
+				labels = append(labels, i.Label)
+			case ir.Copy:
+				copied = i.Dest
+			}
+		}
+		// The break jumps to the end of the outer loop, the last label
+		if jumps[0] != labels[len(labels)-1] {
+			t.Errorf("Expected break to jump to %v, got %v", labels[len(labels)-1], jumps[0])
+		}
+		printed := main[len(main)-1].(ir.Call)
+		if printed.Fun != "print_int" || printed.Args[0] != copied {
+			t.Errorf("Expected the break value %v to be printed, got %v", copied, printed)
+		}
+	})
+
+	t.Run("Match compares the tag or jumps through a table", func(t *testing.T) {
+		count := func(source string) (tables int, condJumps int) {
+			parsed := parser.Parse(tokenizer.Tokenize(source, ""))
+			for _, ins := range Generate(parsed)["main"] {
+				switch i := ins.(type) {
+				case ir.JumpTable:
+					tables++
+					if len(i.Labels) != 5 {
+						t.Errorf("Expected a label for each of the 5 variants, got %v", i)
+					}
+				case ir.CondJump:
+					condJumps++
+				}
+			}
+			return tables, condJumps
+		}
+		tables, condJumps := count(`
+			enum Shape { Circle(Int), Rect(Int, Int), Empty }
+			match Shape.Circle(1) { Circle(r) => r, Rect(w, h) => w * h, Empty => 0 }
+		`)
+		// The last arm needs no test
+		if tables != 0 || condJumps != 2 {
+			t.Errorf("Expected 2 tag tests and no table, got %d and %d", condJumps, tables)
+		}
+		tables, condJumps = count(`
+			enum Op { Add, Sub, Mul, Div, Neg }
+			match Op.Mul { Add => 1, Sub => 2, Mul => 3, _ => 4 }
+		`)
+		if tables != 1 || condJumps != 0 {
+			t.Errorf("Expected a table and no tag tests, got %d and %d", tables, condJumps)
+		}
+	})
+
+	t.Run("Tuples are heap records", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun divmod(a: Int, b: Int): (Int, Int) { (a / b, a % b) }
+			{ var (q, r) = divmod(7, 2); q + r }
+		`, "")
+		generated := Generate(parser.Parse(tokens))
+		stores := 0
+		for _, ins := range generated["divmod"] {
+			if store, ok := ins.(ir.Store); ok {
+				if store.Offset != 8*stores {
+					t.Errorf("Expected element %d at offset %d, got %v", stores, 8*stores, store)
+				}
+				stores++
+			}
+		}
+		if stores != 2 {
+			t.Errorf("Expected a store for each element, got %d", stores)
+		}
+		var offsets []int
+		for _, ins := range generated["main"] {
+			if load, ok := ins.(ir.Load); ok {
+				offsets = append(offsets, load.Offset)
+			}
+		}
+		if fmt.Sprint(offsets) != "[0 8]" {
+			t.Errorf("Expected the elements to be loaded from offsets 0 and 8, got %v", offsets)
+		}
+	})
+
+	t.Run("Generic functions get an instance per list of types", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun id[T](x: T): T { x }
+			fun pair[A, B](a: A, b: B): (A, B) { (id(a), b) }
+			pair(1, true);
+			pair(2, true);
+			pair(true, [1]);
+		`, "")
+		generated := Generate(parser.Parse(tokens))
+		for _, name := range []string{"pair.Int.Bool", "pair.Bool.Array_Int", "id.Int", "id.Bool"} {
+			if _, ok := generated[name]; !ok {
+				t.Errorf("Expected an instance %s", name)
+			}
+		}
+		if _, ok := generated["id"]; ok {
+			t.Errorf("Expected no code for the generic function itself")
+		}
+		if len(generated) != 5 {
+			t.Errorf("Expected main and 4 instances, got %d functions", len(generated))
+		}
+	})
+
+	t.Run("Inferred types reach the generator", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun square(x: Int) { x * x }
+			var inc = fun(x) { x + 1 };
+			print_int(inc(square(3)));
+		`, "")
+		generated := Generate(typechecker.Infer(parser.Parse(tokens)))
+		if _, ok := generated["lambda.1"]; !ok {
+			t.Errorf("Expected code for the lambda, got %d functions", len(generated))
+		}
+		if _, ok := generated["square"]; !ok {
+			t.Errorf("Expected code for square")
+		}
+	})
+
+	t.Run("Consts are folded and loaded as constants", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun area(r: Int): Int { r * r * PI }
+			const PI = 3;
+			const BIG = 2 * -PI < -5;
+			print_bool(BIG);
+			area(2)
+		`, "")
+		generated := Generate(typechecker.Infer(parser.Parse(tokens)))
+		var bools []bool
+		for _, ins := range generated["main"] {
+			if load, ok := ins.(ir.LoadBoolConst); ok {
+				bools = append(bools, load.Value)
+			}
+			if copied, ok := ins.(ir.Copy); ok && copied.Dest == ir.Global("BIG") {
+				t.Errorf("Expected no global for a const, got %v", copied)
+			}
+		}
+		if fmt.Sprint(bools) != "[true]" {
+			t.Errorf("Expected BIG to be loaded as true, got %v", bools)
+		}
+		found := false
+		for _, ins := range generated["area"] {
+			if load, ok := ins.(ir.LoadIntConst); ok && load.Value == 3 {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected PI to be loaded as 3 in area")
+		}
+	})
+
+	t.Run("Sized and unsigned integers", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			var a: Int8 = 100;
+			var b: UInt64 = 7;
+			var c = (a + a) as Int;
+			print_bool(b / 2 < b);
+			-1 as UInt16
+		`, "")
+		generated := Generate(typechecker.Infer(parser.Parse(tokens)))
+		var calls []string
+		var loads []uint64
+		for _, ins := range generated["main"] {
+			switch i := ins.(type) {
+			case ir.Call:
+				calls = append(calls, i.Fun)
+			case ir.LoadIntConst:
+				loads = append(loads, i.Value)
+			}
+		}
+		if fmt.Sprint(calls) != "[+ __as_Int8 u/ u< print_bool unary_- __as_UInt16 print_int]" {
+			t.Errorf("Expected Int8 to wrap and UInt64 to use unsigned operators, got %v", calls)
+		}
+		if fmt.Sprint(loads) != "[100 7 2 1]" {
+			t.Errorf("Expected the literals to be loaded, got %v", loads)
+		}
+	})
 }
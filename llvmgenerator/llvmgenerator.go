@@ -0,0 +1,973 @@
+package llvmgenerator
+
+import (
+	"compiler/ir"
+	"compiler/utils"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// The runtime is written in LLVM IR on top of putchar/getchar so the emitted
+// module only needs libc to link. Runtime errors are written to stderr.
+const LLVM_RUNTIME = `declare i32 @putchar(i32)
+declare i32 @getchar()
+declare void @exit(i32)
+declare i8* @calloc(i64, i64)
+declare void @free(i8*)
+declare i64 @write(i32, i8*, i64)
+declare i32 @memcmp(i8*, i8*, i64)
+declare void @llvm.memcpy.p0i8.p0i8.i64(i8*, i8*, i64, i1)
+declare {i64, i1} @llvm.sadd.with.overflow.i64(i64, i64)
+declare {i64, i1} @llvm.ssub.with.overflow.i64(i64, i64)
+declare {i64, i1} @llvm.smul.with.overflow.i64(i64, i64)
+
+@.error = private constant [7 x i8] c"Error: "
+@.division_by_zero = private constant [16 x i8] c"division by zero"
+@.overflow = private constant [16 x i8] c"integer overflow"
+@.index_out_of_range = private constant [18 x i8] c"index out of range"
+@.at = private constant [4 x i8] c" at "
+@.newline = private constant [1 x i8] c"\0A"
+
+define private void @__exit(i64 %code) {
+entry:
+  %code32 = trunc i64 %code to i32
+  call void @exit(i32 %code32)
+  unreachable
+}
+
+; The LLVM backend has no collector, memory is only given back by delete.
+define void @gc_collect() {
+entry:
+  ret void
+}
+
+; Reports the runtime error with the status in %status, one of the
+; utils.RuntimeError codes, at the location %loc (length %len) and exits with
+; the status like the stdlib's __runtime_error.
+define private void @__runtime_error(i64 %status, i8* %loc, i64 %len) {
+entry:
+  %error = getelementptr [7 x i8], [7 x i8]* @.error, i64 0, i64 0
+  call i64 @write(i32 2, i8* %error, i64 7)
+  switch i64 %status, label %index [i64 3, label %division i64 4, label %overflow]
+division:
+  %division.msg = getelementptr [16 x i8], [16 x i8]* @.division_by_zero, i64 0, i64 0
+  call i64 @write(i32 2, i8* %division.msg, i64 16)
+  br label %location
+overflow:
+  %overflow.msg = getelementptr [16 x i8], [16 x i8]* @.overflow, i64 0, i64 0
+  call i64 @write(i32 2, i8* %overflow.msg, i64 16)
+  br label %location
+index:
+  %index.msg = getelementptr [18 x i8], [18 x i8]* @.index_out_of_range, i64 0, i64 0
+  call i64 @write(i32 2, i8* %index.msg, i64 18)
+  br label %location
+location:
+  %at = getelementptr [4 x i8], [4 x i8]* @.at, i64 0, i64 0
+  call i64 @write(i32 2, i8* %at, i64 4)
+  call i64 @write(i32 2, i8* %loc, i64 %len)
+  %nl = getelementptr [1 x i8], [1 x i8]* @.newline, i64 0, i64 0
+  call i64 @write(i32 2, i8* %nl, i64 1)
+  %code = trunc i64 %status to i32
+  call void @exit(i32 %code)
+  unreachable
+}
+
+define private void @__print_digits(i64 %n) {
+entry:
+  %big = icmp uge i64 %n, 10
+  br i1 %big, label %rec, label %digit
+rec:
+  %q = udiv i64 %n, 10
+  call void @__print_digits(i64 %q)
+  br label %digit
+digit:
+  %r = urem i64 %n, 10
+  %c = add i64 %r, 48
+  %c32 = trunc i64 %c to i32
+  call i32 @putchar(i32 %c32)
+  ret void
+}
+
+define void @print_int(i64 %v) {
+entry:
+  %neg = icmp slt i64 %v, 0
+  br i1 %neg, label %minus, label %digits
+minus:
+  call i32 @putchar(i32 45)
+  br label %digits
+digits:
+  %abs.neg = sub i64 0, %v
+  %abs = select i1 %neg, i64 %abs.neg, i64 %v
+  call void @__print_digits(i64 %abs)
+  call i32 @putchar(i32 10)
+  ret void
+}
+
+define void @print_bool(i1 %b) {
+entry:
+  br i1 %b, label %t, label %f
+t:
+  call i32 @putchar(i32 116)
+  call i32 @putchar(i32 114)
+  call i32 @putchar(i32 117)
+  call i32 @putchar(i32 101)
+  br label %done
+f:
+  call i32 @putchar(i32 102)
+  call i32 @putchar(i32 97)
+  call i32 @putchar(i32 108)
+  call i32 @putchar(i32 115)
+  call i32 @putchar(i32 101)
+  br label %done
+done:
+  call i32 @putchar(i32 10)
+  ret void
+}
+
+; A string points to its length in bytes, followed by the bytes.
+define void @print_string(i64 %s) {
+entry:
+  %len.ptr = inttoptr i64 %s to i64*
+  %len = load i64, i64* %len.ptr
+  %base = inttoptr i64 %s to i8*
+  %bytes = getelementptr i8, i8* %base, i64 8
+  br label %loop
+loop:
+  %i = phi i64 [0, %entry], [%next, %body]
+  %done = icmp eq i64 %i, %len
+  br i1 %done, label %end, label %body
+body:
+  %c.ptr = getelementptr i8, i8* %bytes, i64 %i
+  %c = load i8, i8* %c.ptr
+  %c32 = zext i8 %c to i32
+  call i32 @putchar(i32 %c32)
+  %next = add i64 %i, 1
+  br label %loop
+end:
+  call i32 @putchar(i32 10)
+  ret void
+}
+
+define i64 @concat(i64 %a, i64 %b) {
+entry:
+  %a.len.ptr = inttoptr i64 %a to i64*
+  %a.len = load i64, i64* %a.len.ptr
+  %b.len.ptr = inttoptr i64 %b to i64*
+  %b.len = load i64, i64* %b.len.ptr
+  %len = add i64 %a.len, %b.len
+  %size = add i64 %len, 8
+  %mem = call i8* @calloc(i64 %size, i64 1)
+  %len.ptr = bitcast i8* %mem to i64*
+  store i64 %len, i64* %len.ptr
+  %a.base = inttoptr i64 %a to i8*
+  %a.bytes = getelementptr i8, i8* %a.base, i64 8
+  %b.base = inttoptr i64 %b to i8*
+  %b.bytes = getelementptr i8, i8* %b.base, i64 8
+  %dest = getelementptr i8, i8* %mem, i64 8
+  call void @llvm.memcpy.p0i8.p0i8.i64(i8* %dest, i8* %a.bytes, i64 %a.len, i1 false)
+  %dest.b = getelementptr i8, i8* %dest, i64 %a.len
+  call void @llvm.memcpy.p0i8.p0i8.i64(i8* %dest.b, i8* %b.bytes, i64 %b.len, i1 false)
+  %res = ptrtoint i8* %mem to i64
+  ret i64 %res
+}
+
+define i1 @__string_equals(i64 %a, i64 %b) {
+entry:
+  %a.len.ptr = inttoptr i64 %a to i64*
+  %a.len = load i64, i64* %a.len.ptr
+  %b.len.ptr = inttoptr i64 %b to i64*
+  %b.len = load i64, i64* %b.len.ptr
+  %same.len = icmp eq i64 %a.len, %b.len
+  br i1 %same.len, label %compare, label %done
+compare:
+  %a.base = inttoptr i64 %a to i8*
+  %a.bytes = getelementptr i8, i8* %a.base, i64 8
+  %b.base = inttoptr i64 %b to i8*
+  %b.bytes = getelementptr i8, i8* %b.base, i64 8
+  %cmp = call i32 @memcmp(i8* %a.bytes, i8* %b.bytes, i64 %a.len)
+  %same.bytes = icmp eq i32 %cmp, 0
+  br label %done
+done:
+  %res = phi i1 [false, %entry], [%same.bytes, %compare]
+  ret i1 %res
+}
+
+define i64 @read_int() {
+entry:
+  br label %loop
+loop:
+  %acc = phi i64 [0, %entry], [%acc, %skip], [%next, %digit]
+  %neg = phi i1 [false, %entry], [%neg.next, %skip], [%neg, %digit]
+  %seen = phi i1 [false, %entry], [%seen, %skip], [true, %digit]
+  %c = call i32 @getchar()
+  %eof = icmp slt i32 %c, 0
+  br i1 %eof, label %eof.check, label %not.eof
+not.eof:
+  %nl = icmp eq i32 %c, 10
+  br i1 %nl, label %end, label %classify
+classify:
+  %lo = icmp sge i32 %c, 48
+  %hi = icmp sle i32 %c, 57
+  %isdigit = and i1 %lo, %hi
+  br i1 %isdigit, label %digit, label %skip
+skip:
+  %minus = icmp eq i32 %c, 45
+  %neg.next = xor i1 %neg, %minus
+  br label %loop
+digit:
+  %d32 = sub i32 %c, 48
+  %d = sext i32 %d32 to i64
+  %acc10 = mul i64 %acc, 10
+  %next = add i64 %acc10, %d
+  br label %loop
+eof.check:
+  br i1 %seen, label %end, label %error
+error:
+  call void @exit(i32 1)
+  unreachable
+end:
+  %negated = sub i64 0, %acc
+  %res = select i1 %neg, i64 %negated, i64 %acc
+  ret i64 %res
+}
+`
+
+// libcDeclarations are the libc functions declared by LLVM_RUNTIME.
+var libcDeclarations = map[string]bool{
+	"putchar": true,
+	"getchar": true,
+	"exit":    true,
+	"calloc":  true,
+	"free":    true,
+	"write":   true,
+	"memcmp":  true,
+}
+
+var runtimeFunctions = map[string]bool{
+	"print_int":  true,
+	"print_bool": true,
+	"read_int":   true,
+	"exit":       true,
+	"gc_collect": true,
+
+	"print_string":    true,
+	"concat":          true,
+	"__string_equals": true,
+}
+
+// runtimeNames renames builtins whose names clash with libc.
+var runtimeNames = map[string]string{
+	"exit": "__exit",
+}
+
+type function struct {
+	opts     Options
+	name     string
+	sigs     map[string]utils.Fun
+	varTypes map[ir.IRVar]utils.Type
+	lines    []string
+	// globals are module level definitions the function refers to, such as
+	// the locations reported by runtime errors.
+	globals []string
+	tmp     int
+	// terminated is set after a br/ret so that following instructions get
+	// a fresh basic block.
+	terminated bool
+}
+
+// Options controls optional code generation features.
+type Options struct {
+	// CheckOverflow makes + - * / and unary - trap on signed overflow.
+	CheckOverflow bool
+}
+
+// GenerateLLVM converts the IR function map produced by
+// irgenerator.GenerateWithTypes into a textual LLVM IR module.
+func GenerateLLVM(funcMap map[string][]ir.Instruction, types map[string]map[ir.IRVar]utils.Type) string {
+	return GenerateLLVMWithOptions(funcMap, types, Options{})
+}
+
+func GenerateLLVMWithOptions(funcMap map[string][]ir.Instruction, types map[string]map[ir.IRVar]utils.Type, opts Options) string {
+	var lines []string
+	emit := func(s string) { lines = append(lines, s) }
+
+	sigs := collectSignatures(funcMap, types)
+
+	emit("; ModuleID = 'compiler'")
+	emit(LLVM_RUNTIME)
+
+	names := make([]string, 0, len(funcMap))
+	for name := range funcMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Functions that are neither defined here nor part of the runtime are
+	// extern functions provided by the linker.
+	var externs []string
+	for name := range sigs {
+		if _, defined := funcMap[name]; !defined && !runtimeFunctions[name] {
+			externs = append(externs, name)
+		}
+	}
+	sort.Strings(externs)
+	for _, name := range externs {
+		if libcDeclarations[name] {
+			panic(fmt.Sprintf("Extern function %s clashes with the LLVM runtime's declaration", name))
+		}
+		sig := sigs[name]
+		var params []string
+		for _, p := range sig.Params {
+			params = append(params, llvmType(p))
+		}
+		emit(fmt.Sprintf("declare %s @%s(%s)", llvmType(sig.Res), name, strings.Join(params, ", ")))
+	}
+	if len(externs) > 0 {
+		emit("")
+	}
+
+	// Globals are zeroed until main assigns them
+	globals := make(map[ir.IRVar]string)
+	for _, name := range names {
+		for _, ins := range funcMap[name] {
+			for _, v := range ins.GetVars() {
+				if ir.IsGlobal(v) {
+					globals[v] = llvmType(types[name][v])
+				}
+			}
+		}
+	}
+	globalNames := make([]string, 0, len(globals))
+	for v := range globals {
+		globalNames = append(globalNames, v)
+	}
+	sort.Strings(globalNames)
+	for _, v := range globalNames {
+		zero := "0"
+		if globals[v] == "i1" {
+			zero = "false"
+		}
+		emit(fmt.Sprintf("@%s = internal global %s %s", v, globals[v], zero))
+	}
+	if len(globalNames) > 0 {
+		emit("")
+	}
+
+	for _, name := range names {
+		f := &function{
+			name:     name,
+			sigs:     sigs,
+			varTypes: types[name],
+			opts:     opts,
+		}
+		lines = append(lines, f.generate(funcMap[name])...)
+		lines = append(lines, f.globals...)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// collectSignatures finds the signatures of the functions that are defined
+// or referred to by name. Other variables of a function type hold closures.
+func collectSignatures(funcMap map[string][]ir.Instruction, types map[string]map[ir.IRVar]utils.Type) map[string]utils.Fun {
+	named := make(map[string]bool)
+	for name, instructions := range funcMap {
+		named[name] = true
+		for _, ins := range instructions {
+			switch i := ins.(type) {
+			case ir.Call:
+				named[i.Fun] = true
+			case ir.LoadFunction:
+				named[i.Fun] = true
+			}
+		}
+	}
+	sigs := make(map[string]utils.Fun)
+	for _, varTypes := range types {
+		for name, t := range varTypes {
+			if ft, ok := t.(utils.Fun); ok && ft.Res != nil && named[name] {
+				sigs[name] = ft
+			}
+		}
+	}
+	return sigs
+}
+
+// llvmType maps a language type to its LLVM representation. Unit values are
+// never materialised so it maps to void. Pointers, arrays, structs, enums,
+// tuples, strings and closures are kept as i64 addresses and cast to a typed pointer when
+// loading or storing through them.
+func llvmType(t utils.Type) string {
+	switch t.(type) {
+	case utils.Int, utils.Pointer, utils.Array, utils.Struct, utils.Enum, utils.Tuple, utils.String, utils.Fun:
+		return "i64"
+	case utils.Bool:
+		return "i1"
+	default:
+		return "void"
+	}
+}
+
+// functionPointerType is the LLVM type of a pointer to a function with the
+// given signature. Unit parameters are left out like in its definition.
+func functionPointerType(sig utils.Fun) string {
+	var params []string
+	for _, p := range sig.Params {
+		if t := llvmType(p); t != "void" {
+			params = append(params, t)
+		}
+	}
+	return fmt.Sprintf("%s (%s)*", llvmType(sig.Res), strings.Join(params, ", "))
+}
+
+func (f *function) emit(s string) {
+	f.lines = append(f.lines, s)
+}
+
+// emitInstr emits a non-terminator instruction, opening a new basic block
+// if the previous one already ended.
+func (f *function) emitInstr(s string) {
+	if f.terminated {
+		f.tmp++
+		f.emit(fmt.Sprintf("dead.%d:", f.tmp))
+		f.terminated = false
+	}
+	f.emit("  " + s)
+}
+
+func (f *function) emitTerminator(s string) {
+	f.emitInstr(s)
+	f.terminated = true
+}
+
+func (f *function) newTmp() string {
+	f.tmp++
+	return fmt.Sprintf("%%t%d", f.tmp)
+}
+
+// varRef is the LLVM pointer to the memory of an IR variable: an alloca in
+// the function's frame or a module level global.
+func varRef(v ir.IRVar) string {
+	if ir.IsGlobal(v) {
+		return "@" + v
+	}
+	return "%" + v
+}
+
+func (f *function) typeOf(v ir.IRVar) string {
+	return llvmType(f.varTypes[v])
+}
+
+// load reads an IR variable and converts it to the wanted LLVM type.
+func (f *function) load(v ir.IRVar, want string) string {
+	have := f.typeOf(v)
+	if have == "void" {
+		if want == "i1" {
+			return "false"
+		}
+		return "0"
+	}
+	val := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = load %s, %s* %s", val, have, have, varRef(v)))
+	return f.convert(val, have, want)
+}
+
+func (f *function) convert(val, have, want string) string {
+	if have == want || want == "void" {
+		return val
+	}
+	res := f.newTmp()
+	if have == "i1" && want == "i64" {
+		f.emitInstr(fmt.Sprintf("%s = zext i1 %s to i64", res, val))
+	} else {
+		f.emitInstr(fmt.Sprintf("%s = icmp ne i64 %s, 0", res, val))
+	}
+	return res
+}
+
+// store writes an LLVM value of the given type into an IR variable.
+func (f *function) store(val, have string, dest ir.IRVar) {
+	want := f.typeOf(dest)
+	if want == "void" || have == "void" {
+		return
+	}
+	val = f.convert(val, have, want)
+	f.emitInstr(fmt.Sprintf("store %s %s, %s* %s", want, val, want, varRef(dest)))
+}
+
+func (f *function) returnType() string {
+	if f.name == "main" {
+		return "i32"
+	}
+	return llvmType(f.sigs[f.name].Res)
+}
+
+func (f *function) emitDefaultReturn() {
+	switch f.returnType() {
+	case "void":
+		f.emitTerminator("ret void")
+	case "i1":
+		f.emitTerminator("ret i1 false")
+	case "i32":
+		f.emitTerminator("ret i32 0")
+	default:
+		f.emitTerminator("ret i64 0")
+	}
+}
+
+func (f *function) generate(instructions []ir.Instruction) []string {
+	// Parameters come from the LoadParam instructions of the function.
+	paramTypes := map[int]string{}
+	maxParam := -1
+	for _, ins := range instructions {
+		if lp, ok := ins.(ir.LoadParam); ok {
+			paramTypes[lp.Index] = f.typeOf(lp.Dest)
+			if lp.Index > maxParam {
+				maxParam = lp.Index
+			}
+		}
+	}
+	var params []string
+	for i := 0; i <= maxParam; i++ {
+		if t := paramTypes[i]; t != "void" && t != "" {
+			params = append(params, fmt.Sprintf("%s %%p%d", t, i))
+		}
+	}
+
+	// The code of function values is only reached through closures
+	linkage := ""
+	if strings.Contains(f.name, ".") {
+		linkage = "internal "
+	}
+	f.emit(fmt.Sprintf("define %s%s @%s(%s) {", linkage, f.returnType(), f.name, strings.Join(params, ", ")))
+	f.emit("entry:")
+
+	seen := map[ir.IRVar]bool{}
+	for _, ins := range instructions {
+		for _, v := range ins.GetVars() {
+			if v == "" || seen[v] || ir.IsGlobal(v) {
+				continue
+			}
+			seen[v] = true
+			if t := f.typeOf(v); t != "void" {
+				f.emitInstr(fmt.Sprintf("%%%s = alloca %s", v, t))
+			}
+		}
+	}
+
+	for _, ins := range instructions {
+		switch i := ins.(type) {
+		case ir.LoadIntConst:
+			f.store(fmt.Sprintf("%d", int64(i.Value)), "i64", i.Dest)
+
+		case ir.LoadBoolConst:
+			f.store(fmt.Sprintf("%v", i.Value), "i1", i.Dest)
+
+		case ir.LoadStringConst:
+			f.tmp++
+			name := fmt.Sprintf("@.str.%s.%d", f.name, f.tmp)
+			constType := fmt.Sprintf("<{ i64, [%d x i8] }>", len(i.Value))
+			f.globals = append(f.globals, fmt.Sprintf("%s = private constant %s <{ i64 %d, [%d x i8] c\"%s\" }>, align 8",
+				name, constType, len(i.Value), len(i.Value), llvmEscape(i.Value)))
+			res := f.newTmp()
+			f.emitInstr(fmt.Sprintf("%s = ptrtoint %s* %s to i64", res, constType, name))
+			f.store(res, "i64", i.Dest)
+
+		case ir.Copy:
+			want := f.typeOf(i.Dest)
+			if want == "void" {
+				continue
+			}
+			f.store(f.load(i.Source, want), want, i.Dest)
+
+		case ir.LoadParam:
+			t := f.typeOf(i.Dest)
+			if t != "void" {
+				f.store(fmt.Sprintf("%%p%d", i.Index), t, i.Dest)
+			}
+
+		case ir.Label:
+			if !f.terminated {
+				f.emitTerminator(fmt.Sprintf("br label %%%s", i.Label))
+			}
+			f.emit(fmt.Sprintf("%s:", i.Label))
+			f.terminated = false
+
+		case ir.Jump:
+			f.emitTerminator(fmt.Sprintf("br label %%%s", i.Label.Label))
+
+		case ir.CondJump:
+			cond := f.load(i.Cond, "i1")
+			f.emitTerminator(fmt.Sprintf("br i1 %s, label %%%s, label %%%s",
+				cond, i.ThenLabel.Label, i.ElseLabel.Label))
+
+		case ir.JumpTable:
+			// The index is always in range, so any label can be the default
+			index := f.load(i.Index, "i64")
+			cases := make([]string, len(i.Labels)-1)
+			for j, label := range i.Labels[1:] {
+				cases[j] = fmt.Sprintf("i64 %d, label %%%s", j+1, label.Label)
+			}
+			f.emitTerminator(fmt.Sprintf("switch i64 %s, label %%%s [ %s ]",
+				index, i.Labels[0].Label, strings.Join(cases, " ")))
+
+		case ir.Return:
+			switch rt := f.returnType(); rt {
+			case "void":
+				f.emitTerminator("ret void")
+			case "i32":
+				// main's Int result becomes the exit status
+				status := "0"
+				if f.typeOf(i.Value) == "i64" {
+					status = f.newTmp()
+					f.emitInstr(fmt.Sprintf("%s = trunc i64 %s to i32", status, f.load(i.Value, "i64")))
+				}
+				f.emitTerminator(fmt.Sprintf("ret i32 %s", status))
+			default:
+				f.emitTerminator(fmt.Sprintf("ret %s %s", rt, f.load(i.Value, rt)))
+			}
+
+		case ir.Call:
+			f.generateCall(i)
+
+		case ir.LoadFunction:
+			res := f.newTmp()
+			f.emitInstr(fmt.Sprintf("%s = ptrtoint %s @%s to i64", res, functionPointerType(f.sigs[i.Fun]), i.Fun))
+			f.store(res, "i64", i.Dest)
+
+		case ir.CallClosure:
+			// The first word of the record is the code, which gets the
+			// record before the arguments
+			sig := f.varTypes[i.Closure].(utils.Fun)
+			code := f.newTmp()
+			f.emitInstr(fmt.Sprintf("%s = load i64, i64* %s", code, f.pointer(i.Closure, "i64")))
+			fnType := functionPointerType(utils.Fun{Params: append([]utils.Type{sig}, sig.Params...), Res: sig.Res})
+			fn := f.newTmp()
+			f.emitInstr(fmt.Sprintf("%s = inttoptr i64 %s to %s", fn, code, fnType))
+			args := []string{"i64 " + f.load(i.Closure, "i64")}
+			for j, arg := range i.Args {
+				if t := llvmType(sig.Params[j]); t != "void" {
+					args = append(args, fmt.Sprintf("%s %s", t, f.load(arg, t)))
+				}
+			}
+			resType := llvmType(sig.Res)
+			if resType == "void" {
+				f.emitInstr(fmt.Sprintf("call void %s(%s)", fn, strings.Join(args, ", ")))
+				continue
+			}
+			res := f.newTmp()
+			f.emitInstr(fmt.Sprintf("%s = call %s %s(%s)", res, resType, fn, strings.Join(args, ", ")))
+			f.store(res, resType, i.Dest)
+
+		case ir.Load:
+			t := f.typeOf(i.Dest)
+			if t == "void" {
+				continue
+			}
+			ptr := f.pointerAt(i.Address, i.Offset, t)
+			val := f.newTmp()
+			f.emitInstr(fmt.Sprintf("%s = load %s, %s* %s", val, t, t, ptr))
+			f.store(val, t, i.Dest)
+
+		case ir.Store:
+			t := f.typeOf(i.Value)
+			if t == "void" {
+				continue
+			}
+			ptr := f.pointerAt(i.Address, i.Offset, t)
+			f.emitInstr(fmt.Sprintf("store %s %s, %s* %s", t, f.load(i.Value, t), t, ptr))
+
+		default:
+			panic(fmt.Sprintf("Unsupported instruction in LLVM backend: %v", i))
+		}
+	}
+
+	if !f.terminated {
+		f.emitDefaultReturn()
+	}
+	f.emit("}")
+	f.emit("")
+	return f.lines
+}
+
+// pointer converts the address held in v to a pointer to elem.
+func (f *function) pointer(v ir.IRVar, elem string) string {
+	return f.pointerAt(v, 0, elem)
+}
+
+// pointerAt converts the address offset bytes past the one held in v to a
+// pointer to elem.
+func (f *function) pointerAt(v ir.IRVar, offset int, elem string) string {
+	address := f.load(v, "i64")
+	if offset != 0 {
+		moved := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = add i64 %s, %d", moved, address, offset))
+		address = moved
+	}
+	ptr := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = inttoptr i64 %s to %s*", ptr, address, elem))
+	return ptr
+}
+
+var binaryOps = map[string]string{
+	"+": "add",
+	"-": "sub",
+	"*": "mul",
+	"/": "sdiv",
+	"%": "srem",
+
+	"u+": "add",
+	"u-": "sub",
+	"u*": "mul",
+	"u/": "udiv",
+	"u%": "urem",
+}
+
+var comparisonOps = map[string]string{
+	"==": "eq",
+	"!=": "ne",
+	"<":  "slt",
+	"<=": "sle",
+	">":  "sgt",
+	">=": "sge",
+
+	"u<":  "ult",
+	"u<=": "ule",
+	"u>":  "ugt",
+	"u>=": "uge",
+}
+
+// extensions are the conversions that wrap a word around to an integer type
+// narrower than 64 bits: the low bits are kept and extended back
+var extensions = map[string]string{
+	"__as_Int8":   "sext i8",
+	"__as_Int16":  "sext i16",
+	"__as_Int32":  "sext i32",
+	"__as_UInt8":  "zext i8",
+	"__as_UInt16": "zext i16",
+	"__as_UInt32": "zext i32",
+}
+
+// signedDivision divides a by b with sdiv or srem. MinInt64 / -1 is
+// undefined there, so a divisor of -1 gives -a, which wraps around or traps
+// at loc with overflow checking, and a remainder of 0.
+func (f *function) signedDivision(op string, a string, b string, loc ir.Location) string {
+	minusOne := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = icmp eq i64 %s, -1", minusOne, b))
+	if op == "sdiv" && f.opts.CheckOverflow {
+		minInt := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = icmp eq i64 %s, %d", minInt, a, math.MinInt64))
+		overflow := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = and i1 %s, %s", overflow, minusOne, minInt))
+		f.trapIf(overflow, utils.RuntimeErrorOverflow, loc)
+	}
+	divisor := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = select i1 %s, i64 1, i64 %s", divisor, minusOne, b))
+	divided := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = %s i64 %s, %s", divided, op, a, divisor))
+	byMinusOne := "0"
+	if op == "sdiv" {
+		byMinusOne = f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = sub i64 0, %s", byMinusOne, a))
+	}
+	res := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = select i1 %s, i64 %s, i64 %s", res, minusOne, byMinusOne, divided))
+	return res
+}
+
+// withOverflow computes a op b with the llvm.s<op>.with.overflow intrinsic
+// and traps at loc when it overflows
+func (f *function) withOverflow(op string, a string, b string, loc ir.Location) string {
+	pair := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = call {i64, i1} @llvm.s%s.with.overflow.i64(i64 %s, i64 %s)", pair, op, a, b))
+	overflow := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = extractvalue {i64, i1} %s, 1", overflow, pair))
+	f.trapIf(overflow, utils.RuntimeErrorOverflow, loc)
+	res := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = extractvalue {i64, i1} %s, 0", res, pair))
+	return res
+}
+
+// trapIf branches to a runtime error with status at loc when cond holds
+func (f *function) trapIf(cond string, status int, loc ir.Location) {
+	f.tmp++
+	fail := fmt.Sprintf("error.%d", f.tmp)
+	ok := fmt.Sprintf("ok.%d", f.tmp)
+	f.emitTerminator(fmt.Sprintf("br i1 %s, label %%%s, label %%%s", cond, fail, ok))
+	f.emit(fmt.Sprintf("%s:", fail))
+	f.terminated = false
+	text := f.locationString(loc)
+	f.emitInstr(fmt.Sprintf("call void @__runtime_error(i64 %d, i8* %s, i64 %d)", status, text, len(loc.Position())))
+	f.emitTerminator("unreachable")
+	f.emit(fmt.Sprintf("%s:", ok))
+	f.terminated = false
+}
+
+func (f *function) generateCall(c ir.Call) {
+	if op, ok := binaryOps[c.Fun]; ok && len(c.Args) == 2 {
+		a := f.load(c.Args[0], "i64")
+		b := f.load(c.Args[1], "i64")
+		if strings.HasSuffix(op, "div") || strings.HasSuffix(op, "rem") {
+			zero := f.newTmp()
+			f.emitInstr(fmt.Sprintf("%s = icmp eq i64 %s, 0", zero, b))
+			f.trapIf(zero, utils.RuntimeErrorDivisionByZero, c.Location)
+		}
+		if c.Fun == "/" || c.Fun == "%" {
+			f.store(f.signedDivision(op, a, b, c.Location), "i64", c.Dest)
+			return
+		}
+		if f.opts.CheckOverflow && (c.Fun == "+" || c.Fun == "-" || c.Fun == "*") {
+			f.store(f.withOverflow(op, a, b, c.Location), "i64", c.Dest)
+			return
+		}
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = %s i64 %s, %s", res, op, a, b))
+		f.store(res, "i64", c.Dest)
+		return
+	}
+	if pred, ok := comparisonOps[c.Fun]; ok && len(c.Args) == 2 {
+		t := f.typeOf(c.Args[0])
+		if t == "void" {
+			t = "i64"
+		}
+		a := f.load(c.Args[0], t)
+		b := f.load(c.Args[1], t)
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = icmp %s %s %s, %s", res, pred, t, a, b))
+		f.store(res, "i1", c.Dest)
+		return
+	}
+	if extension, ok := extensions[c.Fun]; ok {
+		op, narrow, _ := strings.Cut(extension, " ")
+		truncated := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = trunc i64 %s to %s", truncated, f.load(c.Args[0], "i64"), narrow))
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = %s %s %s to i64", res, op, narrow, truncated))
+		f.store(res, "i64", c.Dest)
+		return
+	}
+	switch c.Fun {
+	case "unary_-":
+		a := f.load(c.Args[0], "i64")
+		if f.opts.CheckOverflow {
+			f.store(f.withOverflow("sub", "0", a, c.Location), "i64", c.Dest)
+			return
+		}
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = sub i64 0, %s", res, a))
+		f.store(res, "i64", c.Dest)
+		return
+	case "__c_bool":
+		f.store(f.load(c.Args[0], "i1"), "i1", c.Dest)
+		return
+	case "unary_&":
+		t := f.typeOf(c.Args[0])
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = ptrtoint %s* %s to i64", res, t, varRef(c.Args[0])))
+		f.store(res, "i64", c.Dest)
+		return
+	case "__new":
+		mem := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = call i8* @calloc(i64 1, i64 %s)", mem, f.load(c.Args[0], "i64")))
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = ptrtoint i8* %s to i64", res, mem))
+		f.store(res, "i64", c.Dest)
+		return
+	case "__delete":
+		f.emitInstr(fmt.Sprintf("call void @free(i8* %s)", f.pointer(c.Args[0], "i8")))
+		return
+	case "new[]":
+		// The length is kept in the word before the elements
+		length := f.load(c.Args[0], "i64")
+		words := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = add i64 %s, 1", words, length))
+		mem := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = call i8* @calloc(i64 %s, i64 8)", mem, words))
+		array := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = bitcast i8* %s to i64*", array, mem))
+		f.emitInstr(fmt.Sprintf("store i64 %s, i64* %s", length, array))
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = ptrtoint i8* %s to i64", res, mem))
+		f.store(res, "i64", c.Dest)
+		return
+	case "&[]":
+		array := f.pointer(c.Args[0], "i64")
+		index := f.load(c.Args[1], "i64")
+		length := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = load i64, i64* %s", length, array))
+		outOfRange := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = icmp uge i64 %s, %s", outOfRange, index, length))
+		f.trapIf(outOfRange, utils.RuntimeErrorIndexOutOfRange, c.Location)
+		offset := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = add i64 %s, 1", offset, index))
+		element := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = getelementptr i64, i64* %s, i64 %s", element, array, offset))
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = ptrtoint i64* %s to i64", res, element))
+		f.store(res, "i64", c.Dest)
+		return
+	case "unary_not":
+		a := f.load(c.Args[0], "i1")
+		res := f.newTmp()
+		f.emitInstr(fmt.Sprintf("%s = xor i1 %s, true", res, a))
+		f.store(res, "i1", c.Dest)
+		return
+	}
+
+	sig, ok := f.sigs[c.Fun]
+	if !ok {
+		panic(fmt.Sprintf("Unknown function in LLVM backend: %s", c.Fun))
+	}
+	var args []string
+	for idx, arg := range c.Args {
+		want := "i64"
+		if idx < len(sig.Params) {
+			want = llvmType(sig.Params[idx])
+		}
+		if want == "void" {
+			continue
+		}
+		args = append(args, fmt.Sprintf("%s %s", want, f.load(arg, want)))
+	}
+	callee := c.Fun
+	if name, ok := runtimeNames[callee]; ok {
+		callee = name
+	}
+	resType := llvmType(sig.Res)
+	if resType == "void" {
+		f.emitInstr(fmt.Sprintf("call void @%s(%s)", callee, strings.Join(args, ", ")))
+		return
+	}
+	res := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = call %s @%s(%s)", res, resType, callee, strings.Join(args, ", ")))
+	f.store(res, resType, c.Dest)
+}
+
+// locationString defines loc as a module level string and returns a pointer
+// to its first byte.
+func (f *function) locationString(loc ir.Location) string {
+	text := loc.Position()
+	f.tmp++
+	name := fmt.Sprintf("@.loc.%s.%d", f.name, f.tmp)
+	f.globals = append(f.globals, fmt.Sprintf("%s = private constant [%d x i8] c\"%s\"",
+		name, len(text), llvmEscape(text)))
+	ptr := f.newTmp()
+	f.emitInstr(fmt.Sprintf("%s = getelementptr [%d x i8], [%d x i8]* %s, i64 0, i64 0",
+		ptr, len(text), len(text), name))
+	return ptr
+}
+
+// llvmEscape escapes s for use inside a c"..." constant.
+func llvmEscape(s string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 0x20 && c < 0x7f && c != '"' && c != '\\' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "\\%02X", c)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,219 @@
+package llvmgenerator
+
+import (
+	"compiler/irgenerator"
+	"compiler/parser"
+	"compiler/tokenizer"
+	"compiler/typechecker"
+	"compiler/utils"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// generate compiles a program to an LLVM IR module
+func generate(t *testing.T, source string) string {
+	t.Helper()
+	return generateWithOptions(t, source, Options{})
+}
+
+func generateWithOptions(t *testing.T, source string, opts Options) string {
+	t.Helper()
+	res := typechecker.Infer(parser.Parse(tokenizer.Tokenize(source, "")))
+	funcMap, types := irgenerator.GenerateWithTypes(res, irgenerator.Options{})
+	return GenerateLLVMWithOptions(funcMap, types, opts)
+}
+
+// definition returns the definition of the function name in a module
+func definition(t *testing.T, module string, name string) string {
+	t.Helper()
+	for _, def := range strings.SplitAfter(module, "\n}\n") {
+		start := strings.Index(def, "define ")
+		if start < 0 {
+			continue
+		}
+		def = def[start:]
+		if strings.Contains(strings.SplitN(def, "\n", 2)[0], " @"+name+"(") {
+			return def
+		}
+	}
+	t.Fatalf("Expected a definition of %s in\n%s", name, module)
+	return ""
+}
+
+// requireToolchain skips the test unless lli, or llc and gcc, can run a module
+func requireToolchain(t *testing.T) {
+	if _, err := exec.LookPath("lli"); err == nil {
+		return
+	}
+	for _, tool := range []string{"llc", "gcc"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+}
+
+// run executes a module and returns what it printed
+func run(t *testing.T, module string) string {
+	t.Helper()
+	stdout, stderr, status := runWithStatus(t, module)
+	if status != 0 {
+		t.Fatalf("Running the module failed with status %d: %s", status, stderr)
+	}
+	return stdout
+}
+
+// runWithStatus executes a module with lli, or links it with llc and gcc
+// when lli is missing, and returns what it printed and its exit status
+func runWithStatus(t *testing.T, module string) (string, string, int) {
+	t.Helper()
+	dir := t.TempDir()
+	ll := filepath.Join(dir, "program.ll")
+	if err := os.WriteFile(ll, []byte(module), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("lli"); err == nil {
+		cmd = exec.Command("lli", ll)
+	} else {
+		asm, exe := filepath.Join(dir, "program.s"), filepath.Join(dir, "program")
+		for _, args := range [][]string{{"llc", "-relocation-model=pic", ll, "-o", asm}, {"gcc", asm, "-o", exe}} {
+			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+				t.Fatalf("%s failed: %v\n%s", args[0], err, out)
+			}
+		}
+		cmd = exec.Command(exe)
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), stderr.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), stderr.String(), 0
+}
+
+func TestLLVM(t *testing.T) {
+	t.Run("A function with arithmetic", func(t *testing.T) {
+		module := generate(t, "fun square(x: Int): Int { x * x }\nprint_int(square(3));")
+		expected := `define i64 @square(i64 %p0) {
+entry:
+  %x0 = alloca i64
+  %x1 = alloca i64
+  store i64 %p0, i64* %x0
+  %t1 = load i64, i64* %x0
+  %t2 = load i64, i64* %x0
+  %t3 = mul i64 %t1, %t2
+  store i64 %t3, i64* %x1
+  %t4 = load i64, i64* %x1
+  ret i64 %t4
+}
+`
+		if got := definition(t, module, "square"); got != expected {
+			t.Errorf("Expected\n%s\ngot\n%s", expected, got)
+		}
+	})
+
+	t.Run("Globals, externs and comparisons", func(t *testing.T) {
+		module := generate(t, "extern fun labs(n: Int): Int;\nvar x = 3;\nprint_bool(labs(x) < 5);")
+		for _, line := range []string{
+			"declare i64 @labs(i64)",
+			"@global.x = internal global i64 0",
+		} {
+			if !strings.Contains(module, line+"\n") {
+				t.Errorf("Expected the line %q in\n%s", line, module)
+			}
+		}
+		expected := `define i32 @main() {
+entry:
+  %x0 = alloca i64
+  %x1 = alloca i64
+  %x2 = alloca i64
+  %x3 = alloca i1
+  store i64 3, i64* %x0
+  %t1 = load i64, i64* %x0
+  store i64 %t1, i64* @global.x
+  %t2 = load i64, i64* @global.x
+  %t3 = call i64 @labs(i64 %t2)
+  store i64 %t3, i64* %x1
+  store i64 5, i64* %x2
+  %t4 = load i64, i64* %x1
+  %t5 = load i64, i64* %x2
+  %t6 = icmp slt i64 %t4, %t5
+  store i1 %t6, i1* %x3
+  %t7 = load i1, i1* %x3
+  call void @print_bool(i1 %t7)
+  ret i32 0
+}
+`
+		if got := definition(t, module, "main"); got != expected {
+			t.Errorf("Expected\n%s\ngot\n%s", expected, got)
+		}
+	})
+
+	t.Run("Running a program", func(t *testing.T) {
+		requireToolchain(t)
+		module := generate(t, `
+			fun fib(n: Int): Int {
+				if n < 2 then { n } else { fib(n - 1) + fib(n - 2) }
+			}
+			var i = 0;
+			while i < 8 do {
+				print_int(fib(i));
+				i = i + 1;
+			}
+			print_bool(-7 / -1 == 7 and -7 % 3 == -1);
+		`)
+		expected := "0\n1\n1\n2\n3\n5\n8\n13\ntrue\n"
+		if got := run(t, module); got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	})
+
+	t.Run("gc_collect can be called and used as a value", func(t *testing.T) {
+		requireToolchain(t)
+		module := generate(t, "var p = new Int(5);\ngc_collect();\nvar c = gc_collect;\nc();\nprint_int(*p);")
+		if got := run(t, module); got != "5\n" {
+			t.Errorf("Expected %q, got %q", "5\n", got)
+		}
+	})
+
+	t.Run("Division by zero is a located runtime error", func(t *testing.T) {
+		source := "var z = 0;\nprint_int(1);\nprint_int(7 / z);\nprint_int(7 % z);"
+		module := generate(t, source)
+		if !strings.Contains(module, "call void @__runtime_error(i64 3, ") {
+			t.Errorf("Expected a division by zero check in\n%s", definition(t, module, "main"))
+		}
+		requireToolchain(t)
+		stdout, stderr, status := runWithStatus(t, module)
+		if stdout != "1\n" || stderr != "Error: division by zero at 3:11\n" || status != utils.RuntimeErrorDivisionByZero {
+			t.Errorf("Expected 1 and a division by zero at 3:11, got %q, %q and status %d", stdout, stderr, status)
+		}
+	})
+
+	t.Run("Signed overflow traps with CheckOverflow", func(t *testing.T) {
+		requireToolchain(t)
+		// Only the line of the position of unary - is checked
+		for source, loc := range map[string]string{
+			"var m = 4611686018427387904;\nprint_int(1);\nprint_int(m * 2);":       "3:11",
+			"var m = 9223372036854775807;\nprint_int(1);\nprint_int(m + 1);":       "3:11",
+			"var m = -9223372036854775807 - 1;\nprint_int(1);\nprint_int(m / -1);": "3:11",
+			"var m = -9223372036854775807 - 1;\nprint_int(1);\nprint_int(0 - m);":  "3:11",
+			"var m = -9223372036854775807 - 1;\nprint_int(1);\nprint_int(-m);":     "3:",
+		} {
+			if stdout, _, status := runWithStatus(t, generate(t, source)); status != 0 || !strings.HasPrefix(stdout, "1\n") {
+				t.Errorf("Expected %q to wrap around without CheckOverflow, got %q and status %d", source, stdout, status)
+			}
+			stdout, stderr, status := runWithStatus(t, generateWithOptions(t, source, Options{CheckOverflow: true}))
+			expected := "Error: integer overflow at " + loc
+			if stdout != "1\n" || !strings.HasPrefix(stderr, expected) || status != utils.RuntimeErrorOverflow {
+				t.Errorf("Expected %q to print 1 and %q, got %q, %q and status %d", source, expected, stdout, stderr, status)
+			}
+		}
+	})
+}
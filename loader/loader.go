@@ -0,0 +1,323 @@
+// Package loader reads a program together with the files it imports and
+// merges them into one module for the rest of the compiler.
+//
+// Every imported file is a namespace named after the file without its
+// extension: the public functions of "lib/math.src" are called as
+// math.square(2) and are renamed to math.square in the merged module. Imported
+// files can only declare functions, structs, enums and externs. Structs, enums
+// and externs are shared by the whole program.
+package loader
+
+import (
+	"compiler/ast"
+	"compiler/parser"
+	"compiler/tokenizer"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var moduleName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type file struct {
+	path string
+	// prefix is put in front of the names of the functions of the file: the
+	// module name and a dot, empty for the main file
+	prefix    string
+	module    ast.Module
+	functions map[string]ast.FunctionDefinition
+	imports   map[string]*file
+	// shared holds the enums and externs of the whole program, which
+	// imported files can use besides their own functions and the builtins
+	shared map[string]bool
+}
+
+// builtins are the functions every file can call
+var builtins = []string{"print_int", "print_bool", "read_int", "print_string", "concat", "exit", "gc_collect", "len"}
+
+type loader struct {
+	// files by absolute path
+	files map[string]*file
+	// paths by module name, to tell apart files with the same name
+	names map[string]string
+	// loading holds the files being loaded, to find import cycles
+	loading []string
+	// order has every file after the files it imports
+	order []*file
+}
+
+// Load parses source, read from path, and the files it imports. Import paths
+// are relative to the directory of the importing file. A program without
+// imports is returned as the parser gives it.
+func Load(source string, path string) ast.Expression {
+	parsed := parser.Parse(tokenizer.Tokenize(source, path))
+	mod, ok := parsed.(ast.Module)
+	if !ok || len(mod.Imports) == 0 {
+		return parsed
+	}
+	l := &loader{files: map[string]*file{}, names: map[string]string{}}
+	main := l.load(mod, path, "")
+	return l.merge(main)
+}
+
+func (l *loader) load(mod ast.Module, path string, prefix string) *file {
+	key := absolute(path)
+	f := &file{
+		path:      path,
+		prefix:    prefix,
+		module:    mod,
+		functions: map[string]ast.FunctionDefinition{},
+		imports:   map[string]*file{},
+	}
+	l.files[key] = f
+	l.loading = append(l.loading, key)
+	for _, fn := range mod.Functions {
+		fd := fn.(ast.FunctionDefinition)
+		f.functions[fd.Name.(ast.Identifier).Name] = fd
+	}
+	for _, imp := range mod.Imports {
+		i := imp.(ast.Import)
+		imported := l.importFile(filepath.Join(filepath.Dir(path), i.Path), i.Location)
+		name := strings.TrimSuffix(imported.prefix, ".")
+		if _, ok := f.functions[name]; ok {
+			panic(fmt.Sprintf("Import %s has the name of a function at %v", name, i.Location))
+		}
+		f.imports[name] = imported
+	}
+	l.loading = l.loading[:len(l.loading)-1]
+	l.order = append(l.order, f)
+	return f
+}
+
+// importFile loads the file at path unless it was loaded already
+func (l *loader) importFile(path string, loc ast.Location) *file {
+	key := absolute(path)
+	for i, loading := range l.loading {
+		if loading == key {
+			var cycle []string
+			for _, p := range l.loading[i:] {
+				cycle = append(cycle, l.files[p].path)
+			}
+			cycle = append(cycle, path)
+			panic(fmt.Sprintf("Import cycle %s at %v", strings.Join(cycle, " -> "), loc))
+		}
+	}
+	if f, ok := l.files[key]; ok {
+		return f
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if !moduleName.MatchString(name) {
+		panic(fmt.Sprintf("Imported file %s does not have a valid module name at %v", path, loc))
+	}
+	if other, ok := l.names[name]; ok {
+		panic(fmt.Sprintf("Imported files %s and %s have the same module name %s at %v",
+			l.files[other].path, path, name, loc))
+	}
+	l.names[name] = key
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Sprintf("Cannot read import %s at %v: %v", path, loc, err))
+	}
+	var mod ast.Module
+	switch parsed := parser.Parse(tokenizer.Tokenize(string(source), path)).(type) {
+	case ast.Module:
+		mod = parsed
+	case ast.Block:
+		mod = ast.Module{Block: parsed, Location: parsed.Location}
+	}
+	if block, ok := mod.Block.(ast.Block); !ok || len(block.Expressions) > 0 || block.Result != nil {
+		panic(fmt.Sprintf("Imported file %s can only declare functions, structs, enums and externs, found code at %v",
+			path, mod.Block.GetLocation()))
+	}
+	return l.load(mod, path, name+".")
+}
+
+func absolute(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
+// merge puts the functions of all files into the module of the main file
+func (l *loader) merge(main *file) ast.Module {
+	merged := main.module
+	merged.Functions, merged.Externs, merged.Structs, merged.Enums, merged.Imports = nil, nil, nil, nil, nil
+	structs := map[string]string{}
+	enums := map[string]string{}
+	externs := map[string]bool{}
+	shared := map[string]bool{}
+	for _, name := range builtins {
+		shared[name] = true
+	}
+	for _, f := range l.order {
+		f.shared = shared
+		for _, st := range f.module.Structs {
+			sd := st.(ast.StructDefinition)
+			name := sd.Name.(ast.Identifier).Name
+			if other, ok := structs[name]; ok {
+				panic(fmt.Sprintf("Struct %s is declared in both %s and %s at %v", name, other, f.path, sd.Location))
+			}
+			structs[name] = f.path
+			merged.Structs = append(merged.Structs, st)
+		}
+		for _, en := range f.module.Enums {
+			ed := en.(ast.EnumDefinition)
+			name := ed.Name.(ast.Identifier).Name
+			if other, ok := enums[name]; ok {
+				panic(fmt.Sprintf("Enum %s is declared in both %s and %s at %v", name, other, f.path, ed.Location))
+			}
+			enums[name] = f.path
+			shared[name] = true
+			merged.Enums = append(merged.Enums, en)
+		}
+		// The same C function can be declared by several files
+		for _, ext := range f.module.Externs {
+			name := ext.(ast.ExternFunction).Name.(ast.Identifier).Name
+			if !externs[name] {
+				externs[name] = true
+				shared[name] = true
+				merged.Externs = append(merged.Externs, ext)
+			}
+		}
+	}
+	for _, f := range l.order {
+		for _, fn := range f.module.Functions {
+			merged.Functions = append(merged.Functions, f.resolveFunction(fn.(ast.FunctionDefinition)))
+		}
+	}
+	merged.Block = main.resolve(main.module.Block, map[string]bool{})
+	return merged
+}
+
+func (f *file) resolveFunction(fd ast.FunctionDefinition) ast.FunctionDefinition {
+	name := fd.Name.(ast.Identifier)
+	name.Name = f.prefix + name.Name
+	fd.Name = name
+	fd.Body = f.resolve(fd.Body, f.bind(map[string]bool{}, fd.Params))
+	return fd
+}
+
+// resolve renames the references to functions in expr: calls to the
+// functions of the file get its prefix and m.f becomes the public function f
+// of the imported module m. locals holds the variables that hide functions of
+// the file. An imported file cannot use names of the main file, such as its
+// globals.
+func (f *file) resolve(expr ast.Expression, locals map[string]bool) ast.Expression {
+	if expr == nil {
+		return nil
+	}
+	switch e := expr.(type) {
+	case ast.Identifier:
+		if locals[e.Name] {
+			return e
+		}
+		if _, ok := f.functions[e.Name]; ok {
+			e.Name = f.prefix + e.Name
+		} else if f.prefix != "" && !f.shared[e.Name] {
+			panic(fmt.Sprintf("Undefined name %s in %s at %v", e.Name, f.path, e.Location))
+		}
+		return e
+	case ast.FieldAccess:
+		if object, ok := e.Object.(ast.Identifier); ok {
+			if imported, ok := f.imports[object.Name]; ok {
+				return imported.export(e.Field.(ast.Identifier))
+			}
+		}
+		e.Object = f.resolve(e.Object, locals)
+		return e
+	case ast.Block:
+		scope := f.bind(locals, nil)
+		expressions := make([]ast.Expression, len(e.Expressions))
+		for i, x := range e.Expressions {
+			expressions[i] = f.resolve(x, scope)
+		}
+		e.Expressions = expressions
+		e.Result = f.resolve(e.Result, scope)
+		return e
+	case ast.Declaration:
+		e.Value = f.resolve(e.Value, locals)
+		f.declare(e.Variable.(ast.Identifier), locals)
+		return e
+	case ast.Lambda:
+		e.Body = f.resolve(e.Body, f.bind(locals, e.Params))
+		return e
+	case ast.ForLoop:
+		scope := f.bind(locals, nil)
+		e.Init = f.resolve(e.Init, scope)
+		e.Condition = f.resolve(e.Condition, scope)
+		e.Step = f.resolve(e.Step, scope)
+		e.Body = f.resolve(e.Body, scope)
+		return e
+	case ast.Destructuring:
+		e.Value = f.resolve(e.Value, locals)
+		for _, variable := range e.Variables {
+			f.declare(variable.(ast.Identifier), locals)
+		}
+		return e
+	case ast.MatchArm:
+		// The variant is not a reference, the bindings are variables
+		scope := f.bind(locals, nil)
+		for _, binding := range e.Bindings {
+			f.declare(binding.(ast.Identifier), scope)
+		}
+		e.Body = f.resolve(e.Body, scope)
+		return e
+	case ast.NewExpression:
+		e.Value = f.resolve(e.Value, locals)
+		return e
+	case ast.Cast:
+		e.Value = f.resolve(e.Value, locals)
+		return e
+	case ast.StructLiteral:
+		values := make([]ast.Expression, len(e.Values))
+		for i, v := range e.Values {
+			values[i] = f.resolve(v, locals)
+		}
+		e.Values = values
+		return e
+	}
+	return ast.Map(expr, func(child ast.Expression) ast.Expression {
+		return f.resolve(child, locals)
+	})
+}
+
+// bind returns a new scope inside locals with params declared in it
+func (f *file) bind(locals map[string]bool, params []ast.Expression) map[string]bool {
+	scope := map[string]bool{}
+	for name := range locals {
+		scope[name] = true
+	}
+	for _, param := range params {
+		f.declare(param.(ast.Param).Name.(ast.Identifier), scope)
+	}
+	return scope
+}
+
+// declare adds a variable to scope. A variable cannot take the name of an
+// import, since m.f would then be ambiguous.
+func (f *file) declare(name ast.Identifier, scope map[string]bool) {
+	if _, ok := f.imports[name.Name]; ok {
+		panic(fmt.Sprintf("Variable %s hides the import %s at %v", name.Name, name.Name, name.Location))
+	}
+	scope[name.Name] = true
+}
+
+// export returns a reference to the public function name of the module
+func (f *file) export(name ast.Identifier) ast.Expression {
+	module := strings.TrimSuffix(f.prefix, ".")
+	fd, ok := f.functions[name.Name]
+	if !ok {
+		panic(fmt.Sprintf("Module %s has no function %s at %v", module, name.Name, name.Location))
+	}
+	if !fd.Public {
+		panic(fmt.Sprintf("Function %s of module %s is private at %v", name.Name, module, name.Location))
+	}
+	name.Name = f.prefix + name.Name
+	return name
+}
@@ -0,0 +1,199 @@
+package loader
+
+import (
+	"compiler/ast"
+	"compiler/interpreter"
+	"compiler/typechecker"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// write creates the files under a temporary directory and returns its path
+func write(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, source := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// load loads main.src from dir and returns the panic message, if any
+func load(dir string) (mod ast.Expression, err string) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Sprint(r)
+		}
+	}()
+	path := filepath.Join(dir, "main.src")
+	source, _ := os.ReadFile(path)
+	return Load(string(source), path), ""
+}
+
+func TestLoader_Namespaces(t *testing.T) {
+	dir := write(t, map[string]string{
+		"main.src": `
+			import "lib/math.src";
+			fun square(x: Int): Int { 0 }
+			var f = math.cube;
+			f(2) + math.square(3) + square(4)
+		`,
+		"lib/math.src": `
+			pub fun square(x: Int): Int { x * x }
+			pub fun cube(x: Int): Int {
+				var y = square(x);
+				helper(y, x)
+			}
+			fun helper(square: Int, x: Int): Int { square * x }
+		`,
+	})
+	mod, err := load(dir)
+	if err != "" {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fn := range mod.(ast.Module).Functions {
+		fd := fn.(ast.FunctionDefinition)
+		names = append(names, fmt.Sprintf("%s@%s", fd.Name.(ast.Identifier).Name, filepath.Base(fd.Location.File)))
+	}
+	expected := "[math.square@math.src math.cube@math.src math.helper@math.src square@main.src]"
+	if fmt.Sprintf("%v", names) != expected {
+		t.Errorf("Expected functions %v but got %v", expected, names)
+	}
+	typechecker.Type(mod)
+	if res := interpreter.Interpret(mod); fmt.Sprintf("%v", res) != "17" {
+		t.Errorf("Expected 17 but got %v", res)
+	}
+}
+
+func TestLoader_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{
+			"Cycle",
+			map[string]string{
+				"main.src": `import "a.src"; 1`,
+				"a.src":    `import "b.src"; pub fun a(): Int { 1 }`,
+				"b.src":    `import "a.src"; pub fun b(): Int { 1 }`,
+			},
+			"Import cycle",
+		},
+		{
+			"Private function",
+			map[string]string{
+				"main.src": `import "a.src"; a.hidden()`,
+				"a.src":    `fun hidden(): Int { 1 }`,
+			},
+			"Function hidden of module a is private",
+		},
+		{
+			"Missing function",
+			map[string]string{
+				"main.src": `import "a.src"; a.missing()`,
+				"a.src":    `pub fun a(): Int { 1 }`,
+			},
+			"Module a has no function missing",
+		},
+		{
+			"Code in an imported file",
+			map[string]string{
+				"main.src": `import "a.src"; 1`,
+				"a.src":    `print_int(1);`,
+			},
+			"can only declare functions",
+		},
+		{
+			"Same module name",
+			map[string]string{
+				"main.src":  `import "a.src"; import "lib/a.src"; 1`,
+				"a.src":     `pub fun a(): Int { 1 }`,
+				"lib/a.src": `pub fun a(): Int { 2 }`,
+			},
+			"have the same module name a",
+		},
+		{
+			"Same enum",
+			map[string]string{
+				"main.src": `import "a.src"; enum E { X } 1`,
+				"a.src":    `enum E { Y }`,
+			},
+			"Enum E is declared in both",
+		},
+		{
+			"Name of the main file in an import",
+			map[string]string{
+				"main.src": `import "a.src"; fun helper(): Int { 1 } var secret = 2; a.f()`,
+				"a.src":    `pub fun f(): Int { helper() + secret }`,
+			},
+			"Undefined name helper in",
+		},
+		{
+			"Global of the main file in an import",
+			map[string]string{
+				"main.src": `import "a.src"; var secret = 2; a.f()`,
+				"a.src":    `pub fun f(): Int { secret }`,
+			},
+			"Undefined name secret in",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(write(t, tt.files))
+			if !strings.Contains(err, tt.expected) {
+				t.Errorf("Expected error containing %q, got %q", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestLoader_Diamond(t *testing.T) {
+	dir := write(t, map[string]string{
+		"main.src":  `import "left.src"; import "right.src"; left.f() + right.f()`,
+		"left.src":  `import "base.src"; pub fun f(): Int { base.one() }`,
+		"right.src": `import "base.src"; pub fun f(): Int { base.one() + 1 }`,
+		"base.src":  `pub fun one(): Int { 1 }`,
+	})
+	mod, err := load(dir)
+	if err != "" {
+		t.Fatal(err)
+	}
+	if n := len(mod.(ast.Module).Functions); n != 3 {
+		t.Errorf("Expected base to be loaded once, got %d functions", n)
+	}
+	if res := interpreter.Interpret(mod); fmt.Sprintf("%v", res) != "3" {
+		t.Errorf("Expected 3 but got %v", res)
+	}
+}
+
+func TestLoader_Enums(t *testing.T) {
+	dir := write(t, map[string]string{
+		"main.src": `import "shapes.src"; shapes.area(Shape.Rect(2, 3))`,
+		"shapes.src": `
+			enum Shape { Circle(Int), Rect(Int, Int) }
+			fun Rect(): Int { 100 }
+			pub fun area(s: Shape): Int {
+				match s { Circle(r) => 3 * r * r, Rect(w, h) => w * h }
+			}
+		`,
+	})
+	mod, err := load(dir)
+	if err != "" {
+		t.Fatal(err)
+	}
+	typechecker.Type(mod)
+	// The arm for the variant Rect does not call the function Rect
+	if res := interpreter.Interpret(mod); fmt.Sprintf("%v", res) != "6" {
+		t.Errorf("Expected 6 but got %v", res)
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"compiler/asmgenerator"
 	"compiler/assembler"
+	"compiler/ast"
 	"compiler/interpreter"
 	"compiler/irgenerator"
+	"compiler/llvmgenerator"
+	"compiler/loader"
 	"compiler/parser"
 	"compiler/tokenizer"
 	"compiler/typechecker"
@@ -20,26 +23,101 @@ import (
 	"time"
 )
 
-func callCompiler(sourceCode string, file string) (output []byte) {
+type compileOptions struct {
+	// emit is the kind of output: exe, asm, obj, shared or llvm
+	emit           string
+	checkOverflow  bool
+	exitWithResult bool
+	gc             bool
+	// imports resolves import declarations by reading the imported files; the
+	// server leaves it off so requests cannot read its files
+	imports   bool
+	toolchain assembler.Options
+}
+
+// parse parses a program and, when allowed, the files it imports
+func parse(sourceCode string, file string, opts compileOptions) ast.Expression {
+	if opts.imports {
+		return loader.Load(sourceCode, file)
+	}
+	return parser.Parse(tokenizer.Tokenize(sourceCode, file))
+}
+
+func callCompiler(sourceCode string, file string, opts compileOptions) (output []byte) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("Recovered from panic:", r)
 			output = []byte(fmt.Sprintf("compiler error: %s", r))
 		}
 	}()
-	tokens := tokenizer.Tokenize(sourceCode, file)
-	res := parser.Parse(tokens)
-	typechecker.Type(res)
-	funcMap := irgenerator.Generate(res)
-	asm := asmgenerator.GenerateASM(funcMap)
-	output, _ = assembler.Assemble(asm, "")
+	res := parse(sourceCode, file, opts)
+	res = typechecker.Infer(res)
+	funcMap, _ := irgenerator.GenerateWithTypes(res, irgenerator.Options{
+		ExitWithResult: opts.exitWithResult,
+	})
+	asm := asmgenerator.GenerateASMWithOptions(funcMap, asmgenerator.Options{
+		CheckOverflow: opts.checkOverflow,
+		GC:            opts.gc,
+		PIC:           opts.emit == "shared",
+		Library:       opts.emit == "obj" || opts.emit == "shared",
+	})
+	if opts.emit == "asm" {
+		return []byte(asm)
+	}
+	toolchain := opts.toolchain
+	switch opts.emit {
+	case "obj":
+		toolchain.Output = assembler.Object
+	case "shared":
+		toolchain.Output = assembler.Shared
+	}
+	output, err := assembler.AssembleWithOptions(asm, "", toolchain)
+	if err != nil {
+		panic(err.Error())
+	}
 	return output
 }
 
-func callInterpreter(sourceCode string, file string) string {
-	tokens := tokenizer.Tokenize(sourceCode, file)
-	parsed := parser.Parse(tokens)
-	return fmt.Sprintf("%v", interpreter.Interpret(parsed))
+func callLLVMGenerator(sourceCode string, file string, opts compileOptions) (output []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Recovered from panic:", r)
+			output = []byte(fmt.Sprintf("compiler error: %s", r))
+		}
+	}()
+	res := parse(sourceCode, file, opts)
+	res = typechecker.Infer(res)
+	funcMap, types := irgenerator.GenerateWithTypes(res, irgenerator.Options{
+		ExitWithResult: opts.exitWithResult,
+	})
+	return []byte(llvmgenerator.GenerateLLVMWithOptions(funcMap, types, llvmgenerator.Options{
+		CheckOverflow: opts.checkOverflow,
+	}))
+}
+
+func callInterpreter(sourceCode string, file string, opts compileOptions) (output string) {
+	defer func() {
+		if r := recover(); r != nil {
+			if rtErr, ok := r.(interpreter.RuntimeError); ok {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", rtErr.Error())
+				os.Exit(rtErr.Status)
+			}
+			// Errors in the program are reported like the compiler does
+			fmt.Println("Recovered from panic:", r)
+			output = fmt.Sprintf("compiler error: %s", r)
+		}
+	}()
+	parsed := typechecker.Infer(parse(sourceCode, file, opts))
+	result := interpreter.InterpretWithOptions(parsed, interpreter.Options{
+		CheckOverflow: opts.checkOverflow,
+	})
+	if exit, ok := result.(interpreter.Exit); ok {
+		os.Exit(int(exit.Code))
+	}
+	if code, ok := result.(int64); ok && opts.exitWithResult {
+		os.Exit(int(code))
+	}
+	return fmt.Sprintf("%v", result)
 }
 
 func handleConnection(conn net.Conn) {
@@ -64,7 +142,7 @@ func handleConnection(conn net.Conn) {
 
 	switch cmd {
 	case "compile":
-		executable := callCompiler(code, "")
+		executable := callCompiler(code, "", compileOptions{emit: "exe"})
 		if strings.HasPrefix(string(executable), "compiler error:") || len(executable) == 0 {
 			resp, _ := json.Marshal(map[string]string{"error": string(executable)})
 			conn.Write(resp)
@@ -108,6 +186,7 @@ func main() {
 	var inputFile string
 	var input string
 	var outputFile string
+	var opts compileOptions = compileOptions{emit: "exe", imports: true}
 	var host string = "127.0.0.1"
 	var port int = 3000
 	var err error
@@ -131,6 +210,12 @@ func main() {
 			if len(matches) > 1 {
 				inputFile = matches[1]
 			}
+		} else if matched, _ := regexp.MatchString(`^--emit=(.+)`, arg); matched {
+			re := regexp.MustCompile(`^--emit=(.+)`)
+			matches := re.FindStringSubmatch(arg)
+			if len(matches) > 1 {
+				opts.emit = matches[1]
+			}
 		} else if matched, _ := regexp.MatchString(`^--host=(.+)`, arg); matched {
 			re := regexp.MustCompile(`^--host=(.+)`)
 			matches := re.FindStringSubmatch(arg)
@@ -147,6 +232,57 @@ func main() {
 					return
 				}
 			}
+		} else if matched, _ := regexp.MatchString(`^--link=(.+)`, arg); matched {
+			re := regexp.MustCompile(`^--link=(.+)`)
+			matches := re.FindStringSubmatch(arg)
+			if len(matches) > 1 {
+				opts.toolchain.LinkC = true
+				opts.toolchain.Objects = append(opts.toolchain.Objects, matches[1])
+			}
+		} else if arg == "--link-c" {
+			opts.toolchain.LinkC = true
+		} else if matched, _ := regexp.MatchString(`^--as=(.+)`, arg); matched {
+			re := regexp.MustCompile(`^--as=(.+)`)
+			matches := re.FindStringSubmatch(arg)
+			if len(matches) > 1 {
+				opts.toolchain.AssemblerPath = matches[1]
+			}
+		} else if matched, _ := regexp.MatchString(`^--ld=(.+)`, arg); matched {
+			re := regexp.MustCompile(`^--ld=(.+)`)
+			matches := re.FindStringSubmatch(arg)
+			if len(matches) > 1 {
+				opts.toolchain.LinkerPath = matches[1]
+			}
+		} else if matched, _ := regexp.MatchString(`^--as-flag=(.+)`, arg); matched {
+			re := regexp.MustCompile(`^--as-flag=(.+)`)
+			matches := re.FindStringSubmatch(arg)
+			if len(matches) > 1 {
+				opts.toolchain.AssemblerFlags = append(opts.toolchain.AssemblerFlags, matches[1])
+			}
+		} else if matched, _ := regexp.MatchString(`^--ld-flag=(.+)`, arg); matched {
+			re := regexp.MustCompile(`^--ld-flag=(.+)`)
+			matches := re.FindStringSubmatch(arg)
+			if len(matches) > 1 {
+				opts.toolchain.LinkerFlags = append(opts.toolchain.LinkerFlags, matches[1])
+			}
+		} else if matched, _ := regexp.MatchString(`^--keep-temps=(.+)`, arg); matched {
+			re := regexp.MustCompile(`^--keep-temps=(.+)`)
+			matches := re.FindStringSubmatch(arg)
+			if len(matches) > 1 {
+				opts.toolchain.KeepTemps = matches[1]
+			}
+		} else if matched, _ := regexp.MatchString(`^--target=(.+)`, arg); matched {
+			re := regexp.MustCompile(`^--target=(.+)`)
+			matches := re.FindStringSubmatch(arg)
+			if len(matches) > 1 {
+				opts.toolchain.Target = matches[1]
+			}
+		} else if arg == "--check-overflow" {
+			opts.checkOverflow = true
+		} else if arg == "--exit-with-result" {
+			opts.exitWithResult = true
+		} else if arg == "--gc" {
+			opts.gc = true
 		} else if strings.HasPrefix(arg, "-") {
 			fmt.Printf("Error: Unknown argument: %s\n", arg)
 			return
@@ -155,7 +291,7 @@ func main() {
 		} else if inputFile == "" {
 			inputFile = arg
 		} else {
-			fmt.Println("Error: Multiple input files not supported")
+			fmt.Println("Error: Multiple input files not supported, import the other files from the main one")
 			return
 		}
 	}
@@ -175,13 +311,35 @@ func main() {
 	}
 
 	if command == "compile" {
-		asm := callCompiler(input, inputFile)
-		os.WriteFile(outputFile, []byte(asm), 0644)
+		switch opts.emit {
+		case "exe", "shared":
+			output := callCompiler(input, inputFile, opts)
+			os.WriteFile(outputFile, output, 0755)
+		case "obj":
+			output := callCompiler(input, inputFile, opts)
+			os.WriteFile(outputFile, output, 0644)
+		case "asm":
+			asm := callCompiler(input, inputFile, opts)
+			if outputFile == "" {
+				os.Stdout.Write(asm)
+			} else {
+				os.WriteFile(outputFile, asm, 0644)
+			}
+		case "llvm":
+			ll := callLLVMGenerator(input, inputFile, opts)
+			if outputFile == "" {
+				os.Stdout.Write(ll)
+			} else {
+				os.WriteFile(outputFile, ll, 0644)
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "Error: Unknown emit kind: %s\n", opts.emit)
+		}
 	} else if command == "serve" {
 		runServer(host, port)
 	} else if command == "interpret" {
 		start := time.Now()
-		result := callInterpreter(input, inputFile)
+		result := callInterpreter(input, inputFile, opts)
 		end := time.Since(start)
 		fmt.Println(result, "Time taken", end)
 	} else {
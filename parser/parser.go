@@ -3,13 +3,20 @@ package parser
 import (
 	"compiler/ast"
 	"compiler/tokenizer"
+	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 type Parser struct {
 	tokens []tokenizer.Token
 	pos    int
+	// labels are the names of the loops around the current position in the
+	// function being parsed
+	labels []string
 }
 
 var precedenceLevels = [][]string{
@@ -37,6 +44,17 @@ var allowedIdentifiers = []string{
 	"continue",
 	"fun",
 	"return",
+	"extern",
+	"new",
+	"delete",
+	"struct",
+	"import",
+	"pub",
+	"for",
+	"in",
+	"enum",
+	"match",
+	"as",
 }
 
 func contains(slice []string, item string) bool {
@@ -94,16 +112,65 @@ func (p *Parser) parseIntLiteral() ast.Literal {
 		panic("Not int literal")
 	}
 	consumedToken := p.consume(nil)
-	value, err := strconv.ParseUint(consumedToken.Text, 10, 64)
-	if err != nil {
-		panic(err)
-	}
 	return ast.Literal{
 		Location: consumedToken.Location,
-		Value:    value,
+		Value:    intLiteralValue(consumedToken),
 	}
 }
 
+// digitGroups are the digits of an integer literal, which _ can separate
+var digitGroups = regexp.MustCompile(`^[0-9a-zA-Z]+(_[0-9a-zA-Z]+)*$`)
+
+// intLiteralValue is the value of a decimal, 0x hexadecimal, 0b binary or 0o
+// octal integer literal, or of a character literal 'a', which stands for the
+// code point of its character
+func intLiteralValue(token tokenizer.Token) uint64 {
+	text := token.Text
+	if text[0] == '\'' {
+		return charLiteralValue(token)
+	}
+	base, digits := 10, text
+	if len(text) > 1 && text[0] == '0' {
+		switch text[1] {
+		case 'x', 'X':
+			base, digits = 16, text[2:]
+		case 'b', 'B':
+			base, digits = 2, text[2:]
+		case 'o', 'O':
+			base, digits = 8, text[2:]
+		}
+	}
+	if !digitGroups.MatchString(digits) {
+		panic(fmt.Sprintf("Invalid integer literal %s at %s", text, token.Location.Position()))
+	}
+	value, err := strconv.ParseUint(strings.ReplaceAll(digits, "_", ""), base, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		panic(fmt.Sprintf("The literal %s at %s does not fit 64 bits", text, token.Location.Position()))
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Invalid integer literal %s at %s", text, token.Location.Position()))
+	}
+	return value
+}
+
+// charLiteralValue is the code point of the one character, or escape
+// sequence, between the quotes of a character literal
+func charLiteralValue(token tokenizer.Token) uint64 {
+	quoted := token.Text[1 : len(token.Text)-1]
+	if len(quoted) == 2 && quoted[0] == '\\' {
+		escaped, ok := stringEscapes[quoted[1]]
+		if !ok {
+			panic(fmt.Sprintf("Unknown escape sequence %s at %s", quoted, token.Location.Position()))
+		}
+		return uint64(escaped)
+	}
+	char, size := utf8.DecodeRuneInString(quoted)
+	if quoted == "" || size != len(quoted) || char == utf8.RuneError {
+		panic(fmt.Sprintf("A character literal must hold one character, got %s at %s", token.Text, token.Location.Position()))
+	}
+	return uint64(char)
+}
+
 func (p *Parser) parseIdentifier() ast.Identifier {
 	token := p.peek()
 	if token.Type != "Identifier" {
@@ -123,6 +190,23 @@ func (p *Parser) parseParenthesised() ast.Expression {
 	return expr
 }
 
+// parseParenthesisedOrTuple parses (e) and the tuple literal (a, b, ...)
+func (p *Parser) parseParenthesisedOrTuple() ast.Expression {
+	loc := p.consume("(").Location
+	first := p.parseExpression()
+	if p.peek().Text != "," {
+		p.consume(")")
+		return first
+	}
+	elements := []ast.Expression{first}
+	for p.peek().Text == "," {
+		p.consume(",")
+		elements = append(elements, p.parseExpression())
+	}
+	p.consume(")")
+	return ast.TupleLiteral{Elements: elements, Location: loc}
+}
+
 func (p *Parser) parseIfExpression() ast.Expression {
 	loc := p.peek().Location
 	p.consume("if")
@@ -142,6 +226,40 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	}
 }
 
+// stringEscapes are the characters a backslash escape in a string or a
+// character literal stands for
+var stringEscapes = map[byte]byte{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'0':  0,
+	'"':  '"',
+	'\'': '\'',
+	'\\': '\\',
+}
+
+func (p *Parser) parseStringLiteral() ast.StringLiteral {
+	token := p.consume(nil)
+	quoted := token.Text[1 : len(token.Text)-1]
+	var value strings.Builder
+	for i := 0; i < len(quoted); i++ {
+		if quoted[i] != '\\' {
+			value.WriteByte(quoted[i])
+			continue
+		}
+		i++
+		escaped, ok := stringEscapes[quoted[i]]
+		if !ok {
+			panic(fmt.Sprintf("Unknown escape sequence \\%c at %v", quoted[i], token.Location))
+		}
+		value.WriteByte(escaped)
+	}
+	return ast.StringLiteral{
+		Value:    value.String(),
+		Location: token.Location,
+	}
+}
+
 func (p *Parser) parseBooleanLiteral() ast.BooleanLiteral {
 	token := p.consume(nil)
 	return ast.BooleanLiteral{
@@ -153,7 +271,7 @@ func (p *Parser) parseBooleanLiteral() ast.BooleanLiteral {
 func (p *Parser) parseUnary() ast.Expression {
 	var operator string
 	var factor ast.Expression
-	if p.peek().Text == "not" || p.peek().Text == "-" {
+	if contains([]string{"not", "-", "*", "&"}, p.peek().Text) {
 		operator = p.peek().Text
 		p.consume(nil)
 		factor = p.parseUnary()
@@ -170,23 +288,145 @@ func (p *Parser) parseUnary() ast.Expression {
 	return factor
 }
 
-func (p *Parser) parseWhileLoop() ast.Expression {
+// parseCast parses a unary expression followed by any number of as Type
+// casts, so -x as UInt8 casts -x. Only integer types can be cast to, so the
+// type is a name and x as Int * 2 multiplies.
+func (p *Parser) parseCast() ast.Expression {
+	value := p.parseUnary()
+	for p.peek().Text == "as" {
+		loc := p.consume("as").Location
+		value = ast.Cast{
+			Value:    value,
+			Type:     p.parseIdentifier(),
+			Location: loc,
+		}
+	}
+	return value
+}
+
+func (p *Parser) parseWhileLoop(label string) ast.Expression {
 	loc := p.peek().Location
 	p.consume("while")
 	condition := p.parseExpression()
 	p.consume("do")
-	looping := p.parseExpression()
+	looping := p.parseLoopBody(label)
 	return ast.WhileLoop{
 		Location:  loc,
 		Condition: condition,
 		Looping:   looping,
+		Label:     label,
+	}
+}
+
+// parseLoopBody parses the body of a loop, where break and continue can name
+// the loop's label
+func (p *Parser) parseLoopBody(label string) ast.Expression {
+	p.labels = append(p.labels, label)
+	body := p.parseExpression()
+	p.labels = p.labels[:len(p.labels)-1]
+	return body
+}
+
+// parseLabeledLoop parses outer: while ... and outer: for ...
+func (p *Parser) parseLabeledLoop() ast.Expression {
+	label := p.consume(nil).Text
+	p.consume(":")
+	if contains(p.labels, label) {
+		panic(fmt.Sprintf("Label %s is already used by an outer loop at %v", label, p.peekOffset(-2).Location))
+	}
+	if p.peek().Text == "while" {
+		return p.parseWhileLoop(label)
+	}
+	return p.parseForLoop(label)
+}
+
+// parseLoopJump parses break and continue. A name after them is a label when
+// a surrounding loop has it; anything else before the end of the expression
+// is the value of a break.
+func (p *Parser) parseLoopJump() ast.Expression {
+	token := p.consume(nil)
+	label := ""
+	if p.peek().Type == "Identifier" && contains(p.labels, p.peek().Text) {
+		label = p.consume(nil).Text
+	}
+	if token.Text == "continue" {
+		return ast.ContinueExpression{Location: token.Location, Label: label}
+	}
+	var value ast.Expression
+	if !contains([]string{";", "}", ")", ",", "]", "then", "else", "do", ""}, p.peek().Text) {
+		value = p.parseExpression()
+	}
+	return ast.BreakExpression{Location: token.Location, Label: label, Value: value}
+}
+
+// parseForLoop parses for (init; cond; step) body, where do before the body
+// is optional, and for i in start..end do body. The range is desugared into
+// a ForLoop counting from start up to but not including end, which is
+// evaluated once into a hidden variable.
+func (p *Parser) parseForLoop(label string) ast.Expression {
+	loc := p.consume("for").Location
+	if p.peek().Text == "(" {
+		p.consume("(")
+		var init, condition, step ast.Expression
+		if p.peek().Text != ";" {
+			init = p.parseTopExpression()
+		}
+		p.consume(";")
+		if p.peek().Text != ";" {
+			condition = p.parseExpression()
+		}
+		p.consume(";")
+		if p.peek().Text != ")" {
+			step = p.parseExpression()
+		}
+		p.consume(")")
+		if p.peek().Text == "do" {
+			p.consume("do")
+		}
+		return ast.ForLoop{
+			Init:      init,
+			Condition: condition,
+			Step:      step,
+			Body:      p.parseLoopBody(label),
+			Location:  loc,
+			Label:     label,
+		}
+	}
+
+	variable := p.parseIdentifier()
+	p.consume("in")
+	start := p.parseExpression()
+	p.consume("..")
+	end := p.parseExpression()
+	p.consume("do")
+	body := p.parseLoopBody(label)
+	endVariable := ast.Identifier{Name: "for.end", Location: end.GetLocation()}
+	one := ast.Literal{Value: uint64(1), Location: loc}
+	return ast.Block{
+		Expressions: []ast.Expression{
+			ast.Declaration{Variable: endVariable, Value: end, Location: end.GetLocation(), Kind: "val"},
+		},
+		Result: ast.ForLoop{
+			Init:      ast.Declaration{Variable: variable, Value: start, Location: variable.GetLocation(), Kind: "var"},
+			Condition: ast.BinaryOp{Left: variable, Op: "<", Right: endVariable, Location: loc},
+			Step: ast.BinaryOp{
+				Left:     variable,
+				Op:       "=",
+				Right:    ast.BinaryOp{Left: variable, Op: "+", Right: one, Location: loc},
+				Location: loc,
+			},
+			Body:     body,
+			Location: loc,
+			Label:    label,
+		},
+		Location: loc,
 	}
 }
 
 func (p *Parser) parseTermPrecedence(precedence int) ast.Expression {
 	var left ast.Expression
 	if precedence == len(precedenceLevels)-1 {
-		left = p.parseUnary()
+		left = p.parseCast()
 	} else {
 		left = p.parseTermPrecedence(precedence + 1)
 	}
@@ -195,7 +435,7 @@ func (p *Parser) parseTermPrecedence(precedence int) ast.Expression {
 		operator := operatorToken.Text
 		var right ast.Expression
 		if precedence == len(precedenceLevels)-1 {
-			right = p.parseUnary()
+			right = p.parseCast()
 		} else {
 			right = p.parseTermPrecedence(precedence + 1)
 		}
@@ -212,13 +452,19 @@ func (p *Parser) parseTermPrecedence(precedence int) ast.Expression {
 func (p *Parser) parseFactor() ast.Expression {
 	token := p.peek()
 	var res ast.Expression
+	// Only names and parenthesised expressions can be indexed, so that a
+	// block followed by an array literal is not read as indexing
+	indexable := false
 	if token.Type == "Punctuation" {
-		if token.Text == "{" {
+		if token.Text == "[" {
+			res = p.parseArrayLiteral()
+		} else if token.Text == "{" {
 			p.consume("{")
 			res = p.parseBlock()
 			p.consume("}")
 		} else if token.Text == "(" {
-			res = p.parseParenthesised()
+			res = p.parseParenthesisedOrTuple()
+			indexable = true
 		} else {
 			panic(fmt.Sprintf(
 				"Unexpected token %v, expexted left brace at location %v",
@@ -229,17 +475,30 @@ func (p *Parser) parseFactor() ast.Expression {
 	} else if token.Text == "true" || token.Text == "false" {
 		res = p.parseBooleanLiteral()
 	} else if token.Text == "while" {
-		res = p.parseWhileLoop()
-	} else if token.Text == "break" {
-		loc := p.consume(nil).Location
-		res = ast.BreakExpression{Location: loc}
-	} else if token.Text == "continue" {
-		loc := p.consume(nil).Location
-		res = ast.ContinueExpression{Location: loc}
+		res = p.parseWhileLoop("")
+	} else if token.Text == "for" {
+		res = p.parseForLoop("")
+	} else if token.Type == "Identifier" && p.peekOffset(1).Text == ":" &&
+		(p.peekOffset(2).Text == "while" || p.peekOffset(2).Text == "for") {
+		res = p.parseLabeledLoop()
+	} else if token.Text == "break" || token.Text == "continue" {
+		res = p.parseLoopJump()
+	} else if token.Text == "match" {
+		res = p.parseMatchExpression()
 	} else if token.Text == "return" {
 		res = p.parseReturnExpression()
+	} else if token.Text == "new" {
+		res = p.parseNewExpression()
+	} else if token.Text == "delete" {
+		loc := p.consume("delete").Location
+		res = ast.DeleteExpression{Value: p.parseUnary(), Location: loc}
 	} else if token.Text == "fun" {
-		return res
+		if !p.atLambda() {
+			return res
+		}
+		res = p.parseLambda()
+	} else if token.Type == "StringLiteral" {
+		res = p.parseStringLiteral()
 	} else if token.Type == "IntLiteral" {
 		res = p.parseIntLiteral()
 		if p.peek().Type == "IntLiteral" {
@@ -248,20 +507,127 @@ func (p *Parser) parseFactor() ast.Expression {
 				p.peekOffset(-1).Text, p.peek().Text))
 		}
 	} else if token.Type == "Identifier" {
+		// break outer value has a label before the value
 		if p.peekOffset(-1).Type == "Identifier" &&
-			!contains(allowedIdentifiers, p.peekOffset(-1).Text) {
+			!contains(allowedIdentifiers, p.peekOffset(-1).Text) && p.peekOffset(-2).Text != "break" {
 			panic("Not allowed Identifier: " + p.peekOffset(-1).Text)
 		}
 		res = p.parseIdentifier()
+		if p.peek().Text == "{" && p.peekOffset(1).Type == "Identifier" && p.peekOffset(2).Text == ":" {
+			res = p.parseStructLiteral(res)
+		}
+		indexable = true
 	} else if token.Type == "" {
 		panic("Invalid end of code")
 	}
-	if p.peek().Text == "(" {
+	// A parenthesised expression after a block or a loop starts a new
+	// expression, such as the tuple a block ends with; only lambdas end in a
+	// brace and can be called right away
+	if _, isLambda := res.(ast.Lambda); p.peek().Text == "(" && (p.peekOffset(-1).Text != "}" || isLambda) {
 		res = p.parseFunctionCall(res)
 	}
+	for indexable && (p.peek().Text == "[" || p.peek().Text == "." || p.peek().Text == "(") {
+		if p.peek().Text == "(" {
+			res = p.parseFunctionCall(res)
+			continue
+		}
+		if p.peek().Text == "." {
+			loc := p.consume(".").Location
+			if p.peek().Type == "IntLiteral" {
+				index, err := strconv.Atoi(p.peek().Text)
+				if err != nil {
+					panic(fmt.Sprintf("Tuple index %s out of range at %v", p.peek().Text, p.peek().Location))
+				}
+				p.consume(nil)
+				res = ast.TupleElement{Tuple: res, Index: index, Location: loc}
+				continue
+			}
+			res = ast.FieldAccess{Object: res, Field: p.parseIdentifier(), Location: loc}
+			continue
+		}
+		loc := p.consume("[").Location
+		index := p.parseExpression()
+		p.consume("]")
+		res = ast.IndexExpression{Array: res, Index: index, Location: loc}
+	}
 	return res
 }
 
+func (p *Parser) parseStructLiteral(name ast.Expression) ast.Expression {
+	p.consume("{")
+	var fields, values []ast.Expression
+	for p.peek().Text != "}" {
+		fields = append(fields, p.parseIdentifier())
+		p.consume(":")
+		values = append(values, p.parseExpression())
+		if p.peek().Text != "," {
+			break
+		}
+		p.consume(",")
+	}
+	p.consume("}")
+	return ast.StructLiteral{Name: name, Fields: fields, Values: values, Location: name.GetLocation()}
+}
+
+// parseMatchExpression parses match value { arm, ... }. The comma after an
+// arm whose body is a block can be left out.
+func (p *Parser) parseMatchExpression() ast.Expression {
+	loc := p.consume("match").Location
+	value := p.parseExpression()
+	p.consume("{")
+	var arms []ast.Expression
+	for p.peek().Text != "}" {
+		arms = append(arms, p.parseMatchArm())
+		if p.peek().Text == "," {
+			p.consume(",")
+		} else if p.peek().Text != "}" && p.peekOffset(-1).Text != "}" {
+			panic(fmt.Sprintf("Expected , or } after a match arm at %v, got: %s", p.peek().Location, p.peek().Text))
+		}
+	}
+	p.consume("}")
+	return ast.MatchExpression{Value: value, Arms: arms, Location: loc}
+}
+
+// parseMatchArm parses Variant => body, Variant(a, b) => body and _ => body
+func (p *Parser) parseMatchArm() ast.Expression {
+	loc := p.peek().Location
+	variant := p.parseIdentifier()
+	var bindings []ast.Expression
+	if p.peek().Text == "(" {
+		p.consume("(")
+		for p.peek().Text != ")" {
+			bindings = append(bindings, p.parseIdentifier())
+			if p.peek().Text != "," {
+				break
+			}
+			p.consume(",")
+		}
+		p.consume(")")
+	}
+	p.consume("=")
+	p.consume(">")
+	return ast.MatchArm{
+		Variant:  variant,
+		Bindings: bindings,
+		Body:     p.parseExpression(),
+		Location: loc,
+	}
+}
+
+func (p *Parser) parseArrayLiteral() ast.Expression {
+	loc := p.consume("[").Location
+	var elements []ast.Expression
+	for p.peek().Text != "]" {
+		elements = append(elements, p.parseExpression())
+		if p.peek().Text != "," {
+			break
+		}
+		p.consume(",")
+	}
+	p.consume("]")
+	return ast.ArrayLiteral{Elements: elements, Location: loc}
+}
+
 func (p *Parser) parseFunctionCall(callee ast.Expression) ast.Expression {
 	var args []ast.Expression
 	loc := p.peek().Location
@@ -309,66 +675,140 @@ func (p *Parser) parseExpression() ast.Expression {
 		}
 	}
 	if !contains(allowedIdentifiers, p.peekOffset(-1).Text) &&
-		p.peekOffset(-1).Type == "Identifier" && p.peek().Type == "Identifier" {
+		p.peekOffset(-1).Type == "Identifier" && p.peek().Type == "Identifier" &&
+		!contains(allowedIdentifiers, p.peek().Text) {
 		panic("Not allowed expression: " + p.peekOffset(-1).Text)
 	}
 	return left
 }
 
 func (p *Parser) parseTopExpression() ast.Expression {
-	if p.peek().Text == "var" {
-		p.consume("var")
-		decl := p.parseIdentifier()
-		var typed ast.Expression
-		if p.peek().Text == ":" {
-			p.consume(":")
-			typed = p.parseTypeAnnotation()
-		}
+	kind := p.peek().Text
+	if kind != "var" && kind != "val" && kind != "const" {
+		return p.parseExpression()
+	}
+	if kind != "const" && p.peekOffset(1).Text == "(" {
+		return p.parseDestructuring()
+	}
+	p.consume(kind)
+	decl := p.parseIdentifier()
+	var typed ast.Expression
+	if p.peek().Text == ":" {
+		p.consume(":")
+		typed = p.parseType()
+	}
 
-		p.consume("=")
-		declVal := p.parseExpression()
-		return ast.Declaration{
-			Location: decl.GetLocation(),
-			Variable: decl,
-			Value:    declVal,
-			Typed:    typed,
+	p.consume("=")
+	declVal := p.parseExpression()
+	return ast.Declaration{
+		Location: decl.GetLocation(),
+		Variable: decl,
+		Value:    declVal,
+		Typed:    typed,
+		Kind:     kind,
+	}
+}
+
+// parseDestructuring parses var (a, b, ...) = value, or the same with val
+func (p *Parser) parseDestructuring() ast.Expression {
+	kind := p.peek().Text
+	loc := p.consume(kind).Location
+	p.consume("(")
+	var variables []ast.Expression
+	for p.peek().Text != ")" {
+		variables = append(variables, p.parseIdentifier())
+		if p.peek().Text != "," {
+			break
 		}
+		p.consume(",")
+	}
+	p.consume(")")
+	p.consume("=")
+	return ast.Destructuring{
+		Variables: variables,
+		Value:     p.parseExpression(),
+		Location:  loc,
+		Kind:      kind,
+	}
+}
+
+func (p *Parser) parseNewExpression() ast.Expression {
+	loc := p.consume("new").Location
+	typed := p.parseType()
+	value := p.parseParenthesised()
+	return ast.NewExpression{
+		Type:     typed,
+		Value:    value,
+		Location: loc,
 	}
-	return p.parseExpression()
 }
 
-func (p *Parser) parseTypeAnnotation() ast.Expression {
+// parseType parses a type name, Array[T], a function type (A, B) => R or a
+// tuple type (A, B), followed by any number of * for pointers
+func (p *Parser) parseType() ast.Expression {
+	var typed ast.Expression
 	if p.peek().Text == "(" {
-		loc := p.peek().Location
-		p.consume("(")
-		var params []ast.Expression
-		for p.peek().Text != ")" {
-			params = append(params, p.parseIdentifier())
-			if p.peek().Text != "," {
-				break
-			}
-			p.consume(",")
+		typed = p.parseFunOrTupleType()
+	} else {
+		typed = p.parseIdentifier()
+		if typed.(ast.Identifier).Name == "Array" {
+			loc := p.consume("[").Location
+			typed = ast.ArrayType{Elem: p.parseType(), Location: loc}
+			p.consume("]")
 		}
-		p.consume(")")
-		p.consume("=")
-		p.consume(">")
-		resType := p.parseIdentifier()
-		return ast.FunType{
-			Params:   params,
-			ResType:  resType,
-			Location: loc,
+	}
+	for p.peek().Text == "*" {
+		loc := p.consume("*").Location
+		typed = ast.PointerType{Elem: typed, Location: loc}
+	}
+	return typed
+}
+
+// parseFunOrTupleType parses the types in parentheses, which are the
+// parameters of a function type when => follows and the elements of a tuple
+// type otherwise. (T) is T itself.
+func (p *Parser) parseFunOrTupleType() ast.Expression {
+	loc := p.consume("(").Location
+	var params []ast.Expression
+	for p.peek().Text != ")" {
+		params = append(params, p.parseType())
+		if p.peek().Text != "," {
+			break
+		}
+		p.consume(",")
+	}
+	p.consume(")")
+	if p.peek().Text != "=" || p.peekOffset(1).Text != ">" {
+		switch len(params) {
+		case 0:
+			panic(fmt.Sprintf("Expected => after () at %v", loc))
+		case 1:
+			return params[0]
 		}
+		return ast.TupleType{Elems: params, Location: loc}
+	}
+	p.consume("=")
+	p.consume(">")
+	resType := p.parseType()
+	return ast.FunType{
+		Params:   params,
+		ResType:  resType,
+		Location: loc,
 	}
-	return p.parseIdentifier()
 }
 
-func (p *Parser) parseParams() []ast.Expression {
+// parseParams parses name: Type pairs. With untyped the types can be left
+// out, as the parameters of lambdas can.
+func (p *Parser) parseParams(untyped bool) []ast.Expression {
 	var params []ast.Expression
 	for p.peek().Text != ")" {
 		loc := p.peek().Location
 		name := p.parseIdentifier()
-		p.consume(":")
-		typed := p.parseIdentifier()
+		var typed ast.Expression
+		if !untyped || p.peek().Text == ":" {
+			p.consume(":")
+			typed = p.parseType()
+		}
 		param := ast.Param{
 			Name:     name,
 			Type:     typed,
@@ -408,7 +848,8 @@ func (p *Parser) parseBlock() ast.Expression {
 			expression = nil
 		}
 
-		if p.peek().Text == "}" || p.peek().Type == "end" || p.peek().Text == "fun" {
+		if p.peek().Text == "}" || p.peek().Type == "end" || p.peek().Text == "fun" && !p.atLambda() || p.peek().Text == "extern" ||
+			p.peek().Text == "struct" || p.peek().Text == "enum" {
 			endLoc := p.peek().Location
 			return ast.Block{
 				Location:    endLoc,
@@ -427,11 +868,30 @@ func (p *Parser) parseFunctionDefinition() ast.Expression {
 	loc := p.peek().Location
 	p.consume("fun")
 	name := p.parseIdentifier()
+	var typeParams []ast.Expression
+	if p.peek().Text == "[" {
+		p.consume("[")
+		for p.peek().Text != "]" {
+			typeParams = append(typeParams, p.parseIdentifier())
+			if p.peek().Text != "," {
+				break
+			}
+			p.consume(",")
+		}
+		p.consume("]")
+		if len(typeParams) == 0 {
+			panic(fmt.Sprintf("Expected type parameters between [] at %v", name.Location))
+		}
+	}
 	p.consume("(")
-	params := p.parseParams()
+	params := p.parseParams(false)
 	p.consume(")")
-	p.consume(":")
-	resultType := p.parseIdentifier()
+	// The typechecker infers a result type that is left out
+	var resultType ast.Expression
+	if p.peek().Text == ":" {
+		p.consume(":")
+		resultType = p.parseType()
+	}
 	p.consume("{")
 	body := p.parseBlock()
 	p.consume("}")
@@ -441,18 +901,148 @@ func (p *Parser) parseFunctionDefinition() ast.Expression {
 		ResultType: resultType,
 		Body:       body,
 		Location:   loc,
+		TypeParams: typeParams,
 	}
 }
 
+// atLambda tells a lambda, fun followed by its parameters, from a function
+// definition.
+func (p *Parser) atLambda() bool {
+	return p.peek().Text == "fun" && p.peekOffset(1).Text == "("
+}
+
+func (p *Parser) parseLambda() ast.Expression {
+	loc := p.consume("fun").Location
+	p.consume("(")
+	params := p.parseParams(true)
+	p.consume(")")
+	var resultType ast.Expression
+	if p.peek().Text == ":" {
+		p.consume(":")
+		resultType = p.parseType()
+	}
+	// The loops around the lambda cannot be left from inside it
+	labels := p.labels
+	p.labels = nil
+	p.consume("{")
+	body := p.parseBlock()
+	p.consume("}")
+	p.labels = labels
+	return ast.Lambda{
+		Params:     params,
+		ResultType: resultType,
+		Body:       body,
+		Location:   loc,
+	}
+}
+
+func (p *Parser) parseExternFunction() ast.Expression {
+	loc := p.peek().Location
+	p.consume("extern")
+	p.consume("fun")
+	name := p.parseIdentifier()
+	p.consume("(")
+	params := p.parseParams(false)
+	p.consume(")")
+	p.consume(":")
+	resultType := p.parseType()
+	p.consume(";")
+	return ast.ExternFunction{
+		Name:       name,
+		Params:     params,
+		ResultType: resultType,
+		Location:   loc,
+	}
+}
+
+func (p *Parser) parseStructDefinition() ast.Expression {
+	loc := p.consume("struct").Location
+	name := p.parseIdentifier()
+	p.consume("{")
+	fields := p.parseParams(false)
+	p.consume("}")
+	return ast.StructDefinition{
+		Name:     name,
+		Fields:   fields,
+		Location: loc,
+	}
+}
+
+// parseEnumDefinition parses enum Name { Variant, Variant(Type, ...), ... }
+func (p *Parser) parseEnumDefinition() ast.Expression {
+	loc := p.consume("enum").Location
+	name := p.parseIdentifier()
+	p.consume("{")
+	var variants []ast.Expression
+	for p.peek().Text != "}" {
+		variantLoc := p.peek().Location
+		variantName := p.parseIdentifier()
+		var fields []ast.Expression
+		if p.peek().Text == "(" {
+			p.consume("(")
+			for p.peek().Text != ")" {
+				fields = append(fields, p.parseType())
+				if p.peek().Text != "," {
+					break
+				}
+				p.consume(",")
+			}
+			p.consume(")")
+		}
+		variants = append(variants, ast.EnumVariant{Name: variantName, Fields: fields, Location: variantLoc})
+		if p.peek().Text != "," {
+			break
+		}
+		p.consume(",")
+	}
+	p.consume("}")
+	return ast.EnumDefinition{
+		Name:     name,
+		Variants: variants,
+		Location: loc,
+	}
+}
+
+func (p *Parser) parseImport() ast.Expression {
+	loc := p.consume("import").Location
+	if p.peek().Type != "StringLiteral" {
+		panic(fmt.Sprintf("Expected a file name after import at %v, got: %s", loc, p.peek().Text))
+	}
+	path := p.parseStringLiteral().Value
+	p.consume(";")
+	return ast.Import{Path: path, Location: loc}
+}
+
 func (p *Parser) parseModule() ast.Expression {
 	loc := p.peek().Location
 	var functionDefinitions []ast.Expression
-	for p.peek().Text == "fun" {
-		functionDefinitions = append(functionDefinitions, p.parseFunctionDefinition())
+	var externs []ast.Expression
+	var structs []ast.Expression
+	var imports []ast.Expression
+	var enums []ast.Expression
+	for p.peek().Text == "fun" && !p.atLambda() || p.peek().Text == "extern" || p.peek().Text == "struct" ||
+		p.peek().Text == "import" || p.peek().Text == "pub" || p.peek().Text == "enum" {
+		if p.peek().Text == "extern" {
+			externs = append(externs, p.parseExternFunction())
+		} else if p.peek().Text == "struct" {
+			structs = append(structs, p.parseStructDefinition())
+		} else if p.peek().Text == "enum" {
+			enums = append(enums, p.parseEnumDefinition())
+		} else if p.peek().Text == "import" {
+			imports = append(imports, p.parseImport())
+		} else if p.peek().Text == "pub" {
+			p.consume("pub")
+			fn := p.parseFunctionDefinition().(ast.FunctionDefinition)
+			fn.Public = true
+			functionDefinitions = append(functionDefinitions, fn)
+		} else {
+			functionDefinitions = append(functionDefinitions, p.parseFunctionDefinition())
+		}
 	}
 
 	block := p.parseBlock()
-	if len(functionDefinitions) == 0 {
+	if len(functionDefinitions) == 0 && len(externs) == 0 && len(structs) == 0 && len(imports) == 0 &&
+		len(enums) == 0 {
 		return block
 	}
 
@@ -460,6 +1050,10 @@ func (p *Parser) parseModule() ast.Expression {
 		Functions: functionDefinitions,
 		Block:     block,
 		Location:  loc,
+		Externs:   externs,
+		Structs:   structs,
+		Imports:   imports,
+		Enums:     enums,
 	}
 }
 
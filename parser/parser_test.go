@@ -1,8 +1,10 @@
 package parser
 
 import (
+	"compiler/ast"
 	"compiler/tokenizer"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -92,7 +94,7 @@ func TestParser_Blocks(t *testing.T) {
 func TestParser_While(t *testing.T) {
 	tokens := tokenizer.Tokenize("while true do { x = x + 1; }", "")
 	res := Parse(tokens)
-	expected := "{[] {{true { 1 7}} {[{{x { 1 17}} = {{x { 1 21}} + {1 { 1 25}} { 1 21}} { 1 17}}] <nil> { 1 28}} { 1 1}} { 1 28}}"
+	expected := "{[] {{true { 1 7}} {[{{x { 1 17}} = {{x { 1 21}} + {1 { 1 25}} { 1 21}} { 1 17}}] <nil> { 1 28}} { 1 1} } { 1 28}}"
 	if fmt.Sprintf("%v", res) != fmt.Sprintf("%v", expected) {
 		t.Errorf("Expected %v but got %v", expected, res)
 	}
@@ -137,7 +139,7 @@ func TestParser_Fun1(t *testing.T) {
 	tokens := tokenizer.Tokenize(`fun square(x: Int): Int {
 								return x * x;
 							  }`, "")
-	expected := `{[{{square { 1 5}} [{{x { 1 12}} {Int { 1 15}} { 1 12}}] {Int { 1 21}} {[{{{x { 2 16}} * {x { 2 20}} { 2 16}} { 2 9}}] <nil> { 3 10}} { 1 1}}] {[] <nil> { 3 10}} { 1 1}}`
+	expected := `{[{{square { 1 5}} [{{x { 1 12}} {Int { 1 15}} { 1 12}}] {Int { 1 21}} {[{{{x { 2 16}} * {x { 2 20}} { 2 16}} { 2 9}}] <nil> { 3 10}} { 1 1} false []}] {[] <nil> { 3 10}} { 1 1} [] [] [] []}`
 	result := Parse(tokens)
 	if fmt.Sprintf("%v", result) != expected {
 		t.Errorf("Expected %v but got %v", expected, result)
@@ -161,7 +163,7 @@ func TestParser_Fun2(t *testing.T) {
 
 									print_int_twice(vec_len_squared(3, 4));
 								`, "")
-	expected := `{[{{square { 2 14}} [{{x { 2 21}} {Int { 2 24}} { 2 21}}] {Int { 2 30}} {[{{{x { 3 21}} * {x { 3 25}} { 3 21}} { 3 14}}] <nil> { 4 10}} { 2 10}} {{vec_len_squared { 6 14}} [{{x { 6 30}} {Int { 6 33}} { 6 30}} {{y { 6 38}} {Int { 6 41}} { 6 38}}] {Int { 6 47}} {[{{{{square { 7 21}} [{x { 7 28}}] { 7 27}} + {{square { 7 33}} [{y { 7 40}}] { 7 39}} { 7 27}} { 7 14}}] <nil> { 8 10}} { 6 10}} {{print_int_twice { 10 14}} [{{x { 10 30}} {Int { 10 33}} { 10 30}}] {Unit { 10 39}} {[{{print_int { 11 14}} [{x { 11 24}}] { 11 23}} {{print_int { 12 14}} [{x { 12 24}}] { 12 23}}] <nil> { 13 10}} { 10 10}}] {[{{print_int_twice { 15 10}} [{{vec_len_squared { 15 26}} [{3 { 15 42}} {4 { 15 45}}] { 15 41}}] { 15 25}}] <nil> { 15 48}} { 2 10}}`
+	expected := `{[{{square { 2 14}} [{{x { 2 21}} {Int { 2 24}} { 2 21}}] {Int { 2 30}} {[{{{x { 3 21}} * {x { 3 25}} { 3 21}} { 3 14}}] <nil> { 4 10}} { 2 10} false []} {{vec_len_squared { 6 14}} [{{x { 6 30}} {Int { 6 33}} { 6 30}} {{y { 6 38}} {Int { 6 41}} { 6 38}}] {Int { 6 47}} {[{{{{square { 7 21}} [{x { 7 28}}] { 7 27}} + {{square { 7 33}} [{y { 7 40}}] { 7 39}} { 7 27}} { 7 14}}] <nil> { 8 10}} { 6 10} false []} {{print_int_twice { 10 14}} [{{x { 10 30}} {Int { 10 33}} { 10 30}}] {Unit { 10 39}} {[{{print_int { 11 14}} [{x { 11 24}}] { 11 23}} {{print_int { 12 14}} [{x { 12 24}}] { 12 23}}] <nil> { 13 10}} { 10 10} false []}] {[{{print_int_twice { 15 10}} [{{vec_len_squared { 15 26}} [{3 { 15 42}} {4 { 15 45}}] { 15 41}}] { 15 25}}] <nil> { 15 48}} { 2 10} [] [] [] []}`
 	result := Parse(tokens)
 	if fmt.Sprintf("%v", result) != expected {
 		t.Errorf("Expected %v but got %v", expected, result)
@@ -214,3 +216,395 @@ func TestParser_MutualRecursion(t *testing.T) {
 		t.Errorf("Expected module expression")
 	}
 }
+
+func TestParser_ExternFunction(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		extern fun abs(x: Int): Int;
+		fun f(x: Int): Int { return abs(x); }
+		f(-3)
+	`, "")
+	res := Parse(tokens)
+	mod, ok := res.(ast.Module)
+	if !ok {
+		t.Fatalf("Expected module, got %T", res)
+	}
+	if len(mod.Externs) != 1 || len(mod.Functions) != 1 {
+		t.Errorf("Expected one extern and one function, got %v and %v", mod.Externs, mod.Functions)
+	}
+}
+
+func TestParser_Pointers(t *testing.T) {
+	tokens := tokenizer.Tokenize("var p: Int* = &x; *p = new Int(*p + 1); delete p", "")
+	res := Parse(tokens).(ast.Block)
+	decl := res.Expressions[0].(ast.Declaration)
+	if _, ok := decl.Typed.(ast.PointerType); !ok {
+		t.Errorf("Expected pointer type, got %v", decl.Typed)
+	}
+	if unary, ok := decl.Value.(ast.Unary); !ok || unary.Op != "&" {
+		t.Errorf("Expected address-of, got %v", decl.Value)
+	}
+	assign := res.Expressions[1].(ast.BinaryOp)
+	if unary, ok := assign.Left.(ast.Unary); !ok || unary.Op != "*" {
+		t.Errorf("Expected assignment through pointer, got %v", assign.Left)
+	}
+	if _, ok := assign.Right.(ast.NewExpression); !ok {
+		t.Errorf("Expected new expression, got %v", assign.Right)
+	}
+	if _, ok := res.Result.(ast.DeleteExpression); !ok {
+		t.Errorf("Expected delete expression, got %v", res.Result)
+	}
+}
+
+func TestParser_Arrays(t *testing.T) {
+	tokens := tokenizer.Tokenize("var a: Array[Int] = [1, 2]; m[0][1] = new Array[Int](3); len(a)", "")
+	res := Parse(tokens).(ast.Block)
+	decl := res.Expressions[0].(ast.Declaration)
+	if typed, ok := decl.Typed.(ast.ArrayType); !ok || typed.Elem.(ast.Identifier).Name != "Int" {
+		t.Errorf("Expected array type, got %v", decl.Typed)
+	}
+	if literal, ok := decl.Value.(ast.ArrayLiteral); !ok || len(literal.Elements) != 2 {
+		t.Errorf("Expected array literal with two elements, got %v", decl.Value)
+	}
+	assign := res.Expressions[1].(ast.BinaryOp)
+	if index, ok := assign.Left.(ast.IndexExpression); !ok {
+		t.Errorf("Expected assignment to an element, got %v", assign.Left)
+	} else if _, ok := index.Array.(ast.IndexExpression); !ok {
+		t.Errorf("Expected nested index, got %v", index.Array)
+	}
+	if _, ok := assign.Right.(ast.NewExpression); !ok {
+		t.Errorf("Expected new expression, got %v", assign.Right)
+	}
+	if call, ok := res.Result.(ast.FunctionCall); !ok || call.Name.(ast.Identifier).Name != "len" {
+		t.Errorf("Expected call to len, got %v", res.Result)
+	}
+}
+
+func TestParser_Structs(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		struct Point { x: Int, y: Int }
+		var p = Point { x: 1, y: 2 };
+		p.x = p.y;
+		if p.x == 2 then p.y
+	`, "")
+	mod := Parse(tokens).(ast.Module)
+	def := mod.Structs[0].(ast.StructDefinition)
+	if def.Name.(ast.Identifier).Name != "Point" || len(def.Fields) != 2 {
+		t.Errorf("Expected struct Point with two fields, got %v", def)
+	}
+	block := mod.Block.(ast.Block)
+	literal, ok := block.Expressions[0].(ast.Declaration).Value.(ast.StructLiteral)
+	if !ok || len(literal.Fields) != 2 || len(literal.Values) != 2 {
+		t.Errorf("Expected struct literal with two fields, got %v", block.Expressions[0])
+	}
+	assign := block.Expressions[1].(ast.BinaryOp)
+	if field, ok := assign.Left.(ast.FieldAccess); !ok || field.Field.(ast.Identifier).Name != "x" {
+		t.Errorf("Expected assignment to field x, got %v", assign.Left)
+	}
+	if _, ok := block.Result.(ast.IfExpression); !ok {
+		t.Errorf("Expected if expression, got %v", block.Result)
+	}
+}
+
+func TestParser_StringEscapes(t *testing.T) {
+	tokens := tokenizer.Tokenize(`"tab\t \"q\" \\ end\n"`, "")
+	res := Parse(tokens).(ast.Block)
+	literal, ok := res.Result.(ast.StringLiteral)
+	if !ok {
+		t.Fatalf("Expected string literal, got %v", res.Result)
+	}
+	if expected := "tab\t \"q\" \\ end\n"; literal.Value != expected {
+		t.Errorf("Expected %q but got %q", expected, literal.Value)
+	}
+}
+
+func TestParser_Lambdas(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		fun adder(n: Int): (Int) => Int {
+			fun(x: Int): Int { x + n }
+		}
+		var id = fun(b: Bool) { b };
+		adder(1)(2)
+	`, "")
+	mod := Parse(tokens).(ast.Module)
+	def := mod.Functions[0].(ast.FunctionDefinition)
+	if _, ok := def.ResultType.(ast.FunType); !ok {
+		t.Errorf("Expected a function result type, got %v", def.ResultType)
+	}
+	lambda, ok := def.Body.(ast.Block).Result.(ast.Lambda)
+	if !ok || len(lambda.Params) != 1 || lambda.ResultType == nil {
+		t.Errorf("Expected lambda with one parameter and a result type, got %v", def.Body)
+	}
+	block := mod.Block.(ast.Block)
+	if lambda, ok := block.Expressions[0].(ast.Declaration).Value.(ast.Lambda); !ok || lambda.ResultType != nil {
+		t.Errorf("Expected lambda without a result type, got %v", block.Expressions[0])
+	}
+	outer, ok := block.Result.(ast.FunctionCall)
+	if !ok {
+		t.Fatalf("Expected call, got %v", block.Result)
+	}
+	if _, ok := outer.Name.(ast.FunctionCall); !ok {
+		t.Errorf("Expected the result of adder(1) to be called, got %v", outer.Name)
+	}
+}
+
+func TestParser_Imports(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		import "lib/math.src";
+		pub fun area(r: Int): Int { math.square(r) * 3 }
+		fun private(): Int { 1 }
+		area(2)
+	`, "main.src")
+	mod := Parse(tokens).(ast.Module)
+	if len(mod.Imports) != 1 || mod.Imports[0].(ast.Import).Path != "lib/math.src" {
+		t.Errorf("Expected an import of lib/math.src, got %v", mod.Imports)
+	}
+	if !mod.Functions[0].(ast.FunctionDefinition).Public || mod.Functions[1].(ast.FunctionDefinition).Public {
+		t.Errorf("Expected only area to be public, got %v", mod.Functions)
+	}
+	if loc := mod.Imports[0].GetLocation(); loc.File != "main.src" || loc.Line != 2 {
+		t.Errorf("Expected the import at main.src line 2, got %v", loc)
+	}
+}
+
+func TestParser_ForLoops(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		for (var i = 0; i < 10; i = i + 1) { print_int(i) }
+		for (;;) do break;
+		for j in 1..n + 1 do { print_int(j) }
+	`, "")
+	block := Parse(tokens).(ast.Block)
+	c, ok := block.Expressions[0].(ast.ForLoop)
+	if !ok || c.Init == nil || c.Condition == nil || c.Step == nil {
+		t.Errorf("Expected a C-style for loop, got %v", block.Expressions[0])
+	}
+	if empty, ok := block.Expressions[1].(ast.ForLoop); !ok || empty.Init != nil || empty.Condition != nil || empty.Step != nil {
+		t.Errorf("Expected a for loop without clauses, got %v", block.Expressions[1])
+	}
+	// The end of the range is evaluated once into a hidden variable
+	desugared, ok := block.Result.(ast.Block)
+	if !ok {
+		t.Fatalf("Expected the range loop in a block, got %v", block.Result)
+	}
+	end := desugared.Expressions[0].(ast.Declaration)
+	if end.Variable.(ast.Identifier).Name != "for.end" {
+		t.Errorf("Expected the end in for.end, got %v", end)
+	}
+	if _, ok := end.Value.(ast.BinaryOp); !ok {
+		t.Errorf("Expected the end to be n + 1, got %v", end.Value)
+	}
+	loop := desugared.Result.(ast.ForLoop)
+	if cond := loop.Condition.(ast.BinaryOp); cond.Op != "<" || cond.Right.(ast.Identifier).Name != "for.end" {
+		t.Errorf("Expected j < for.end, got %v", loop.Condition)
+	}
+	if step := loop.Step.(ast.BinaryOp); step.Op != "=" {
+		t.Errorf("Expected j = j + 1, got %v", loop.Step)
+	}
+}
+
+func TestParser_LabeledLoops(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		outer: while true do {
+			for i in 0..3 do {
+				if i == 1 then { continue outer }
+				break outer i
+			}
+			break;
+		}
+	`, "")
+	loop := Parse(tokens).(ast.Block).Result.(ast.WhileLoop)
+	if loop.Label != "outer" {
+		t.Errorf("Expected the loop to be labeled outer, got %q", loop.Label)
+	}
+	body := loop.Looping.(ast.Block)
+	inner := body.Expressions[0].(ast.Block).Result.(ast.ForLoop).Body.(ast.Block)
+	cont := inner.Expressions[0].(ast.IfExpression).Then.(ast.Block).Result.(ast.ContinueExpression)
+	if cont.Label != "outer" {
+		t.Errorf("Expected continue outer, got %v", cont)
+	}
+	brk := inner.Result.(ast.BreakExpression)
+	if brk.Label != "outer" || brk.Value.(ast.Identifier).Name != "i" {
+		t.Errorf("Expected break outer with the value i, got %v", brk)
+	}
+	if plain := body.Expressions[1].(ast.BreakExpression); plain.Label != "" || plain.Value != nil {
+		t.Errorf("Expected a plain break, got %v", plain)
+	}
+}
+
+func TestParser_Enums(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		enum Shape { Circle(Int), Rect(Int, Int), Empty }
+		match Shape.Rect(1, 2) {
+			Circle(r) => r,
+			Rect(w, _) => { w }
+			_ => 0
+		}
+	`, "")
+	mod := Parse(tokens).(ast.Module)
+	enum := mod.Enums[0].(ast.EnumDefinition)
+	if len(enum.Variants) != 3 {
+		t.Fatalf("Expected 3 variants, got %v", enum.Variants)
+	}
+	if rect := enum.Variants[1].(ast.EnumVariant); rect.Name.(ast.Identifier).Name != "Rect" || len(rect.Fields) != 2 {
+		t.Errorf("Expected Rect(Int, Int), got %v", rect)
+	}
+	if empty := enum.Variants[2].(ast.EnumVariant); len(empty.Fields) != 0 {
+		t.Errorf("Expected Empty without fields, got %v", empty)
+	}
+	match := mod.Block.(ast.Block).Result.(ast.MatchExpression)
+	if value := match.Value.(ast.FunctionCall); value.Name.(ast.FieldAccess).Field.(ast.Identifier).Name != "Rect" {
+		t.Errorf("Expected a call of Shape.Rect, got %v", value)
+	}
+	if len(match.Arms) != 3 {
+		t.Fatalf("Expected 3 arms, got %v", match.Arms)
+	}
+	rect := match.Arms[1].(ast.MatchArm)
+	if len(rect.Bindings) != 2 || rect.Bindings[1].(ast.Identifier).Name != "_" {
+		t.Errorf("Expected Rect(w, _), got %v", rect)
+	}
+	if wildcard := match.Arms[2].(ast.MatchArm); wildcard.Variant.(ast.Identifier).Name != "_" || wildcard.Bindings != nil {
+		t.Errorf("Expected _, got %v", wildcard)
+	}
+}
+
+func TestParser_Tuples(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		fun divmod(a: Int, b: Int): (Int, Int) { (a / b, a % b) }
+		var f: ((Int, Bool)) => Int = fun(p: (Int, Bool)): Int { p.0 };
+		var (q, _) = divmod(7, 2);
+		(q).1
+	`, "")
+	mod := Parse(tokens).(ast.Module)
+	divmod := mod.Functions[0].(ast.FunctionDefinition)
+	if res := divmod.ResultType.(ast.TupleType); len(res.Elems) != 2 {
+		t.Errorf("Expected (Int, Int), got %v", res)
+	}
+	if body := divmod.Body.(ast.Block).Result.(ast.TupleLiteral); len(body.Elements) != 2 {
+		t.Errorf("Expected a tuple of 2 elements, got %v", body)
+	}
+	block := mod.Block.(ast.Block)
+	f := block.Expressions[0].(ast.Declaration)
+	funType := f.Typed.(ast.FunType)
+	if param := funType.Params[0].(ast.TupleType); len(param.Elems) != 2 {
+		t.Errorf("Expected a function taking (Int, Bool), got %v", funType)
+	}
+	destructuring := block.Expressions[1].(ast.Destructuring)
+	if len(destructuring.Variables) != 2 || destructuring.Variables[1].(ast.Identifier).Name != "_" {
+		t.Errorf("Expected var (q, _), got %v", destructuring)
+	}
+	// A parenthesised expression is not a tuple
+	element := block.Result.(ast.TupleElement)
+	if _, ok := element.Tuple.(ast.Identifier); !ok || element.Index != 1 {
+		t.Errorf("Expected q.1, got %v", element)
+	}
+}
+
+func TestParser_Generics(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		fun pair[A, B](a: A, b: B): (A, B) { (a, b) }
+		fun square(x: Int): Int { x * x }
+		pair(1, true)
+	`, "")
+	mod := Parse(tokens).(ast.Module)
+	pair := mod.Functions[0].(ast.FunctionDefinition)
+	if len(pair.TypeParams) != 2 || pair.TypeParams[1].(ast.Identifier).Name != "B" {
+		t.Errorf("Expected type parameters A and B, got %v", pair.TypeParams)
+	}
+	if square := mod.Functions[1].(ast.FunctionDefinition); square.TypeParams != nil {
+		t.Errorf("Expected no type parameters, got %v", square.TypeParams)
+	}
+}
+
+func TestParser_OmittedTypes(t *testing.T) {
+	tokens := tokenizer.Tokenize(`
+		fun double(x: Int) { x * 2 }
+		fun(a, b: Int) { a + b }
+	`, "")
+	mod := Parse(tokens).(ast.Module)
+	if double := mod.Functions[0].(ast.FunctionDefinition); double.ResultType != nil {
+		t.Errorf("Expected no result type, got %v", double.ResultType)
+	}
+	lambda := mod.Block.(ast.Block).Result.(ast.Lambda)
+	if a := lambda.Params[0].(ast.Param); a.Type != nil {
+		t.Errorf("Expected no type for a, got %v", a.Type)
+	}
+	if b := lambda.Params[1].(ast.Param); b.Type.(ast.Identifier).Name != "Int" {
+		t.Errorf("Expected type Int for b, got %v", b.Type)
+	}
+}
+
+func TestParser_ValAndConst(t *testing.T) {
+	tokens := tokenizer.Tokenize("const N = 3; val x: Int = N; var y = x; val (a, b) = (x, y);", "")
+	block := Parse(tokens).(ast.Block)
+	for i, kind := range []string{"const", "val", "var"} {
+		if decl := block.Expressions[i].(ast.Declaration); decl.Kind != kind {
+			t.Errorf("Expected a %s declaration, got %v", kind, decl)
+		}
+	}
+	if destructuring := block.Expressions[3].(ast.Destructuring); destructuring.Kind != "val" {
+		t.Errorf("Expected a val destructuring, got %v", destructuring)
+	}
+}
+
+func TestParser_Cast(t *testing.T) {
+	tokens := tokenizer.Tokenize("-x as UInt8 as Int + 1", "")
+	sum := Parse(tokens).(ast.Block).Result.(ast.BinaryOp)
+	outer, ok := sum.Left.(ast.Cast)
+	if !ok || outer.Type.(ast.Identifier).Name != "Int" {
+		t.Fatalf("Expected a cast to Int on the left of +, got %v", sum.Left)
+	}
+	inner, ok := outer.Value.(ast.Cast)
+	if !ok || inner.Type.(ast.Identifier).Name != "UInt8" {
+		t.Fatalf("Expected a cast to UInt8 inside, got %v", outer.Value)
+	}
+	if _, ok := inner.Value.(ast.Unary); !ok {
+		t.Errorf("Expected the cast to apply to -x, got %v", inner.Value)
+	}
+}
+
+func TestParser_IntLiterals(t *testing.T) {
+	tokens := tokenizer.Tokenize(`[0x1F, 0B101, 0o17, 1_000_000, 0xFFFF_FFFF_FFFF_FFFF, 'a', '\n', 'é', 007]`, "")
+	array := Parse(tokens).(ast.Block).Result.(ast.ArrayLiteral)
+	var values []uint64
+	for _, e := range array.Elements {
+		values = append(values, e.(ast.Literal).Value.(uint64))
+	}
+	expected := "[31 5 15 1000000 18446744073709551615 97 10 233 7]"
+	if fmt.Sprint(values) != expected {
+		t.Errorf("Expected %v but got %v", expected, values)
+	}
+}
+
+func TestParser_InvalidIntLiterals(t *testing.T) {
+	t.Run("Too large", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "0x1_0000_0000_0000_0000 at 1:5 does not fit 64 bits") {
+				t.Errorf("Expected a located error, got %v", r)
+			}
+		}()
+		Parse(tokenizer.Tokenize("1 + 0x1_0000_0000_0000_0000", ""))
+	})
+	t.Run("Misplaced separator", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "Invalid integer literal 1__000 at 1:1") {
+				t.Errorf("Expected a located error, got %v", r)
+			}
+		}()
+		Parse(tokenizer.Tokenize("1__000", ""))
+	})
+	t.Run("Digit out of base", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for 0b102")
+			}
+		}()
+		Parse(tokenizer.Tokenize("0b102", ""))
+	})
+	t.Run("Two characters", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for 'ab'")
+			}
+		}()
+		Parse(tokenizer.Tokenize("'ab'", ""))
+	})
+}
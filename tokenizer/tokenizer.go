@@ -1,16 +1,18 @@
 package tokenizer
 
 import (
+	"fmt"
 	"regexp"
 )
 
 type TokenType string
 
 const (
-	IntLiteral  TokenType = "IntLiteral"
-	Operator    TokenType = "Operator"
-	Punctuation TokenType = "Punctuation"
-	Identifier  TokenType = "Identifier"
+	IntLiteral    TokenType = "IntLiteral"
+	StringLiteral TokenType = "StringLiteral"
+	Operator      TokenType = "Operator"
+	Punctuation   TokenType = "Punctuation"
+	Identifier    TokenType = "Identifier"
 )
 
 type SourceLocation struct {
@@ -19,6 +21,15 @@ type SourceLocation struct {
 	Column int
 }
 
+// Position formats the location as file:line:column, leaving out the file
+// when the source did not come from one.
+func (l SourceLocation) Position() string {
+	if l.File == "" {
+		return fmt.Sprintf("%d:%d", l.Line, l.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", l.File, l.Line, l.Column)
+}
+
 type Token struct {
 	Text     string
 	Type     TokenType
@@ -30,10 +41,13 @@ func Tokenize(sourceCode string, file string) []Token {
 	line, column := 1, 1
 
 	tokenPatterns := map[TokenType]*regexp.Regexp{
-		IntLiteral:  regexp.MustCompile(`^\d+`),
-		Operator:    regexp.MustCompile(`^(==|!=|<=|>=|[+\-*/=<>%])`),
-		Punctuation: regexp.MustCompile(`^[(),{};:]`),
-		Identifier:  regexp.MustCompile(`^[a-zA-Z_]\w*`),
+		// The parser checks the digits of 0x1F, 0b1010, 0o17 and 1_000 and
+		// reads the character of 'a'
+		IntLiteral:    regexp.MustCompile(`^(\d\w*|'(\\.|[^'\\\n])*')`),
+		StringLiteral: regexp.MustCompile(`^"(\\.|[^"\\\n])*"`),
+		Operator:      regexp.MustCompile(`^(==|!=|<=|>=|[+\-*/=<>%&])`),
+		Punctuation:   regexp.MustCompile(`^(\.\.|[(),{};:.\[\]])`),
+		Identifier:    regexp.MustCompile(`^[a-zA-Z_]\w*`),
 	}
 
 	commentPattern := regexp.MustCompile(`^(//|#).*`)
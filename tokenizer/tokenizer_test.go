@@ -71,3 +71,77 @@ func TestTokenize_Fun(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceLocation_Position(t *testing.T) {
+	tokens := Tokenize("1 +\n  x", "prog.txt")
+	if got := tokens[2].Location.Position(); got != "prog.txt:2:3" {
+		t.Errorf("Expected prog.txt:2:3, got %s", got)
+	}
+	tokens = Tokenize("x", "")
+	if got := tokens[0].Location.Position(); got != "1:1" {
+		t.Errorf("Expected 1:1, got %s", got)
+	}
+}
+
+func TestTokenize_String(t *testing.T) {
+	tokens := Tokenize(`print_string("a \"b\" # c\n"); "" x`, "")
+	expected := []Token{
+		{Text: "print_string", Type: Identifier, Location: L},
+		{Text: "(", Type: Punctuation, Location: L},
+		{Text: `"a \"b\" # c\n"`, Type: StringLiteral, Location: L},
+		{Text: ")", Type: Punctuation, Location: L},
+		{Text: ";", Type: Punctuation, Location: L},
+		{Text: `""`, Type: StringLiteral, Location: L},
+		{Text: "x", Type: Identifier, Location: L},
+	}
+	if len(tokens) != len(expected) {
+		t.Errorf("Expected %d tokens, got %d", len(expected), len(tokens))
+	}
+	for i := range tokens {
+		if !tokens[i].Equal(expected[i]) {
+			t.Errorf("Expected token %v, got %v", expected[i], tokens[i])
+		}
+	}
+}
+
+func TestTokenize_Range(t *testing.T) {
+	tokens := Tokenize("0..n p.x", "")
+	expected := []Token{
+		{Text: "0", Type: IntLiteral, Location: L},
+		{Text: "..", Type: Punctuation, Location: L},
+		{Text: "n", Type: Identifier, Location: L},
+		{Text: "p", Type: Identifier, Location: L},
+		{Text: ".", Type: Punctuation, Location: L},
+		{Text: "x", Type: Identifier, Location: L},
+	}
+	if len(tokens) != len(expected) {
+		t.Errorf("Expected %d tokens, got %d", len(expected), len(tokens))
+	}
+	for i := range tokens {
+		if !tokens[i].Equal(expected[i]) {
+			t.Errorf("Expected token %v, got %v", expected[i], tokens[i])
+		}
+	}
+}
+
+func TestTokenize_IntLiterals(t *testing.T) {
+	tokens := Tokenize(`0xFF+0b1010 1_000 '\'' 'a'..2`, "")
+	expected := []Token{
+		{Text: "0xFF", Type: IntLiteral, Location: L},
+		{Text: "+", Type: Operator, Location: L},
+		{Text: "0b1010", Type: IntLiteral, Location: L},
+		{Text: "1_000", Type: IntLiteral, Location: L},
+		{Text: `'\''`, Type: IntLiteral, Location: L},
+		{Text: "'a'", Type: IntLiteral, Location: L},
+		{Text: "..", Type: Punctuation, Location: L},
+		{Text: "2", Type: IntLiteral, Location: L},
+	}
+	if len(tokens) != len(expected) {
+		t.Errorf("Expected %d tokens, got %d", len(expected), len(tokens))
+	}
+	for i := range tokens {
+		if !tokens[i].Equal(expected[i]) {
+			t.Errorf("Expected token %v, got %v", expected[i], tokens[i])
+		}
+	}
+}
@@ -4,74 +4,397 @@ import (
 	"compiler/ast"
 	"compiler/utils"
 	"fmt"
+	"slices"
+	"strings"
 )
 
 type SymTab = utils.SymTab[utils.Type]
 
 func resolveType(name string) utils.Type {
+	if intType, ok := utils.IntTypes[name]; ok {
+		return intType
+	}
 	switch name {
-	case "Int":
-		return utils.Int{Name: "Int"}
 	case "Bool":
 		return utils.Bool{Name: "Bool"}
 	case "Unit":
 		return utils.Unit{Name: "Unit"}
+	case "String":
+		return utils.String{Name: "String"}
 	default:
 		panic(fmt.Sprintf("Unknown type: %s", name))
 	}
 }
 
+// builtinType reports whether name is a type of the language, which structs,
+// enums and type parameters cannot shadow
+func builtinType(name string) bool {
+	_, isInt := utils.IntTypes[name]
+	return isInt || slices.Contains([]string{"Bool", "Unit", "String", "Array"}, name)
+}
+
+// resolveTypeExpr resolves a type annotation, which is a type name, a struct,
+// an array, a function or tuple type or a pointer to another type.
+func resolveTypeExpr(expr ast.Expression, symTab *SymTab) utils.Type {
+	switch typed := expr.(type) {
+	case ast.PointerType:
+		elem := resolveTypeExpr(typed.Elem, symTab)
+		if _, ok := elem.(utils.Unit); ok {
+			panic(fmt.Sprintf("Pointer to Unit is not allowed at %v", typed.Location))
+		}
+		return utils.Pointer{Elem: elem}
+	case ast.ArrayType:
+		elem := resolveTypeExpr(typed.Elem, symTab)
+		if _, ok := elem.(utils.Unit); ok {
+			panic(fmt.Sprintf("Array of Unit is not allowed at %v", typed.Location))
+		}
+		return utils.Array{Elem: elem}
+	case ast.FunType:
+		var params []utils.Type
+		for _, p := range typed.Params {
+			params = append(params, resolveTypeExpr(p, symTab))
+		}
+		functionValue(utils.Fun{Params: params}, typed.Location, "Function type")
+		return utils.Fun{Params: params, Res: resolveTypeExpr(typed.ResType, symTab)}
+	case ast.TupleType:
+		var elems []utils.Type
+		for _, e := range typed.Elems {
+			elem := resolveTypeExpr(e, symTab)
+			if _, ok := elem.(utils.Unit); ok {
+				panic(fmt.Sprintf("Tuple of Unit is not allowed at %v", typed.Location))
+			}
+			elems = append(elems, elem)
+		}
+		return utils.Tuple{Elems: elems}
+	}
+	name := expr.(ast.Identifier).Name
+	if typeParam, ok := lookupTypeParam(symTab, name); ok {
+		return typeParam
+	}
+	if structType, ok := lookupStruct(symTab, name); ok {
+		return structType
+	}
+	if enumType, ok := lookupEnum(symTab, name); ok {
+		return enumType
+	}
+	return resolveType(name)
+}
+
+// The type parameters of a generic function live in the scope of the
+// function under "type <name>".
+func lookupTypeParam(symTab *SymTab, name string) (utils.TypeParam, bool) {
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if value, exists := cur.Table["type "+name]; exists {
+			return value.(utils.TypeParam), true
+		}
+	}
+	return utils.TypeParam{}, false
+}
+
+// declareTypeParams adds the type parameters of a generic function to
+// symTab, the scope its signature and body are checked in.
+func declareTypeParams(fd ast.FunctionDefinition, symTab *SymTab) []string {
+	var names []string
+	for _, tp := range fd.TypeParams {
+		name := tp.(ast.Identifier).Name
+		if slices.Contains(names, name) {
+			panic(fmt.Sprintf("Duplicate type parameter %s at %v", name, tp.GetLocation()))
+		}
+		if builtinType(name) {
+			panic(fmt.Sprintf("Type parameter %s shadows a builtin type at %v", name, tp.GetLocation()))
+		}
+		if _, ok := lookupStruct(symTab, name); ok {
+			panic(fmt.Sprintf("Type parameter %s has the name of a struct at %v", name, tp.GetLocation()))
+		}
+		if _, ok := lookupEnum(symTab, name); ok {
+			panic(fmt.Sprintf("Type parameter %s has the name of an enum at %v", name, tp.GetLocation()))
+		}
+		symTab.Table["type "+name] = utils.TypeParam{Name: name}
+		names = append(names, name)
+	}
+	return names
+}
+
+// lookupGeneric finds the generic function name refers to, unless a
+// variable hides it.
+func lookupGeneric(symTab *SymTab, name string) (utils.Generic, bool) {
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if value, exists := cur.Table[name]; exists {
+			generic, ok := value.(utils.Generic)
+			return generic, ok
+		}
+	}
+	return utils.Generic{}, false
+}
+
+// lookupValue finds the type of the variable or function name refers to
+func lookupValue(symTab *SymTab, name string) (utils.Type, bool) {
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if value, exists := cur.Table[name]; exists {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// maxValueParams is how many parameters a function value can take: its
+// closure record is passed in the first of the six argument registers.
+const maxValueParams = 5
+
+// functionValue rejects a value of a function type with more parameters than
+// a closure can be called with.
+func functionValue(t utils.Type, loc ast.Location, what string) {
+	if fun, ok := utils.Prune(t).(utils.Fun); ok && len(fun.Params) > maxValueParams {
+		panic(fmt.Sprintf("%s at %s takes %d parameters, a function value can take at most %d",
+			what, loc.Position(), len(fun.Params), maxValueParams))
+	}
+}
+
+// instantiate infers the types the type parameters of a call of a generic
+// function stand for from the types of the arguments and returns the type of
+// the result.
+func instantiate(generic utils.Generic, name string, args []ast.Expression, argTypes []utils.Type, loc ast.Location) utils.Type {
+	if len(generic.Fun.Params) != len(argTypes) {
+		panic(fmt.Sprintf("Function %s expects %d args, got %d", name, len(generic.Fun.Params), len(argTypes)))
+	}
+	bindings := make(map[string]utils.Type)
+	for _, tp := range generic.TypeParams {
+		bindings[tp] = &utils.Var{}
+	}
+	for i, pt := range generic.Fun.Params {
+		unify(utils.Substitute(pt, bindings), argTypes[i], args[i].GetLocation(), fmt.Sprintf("Argument %d of %s", i, name))
+	}
+	for _, tp := range generic.TypeParams {
+		if _, ok := utils.Prune(bindings[tp]).(utils.Unit); ok {
+			panic(fmt.Sprintf("Type parameter %s of %s cannot be Unit at %v", tp, name, loc))
+		}
+	}
+	return utils.Substitute(generic.Fun.Res, bindings)
+}
+
+// Struct types live in the symbol table next to variables under
+// "struct <name>".
+func lookupStruct(symTab *SymTab, name string) (utils.Struct, bool) {
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if value, exists := cur.Table["struct "+name]; exists {
+			return value.(utils.Struct), true
+		}
+	}
+	return utils.Struct{}, false
+}
+
+// Enum types live in the symbol table under "enum <name>".
+func lookupEnum(symTab *SymTab, name string) (utils.Enum, bool) {
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if value, exists := cur.Table["enum "+name]; exists {
+			return value.(utils.Enum), true
+		}
+	}
+	return utils.Enum{}, false
+}
+
+// declareEnums adds the names of the enum types of a module to symTab, so
+// that structs and enums can refer to them before defineEnums fills in their
+// variants.
+func declareEnums(enums []ast.Expression, symTab *SymTab) {
+	for _, en := range enums {
+		ed := en.(ast.EnumDefinition)
+		name := ed.Name.(ast.Identifier).Name
+		if _, exists := symTab.Table["enum "+name]; exists {
+			panic(fmt.Sprintf("Enum %s already declared at %v", name, ed.Location))
+		}
+		if builtinType(name) {
+			panic(fmt.Sprintf("Enum %s shadows a builtin type at %v", name, ed.Location))
+		}
+		symTab.Table["enum "+name] = utils.Enum{EnumLayout: &utils.EnumLayout{Name: name}}
+	}
+}
+
+func defineEnums(enums []ast.Expression, symTab *SymTab) {
+	for _, en := range enums {
+		ed := en.(ast.EnumDefinition)
+		layout := symTab.Table["enum "+ed.Name.(ast.Identifier).Name].(utils.Enum).EnumLayout
+		if _, exists := symTab.Table["struct "+layout.Name]; exists {
+			panic(fmt.Sprintf("Enum %s has the name of a struct at %v", layout.Name, ed.Location))
+		}
+		if len(ed.Variants) == 0 {
+			panic(fmt.Sprintf("Enum %s has no variants at %v", layout.Name, ed.Location))
+		}
+		for _, v := range ed.Variants {
+			variant := v.(ast.EnumVariant)
+			variantName := variant.Name.(ast.Identifier).Name
+			if _, exists := layout.Tag(variantName); exists || variantName == "_" {
+				panic(fmt.Sprintf("Duplicate variant %s in enum %s at %v", variantName, layout.Name, variant.Location))
+			}
+			var fields []utils.Type
+			for _, f := range variant.Fields {
+				fieldType := resolveTypeExpr(f, symTab)
+				if _, ok := fieldType.(utils.Unit); ok {
+					panic(fmt.Sprintf("Variant %s of enum %s cannot hold Unit at %v", variantName, layout.Name, variant.Location))
+				}
+				fields = append(fields, fieldType)
+			}
+			layout.Variants = append(layout.Variants, variantName)
+			layout.Fields = append(layout.Fields, fields)
+		}
+	}
+}
+
+// enumVariant tells whether expr, the name of a call or a field access, is a
+// variant of an enum such as Shape.Circle. A variable called Shape hides the
+// enum.
+func enumVariant(expr ast.Expression, symTab *SymTab) (utils.Enum, int, bool) {
+	access, ok := expr.(ast.FieldAccess)
+	if !ok {
+		return utils.Enum{}, 0, false
+	}
+	object, ok := access.Object.(ast.Identifier)
+	if !ok {
+		return utils.Enum{}, 0, false
+	}
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if _, exists := cur.Table[object.Name]; exists {
+			return utils.Enum{}, 0, false
+		}
+	}
+	enumType, ok := lookupEnum(symTab, object.Name)
+	if !ok {
+		return utils.Enum{}, 0, false
+	}
+	variant := access.Field.(ast.Identifier).Name
+	tag, ok := enumType.Tag(variant)
+	if !ok {
+		panic(fmt.Sprintf("Enum %s has no variant %s at %v", enumType.Name, variant, access.Location))
+	}
+	return enumType, tag, true
+}
+
+// defineStructs adds the struct types of a module to symTab. All names are
+// known before the fields are resolved so structs can refer to each other.
+func defineStructs(structs []ast.Expression, symTab *SymTab) {
+	for _, st := range structs {
+		sd := st.(ast.StructDefinition)
+		name := sd.Name.(ast.Identifier).Name
+		if _, exists := symTab.Table["struct "+name]; exists {
+			panic(fmt.Sprintf("Struct %s already declared", name))
+		}
+		if builtinType(name) {
+			panic(fmt.Sprintf("Struct %s shadows a builtin type at %v", name, sd.Location))
+		}
+		symTab.Table["struct "+name] = utils.Struct{StructLayout: &utils.StructLayout{Name: name}}
+	}
+	for _, st := range structs {
+		sd := st.(ast.StructDefinition)
+		layout := symTab.Table["struct "+sd.Name.(ast.Identifier).Name].(utils.Struct).StructLayout
+		if len(sd.Fields) == 0 {
+			panic(fmt.Sprintf("Struct %s has no fields", layout.Name))
+		}
+		for _, f := range sd.Fields {
+			field := f.(ast.Param)
+			fieldName := field.Name.(ast.Identifier).Name
+			if _, exists := layout.Offset(fieldName); exists {
+				panic(fmt.Sprintf("Duplicate field %s in struct %s", fieldName, layout.Name))
+			}
+			fieldType := resolveTypeExpr(field.Type, symTab)
+			if _, ok := fieldType.(utils.Unit); ok {
+				panic(fmt.Sprintf("Field %s of struct %s cannot be Unit", fieldName, layout.Name))
+			}
+			layout.Fields = append(layout.Fields, fieldName)
+			layout.Types = append(layout.Types, fieldType)
+		}
+	}
+}
+
+// typecheck returns the type of node. A type the typechecker infers comes
+// back as the Var itself, so that errors can tell where it was inferred;
+// utils.Prune gives the type it stands for.
 func typecheck(node ast.Expression, symTab *SymTab) utils.Type {
 	switch n := node.(type) {
 	case ast.Module:
+		// Imports are merged in by the loader before type checking
+		if len(n.Imports) > 0 {
+			imp := n.Imports[0].(ast.Import)
+			panic(fmt.Sprintf("Unresolved import %q at %v", imp.Path, imp.Location))
+		}
+		declareEnums(n.Enums, symTab)
+		defineStructs(n.Structs, symTab)
+		defineEnums(n.Enums, symTab)
+		// Extern functions can only pass values C understands
+		for _, ext := range n.Externs {
+			ef := ext.(ast.ExternFunction)
+			name := ef.Name.(ast.Identifier).Name
+			reserved(name, ef.Location)
+			var paramTypes []utils.Type
+			for _, p := range ef.Params {
+				pType := resolveTypeExpr(p.(ast.Param).Type, symTab)
+				if _, ok := pType.(utils.Unit); ok {
+					panic(fmt.Sprintf("Extern function %s parameters must be Int, Bool or pointers", name))
+				}
+				paramTypes = append(paramTypes, pType)
+			}
+			symTab.Table[name] = utils.Fun{
+				Params: paramTypes,
+				Res:    resolveTypeExpr(ef.ResultType, symTab),
+			}
+		}
 		// First pass: register all function types for mutual recursion
 		for _, fn := range n.Functions {
 			fd := fn.(ast.FunctionDefinition)
 			name := fd.Name.(ast.Identifier).Name
+			reserved(name, fd.Location)
+			sigTab := utils.NewSymTab(symTab)
+			typeParams := declareTypeParams(fd, sigTab)
 			var paramTypes []utils.Type
 			for _, p := range fd.Params {
-				paramTypes = append(paramTypes, resolveType(p.(ast.Param).Type.(ast.Identifier).Name))
+				paramTypes = append(paramTypes, resolveTypeExpr(p.(ast.Param).Type, sigTab))
 			}
-			retType := resolveType(fd.ResultType.(ast.Identifier).Name)
-			symTab.Table[name] = utils.Fun{
+			for _, tp := range typeParams {
+				if !slices.ContainsFunc(paramTypes, func(t utils.Type) bool { return mentions(t, tp) }) {
+					panic(fmt.Sprintf("Type parameter %s of %s must appear in the type of a parameter at %v", tp, name, fd.Location))
+				}
+			}
+			if typeParams != nil && fd.ResultType == nil {
+				panic(fmt.Sprintf("Generic function %s needs a result type at %v", name, fd.Location))
+			}
+			retType := resultType(fd, sigTab)
+			sig := utils.Fun{
 				Params: paramTypes,
 				Res:    retType,
 			}
+			if typeParams != nil {
+				symTab.Table[name] = utils.Generic{TypeParams: typeParams, Fun: sig}
+			} else {
+				symTab.Table[name] = sig
+			}
+			// A call in the top-level block can need the result type of a
+			// function before the second pass gets to its body
+			if v, ok := retType.(*utils.Var); ok {
+				v.Infer = func() { checkFunction(fd, symTab) }
+			}
 		}
+		// The top-level block declares the globals the bodies can use
+		result := typecheckTopLevel(n.Block, symTab)
 		// Second pass: type-check function bodies
 		for _, fn := range n.Functions {
 			fd := fn.(ast.FunctionDefinition)
-			fnTab := utils.NewSymTab(symTab)
-			retType := resolveType(fd.ResultType.(ast.Identifier).Name)
-			fnTab.Table["__return_type__"] = retType
-			seen := make(map[string]bool)
-			for _, p := range fd.Params {
-				param := p.(ast.Param)
-				pName := param.Name.(ast.Identifier).Name
-				if seen[pName] {
-					panic(fmt.Sprintf("Duplicate parameter name: %s", pName))
-				}
-				seen[pName] = true
-				pType := resolveType(param.Type.(ast.Identifier).Name)
-				fnTab.Table[pName] = pType
-			}
-			bodyType := typecheck(fd.Body, fnTab)
-			if _, ok := bodyType.(utils.Unit); !ok {
-				if bodyType != retType {
-					panic(fmt.Sprintf("Function %s return type mismatch: expected %v, got %v",
-						fd.Name.(ast.Identifier).Name, retType, bodyType))
-				}
+			if fd.ResultType != nil {
+				checkFunction(fd, symTab)
+			} else if v := inferred(symTab, fd.Location, ""); v.Infer != nil {
+				v.Infer()
 			}
 		}
-		return typecheck(n.Block, symTab)
+		return result
 
 	case ast.Literal:
 		var res utils.Type
 		_, ok := n.Value.(uint64)
 		if ok {
-			res = utils.Int{
-				Name: "Int",
-			}
+			// The literal is an Int unless it is used as another integer
+			// type, which Infer then writes in as a cast. It has no name,
+			// so errors do not note where its type was decided.
+			literal := inferred(symTab, n.Location, "")
+			literal.Integer = true
+			res = literal
 		} else if n.Value == nil {
 			res = utils.Unit{
 				Name: "Nil",
@@ -82,39 +405,57 @@ func typecheck(node ast.Expression, symTab *SymTab) utils.Type {
 		return res
 
 	case ast.BinaryOp:
+		if n.Op == "=" {
+			if target, ok := n.Left.(ast.Identifier); ok && capturedByLambda(symTab, target.Name) {
+				panic(fmt.Sprintf("Cannot assign to %s captured by a lambda at %v", target.Name, n.Location))
+			}
+			if target, ok := n.Left.(ast.Identifier); ok {
+				if kind := declaredWith(symTab, target.Name); kind != "" {
+					panic(fmt.Sprintf("Cannot assign to %s declared with %s at %v", target.Name, kind, n.Location))
+				}
+			}
+		}
 		left := typecheck(n.Left, symTab)
 		right := typecheck(n.Right, symTab)
 
 		switch n.Op {
 		case "+", "-", "*", "/", "%":
-			_, lok := left.(utils.Int)
-			_, rok := right.(utils.Int)
-			if !lok || !rok {
-				panic(fmt.Sprintf("Both left %s and right %s must be integers", left, right))
-			}
-			return utils.Int{
-				Name: "Int",
-			}
+			integer(left, n.Left.GetLocation(), "Left side of "+n.Op)
+			unify(left, right, n.Right.GetLocation(), "Right side of "+n.Op)
+			return left
 
 		case "<", ">", ">=", "<=":
-			_, lok := left.(utils.Int)
-			_, rok := right.(utils.Int)
-			if !lok || !rok {
-				panic(fmt.Sprintf("Both left %s and right %s must be integers", left, right))
-			}
+			integer(left, n.Left.GetLocation(), "Left side of "+n.Op)
+			unify(left, right, n.Right.GetLocation(), "Right side of "+n.Op)
 			return utils.Bool{
 				Name: "Bool",
 			}
 
 		case "=":
-			if left != right {
-				panic(fmt.Sprintf("Both left %s and right %s must be same type", left, right))
-			}
+			unify(left, right, n.Right.GetLocation(), "Assigned value")
 			return left
 
-		case "!=", "==", "and", "or":
-			if left != right {
-				panic(fmt.Sprintf("Both left %s and right %s must be same type", left, right))
+		case "and", "or":
+			unify(utils.Bool{Name: "Bool"}, left, n.Left.GetLocation(), "Left side of "+n.Op)
+			unify(utils.Bool{Name: "Bool"}, right, n.Right.GetLocation(), "Right side of "+n.Op)
+			return utils.Bool{
+				Name: "Bool",
+			}
+
+		case "!=", "==":
+			unify(left, right, n.Right.GetLocation(), "Right side of "+n.Op)
+			left = utils.Prune(left)
+			if _, ok := left.(utils.Fun); ok {
+				panic(fmt.Sprintf("Functions cannot be compared at %v", n.Location))
+			}
+			if _, ok := left.(utils.Enum); ok {
+				panic(fmt.Sprintf("Enums cannot be compared at %v, use match", n.Location))
+			}
+			if _, ok := left.(utils.Tuple); ok {
+				panic(fmt.Sprintf("Tuples cannot be compared at %v, compare their elements", n.Location))
+			}
+			if typeParam, ok := left.(utils.TypeParam); ok {
+				panic(fmt.Sprintf("Values of type parameter %v cannot be compared at %v", typeParam, n.Location))
 			}
 			return utils.Bool{
 				Name: "Bool",
@@ -123,15 +464,14 @@ func typecheck(node ast.Expression, symTab *SymTab) utils.Type {
 
 	case ast.IfExpression:
 		condition := typecheck(n.Condition, symTab)
-		_, ok := condition.(utils.Bool)
-		if !ok {
-			panic(fmt.Sprintf("%s condition is not boolean", condition))
-		}
+		unify(utils.Bool{Name: "Bool"}, condition, n.Condition.GetLocation(), "Condition")
 		if n.Then == nil {
 			panic(fmt.Sprintf("Not allowed to declare here %v", n.Then))
 		}
 		then := typecheck(n.Then, symTab)
-		typecheck(n.Else, symTab)
+		if n.Else != nil {
+			unify(then, typecheck(n.Else, symTab), n.Else.GetLocation(), "If branches")
+		}
 		return then
 
 	case ast.Declaration:
@@ -144,63 +484,223 @@ func typecheck(node ast.Expression, symTab *SymTab) utils.Type {
 			panic(fmt.Sprintf("%s already declared", n.Variable))
 		}
 		if n.Typed != nil {
-			switch typed := n.Typed.(type) {
-			case ast.Identifier:
-				if typed.Name == "Bool" {
-					if _, ok := value.(utils.Bool); !ok {
-						panic("Must be boolean")
-					}
-				} else if typed.Name == "Int" {
-					if _, ok := value.(utils.Int); !ok {
-						panic("Must be integer")
-					}
-				}
-			case ast.FunType:
-				var paramTypes []utils.Type
-				for _, p := range typed.Params {
-					paramTypes = append(paramTypes, resolveType(p.(ast.Identifier).Name))
-				}
-				resType := resolveType(typed.ResType.(ast.Identifier).Name)
-				expected := utils.Fun{Params: paramTypes, Res: resType}
-				if ft, ok := value.(utils.Fun); ok {
-					if len(ft.Params) != len(expected.Params) {
-						panic("Function type parameter count mismatch")
-					}
-					for i, pt := range expected.Params {
-						if pt != ft.Params[i] {
-							panic(fmt.Sprintf("Function type parameter %d mismatch", i))
-						}
-					}
-					if expected.Res != ft.Res {
-						panic("Function type return type mismatch")
-					}
-				} else {
-					panic("Expected function type")
-				}
+			unify(resolveTypeExpr(n.Typed, symTab), value, n.Value.GetLocation(), "Value of "+str)
+		}
+		if n.Kind == "const" {
+			if symTab.Parent != nil {
+				panic(fmt.Sprintf("const %s at %v must be declared in the top-level block", str, n.Location))
+			}
+			switch known(value, n.Value, "it is a const").(type) {
+			case utils.Int, utils.Bool:
+			default:
+				panic(fmt.Sprintf("const %s at %v must be an Int or a Bool, got %v", str, n.Location, value))
 			}
+			constant(n.Value, symTab)
+		}
+		if n.Kind == "val" || n.Kind == "const" {
+			symTab.Table[n.Kind+" "+str] = utils.Unit{}
 		}
 		symTab.Table[str] = value
 		return value
 
 	case ast.Identifier:
-		if value, exists := symTab.Table[n.Name]; exists {
-			return value
+		if _, ok := lookupGeneric(symTab, n.Name); ok {
+			panic(fmt.Sprintf("Generic function %s can only be called, not used as a value at %v", n.Name, n.Location))
 		}
-		cur_scp := symTab.Parent
-		for cur_scp != nil {
-			if value, exists := cur_scp.Table[n.Name]; exists {
-				return value
-			}
-			cur_scp = cur_scp.Parent
+		if value, exists := lookupValue(symTab, n.Name); exists {
+			functionValue(value, n.Location, n.Name)
+			return value
 		}
 
 	case ast.Unary:
 		value := typecheck(n.Exp, symTab)
-		if _, ok := value.(utils.Bool); !ok && n.Op == "not" {
-			panic(fmt.Sprintf("Not allowed Unary %v", value))
+		switch n.Op {
+		case "&":
+			if _, ok := n.Exp.(ast.Identifier); !ok && !isDeref(n.Exp) {
+				panic(fmt.Sprintf("Cannot take the address of %v", n.Exp))
+			}
+			if target, ok := n.Exp.(ast.Identifier); ok && capturedByLambda(symTab, target.Name) {
+				panic(fmt.Sprintf("Cannot take the address of %s captured by a lambda at %v", target.Name, n.Location))
+			}
+			if target, ok := n.Exp.(ast.Identifier); ok {
+				if kind := declaredWith(symTab, target.Name); kind != "" {
+					panic(fmt.Sprintf("Cannot take the address of %s declared with %s at %v", target.Name, kind, n.Location))
+				}
+			}
+			if _, ok := utils.Prune(value).(utils.Unit); ok {
+				panic(fmt.Sprintf("Cannot take the address of %v of type %v", n.Exp, value))
+			}
+			return utils.Pointer{Elem: value}
+		case "*":
+			value = utils.Prune(value)
+			if _, ok := value.(*utils.Var); ok {
+				unify(utils.Pointer{Elem: &utils.Var{}}, value, n.Exp.GetLocation(), "Dereferenced value")
+				value = utils.Prune(value)
+			}
+			ptr, ok := value.(utils.Pointer)
+			if !ok {
+				panic(fmt.Sprintf("Cannot dereference %v of type %v", n.Exp, value))
+			}
+			return ptr.Elem
+		case "not":
+			unify(utils.Bool{Name: "Bool"}, value, n.Exp.GetLocation(), "Operand of not")
+		case "-":
+			integer(value, n.Exp.GetLocation(), "Operand of -")
+			if intType, ok := utils.Prune(value).(utils.Int); ok && intType.Unsigned {
+				panic(fmt.Sprintf("Cannot negate a value of unsigned type %v at %s", intType, n.Exp.GetLocation().Position()))
+			}
 		}
 		return value
 
+	case ast.Cast:
+		value := known(typecheck(n.Value, symTab), n.Value, "it is cast")
+		if _, ok := value.(utils.Int); !ok {
+			panic(fmt.Sprintf("Cannot cast a value of type %v at %s, only integers can be cast", value, n.Location.Position()))
+		}
+		target := resolveTypeExpr(n.Type, symTab)
+		if _, ok := target.(utils.Int); !ok {
+			panic(fmt.Sprintf("Cannot cast to %v at %s, only to integer types", target, n.Location.Position()))
+		}
+		return target
+
+	case ast.NewExpression:
+		typed := resolveTypeExpr(n.Type, symTab)
+		if array, ok := typed.(utils.Array); ok {
+			unify(utils.Int{Name: "Int"}, typecheck(n.Value, symTab), n.Value.GetLocation(), fmt.Sprintf("Length of new %v", array))
+			return array
+		}
+		if _, ok := typed.(utils.Unit); ok {
+			panic(fmt.Sprintf("Cannot allocate Unit at %v", n.Location))
+		}
+		unify(typed, typecheck(n.Value, symTab), n.Value.GetLocation(), fmt.Sprintf("Value of new %v", typed))
+		return utils.Pointer{Elem: typed}
+
+	case ast.ArrayLiteral:
+		if len(n.Elements) == 0 {
+			panic(fmt.Sprintf("Empty array literal at %v, use new Array[T](0)", n.Location))
+		}
+		elem := typecheck(n.Elements[0], symTab)
+		if _, ok := utils.Prune(elem).(utils.Unit); ok {
+			panic(fmt.Sprintf("Cannot make an array of %v", elem))
+		}
+		for _, e := range n.Elements[1:] {
+			unify(elem, typecheck(e, symTab), e.GetLocation(), "Array element")
+		}
+		return utils.Array{Elem: elem}
+
+	case ast.StructLiteral:
+		name := n.Name.(ast.Identifier).Name
+		structType, ok := lookupStruct(symTab, name)
+		if !ok {
+			panic(fmt.Sprintf("Unknown struct %s at %v", name, n.Location))
+		}
+		given := make(map[string]bool)
+		for i, f := range n.Fields {
+			fieldName := f.(ast.Identifier).Name
+			if _, exists := structType.Offset(fieldName); !exists {
+				panic(fmt.Sprintf("Struct %s has no field %s", name, fieldName))
+			}
+			if given[fieldName] {
+				panic(fmt.Sprintf("Field %s given twice at %v", fieldName, f.GetLocation()))
+			}
+			given[fieldName] = true
+			unify(structType.FieldType(fieldName), typecheck(n.Values[i], symTab), n.Values[i].GetLocation(),
+				fmt.Sprintf("Field %s of %s", fieldName, name))
+		}
+		for _, fieldName := range structType.Fields {
+			if !given[fieldName] {
+				panic(fmt.Sprintf("Missing field %s of %s at %v", fieldName, name, n.Location))
+			}
+		}
+		return structType
+
+	case ast.FieldAccess:
+		if enumType, tag, ok := enumVariant(n, symTab); ok {
+			if fields := enumType.Fields[tag]; len(fields) > 0 {
+				panic(fmt.Sprintf("Variant %s of %s needs %d values at %v",
+					enumType.Variants[tag], enumType.Name, len(fields), n.Location))
+			}
+			return enumType
+		}
+		object := known(typecheck(n.Object, symTab), n.Object, "its field "+n.Field.(ast.Identifier).Name+" is used")
+		structType, ok := object.(utils.Struct)
+		if !ok {
+			panic(fmt.Sprintf("Cannot access a field of %v of type %v", n.Object, object))
+		}
+		fieldName := n.Field.(ast.Identifier).Name
+		if _, exists := structType.Offset(fieldName); !exists {
+			panic(fmt.Sprintf("Struct %v has no field %s", structType, fieldName))
+		}
+		return structType.FieldType(fieldName)
+
+	case ast.TupleLiteral:
+		var elems []utils.Type
+		for _, e := range n.Elements {
+			elem := typecheck(e, symTab)
+			if _, ok := utils.Prune(elem).(utils.Unit); ok {
+				panic(fmt.Sprintf("Cannot put %v of type Unit in a tuple at %v", e, n.Location))
+			}
+			elems = append(elems, elem)
+		}
+		return utils.Tuple{Elems: elems}
+
+	case ast.TupleElement:
+		value := known(typecheck(n.Tuple, symTab), n.Tuple, fmt.Sprintf("its element %d is used", n.Index))
+		tuple, ok := value.(utils.Tuple)
+		if !ok {
+			panic(fmt.Sprintf("Cannot take element %d of %v of type %v at %v", n.Index, n.Tuple, value, n.Location))
+		}
+		if n.Index >= len(tuple.Elems) {
+			panic(fmt.Sprintf("Tuple %v has no element %d at %v", tuple, n.Index, n.Location))
+		}
+		return tuple.Elems[n.Index]
+
+	case ast.Destructuring:
+		value := known(typecheck(n.Value, symTab), n.Value, "it is destructured")
+		tuple, ok := value.(utils.Tuple)
+		if !ok {
+			panic(fmt.Sprintf("Cannot destructure %v of type %v at %v", n.Value, value, n.Location))
+		}
+		if len(n.Variables) != len(tuple.Elems) {
+			panic(fmt.Sprintf("Expected %d names for %v, got %d at %v", len(tuple.Elems), tuple, len(n.Variables), n.Location))
+		}
+		for i, v := range n.Variables {
+			name := v.(ast.Identifier).Name
+			if name == "_" {
+				continue
+			}
+			if _, exists := symTab.Table[name]; exists {
+				panic(fmt.Sprintf("%s already declared at %v", name, v.GetLocation()))
+			}
+			if n.Kind == "val" {
+				symTab.Table["val "+name] = utils.Unit{}
+			}
+			symTab.Table[name] = tuple.Elems[i]
+		}
+		return utils.Unit{}
+
+	case ast.IndexExpression:
+		value := utils.Prune(typecheck(n.Array, symTab))
+		if _, ok := value.(*utils.Var); ok {
+			unify(utils.Array{Elem: &utils.Var{}}, value, n.Array.GetLocation(), "Indexed value")
+			value = utils.Prune(value)
+		}
+		array, ok := value.(utils.Array)
+		if !ok {
+			panic(fmt.Sprintf("Cannot index %v, it is not an array", n.Array))
+		}
+		unify(utils.Int{Name: "Int"}, typecheck(n.Index, symTab), n.Index.GetLocation(), "Array index")
+		return array.Elem
+
+	case ast.DeleteExpression:
+		if _, ok := known(typecheck(n.Value, symTab), n.Value, "it is deleted").(utils.Pointer); !ok {
+			panic(fmt.Sprintf("Cannot delete %v, it is not a pointer", n.Value))
+		}
+		return utils.Unit{}
+
+	case ast.StringLiteral:
+		return utils.String{Name: "String"}
+
 	case ast.BooleanLiteral:
 		var res utils.Type
 		if n.Boolean == "true" || n.Boolean == "false" {
@@ -215,34 +715,112 @@ func typecheck(node ast.Expression, symTab *SymTab) utils.Type {
 		for _, par := range n.Args {
 			argTypes = append(argTypes, typecheck(par, symTab))
 		}
-		name := n.Name.(ast.Identifier).Name
+		name := "function value"
+		if identifier, ok := n.Name.(ast.Identifier); ok {
+			name = identifier.Name
+		}
 		if name == "print_int" {
-			if _, ok := argTypes[len(argTypes)-1].(utils.Int); !ok {
-				panic("params should be int")
-			}
+			unify(utils.Int{Name: "Int"}, argTypes[len(argTypes)-1], n.Args[len(n.Args)-1].GetLocation(), "Argument of print_int")
 			return utils.Int{Name: "Int"}
 		} else if name == "print_bool" {
-			if _, ok := argTypes[len(argTypes)-1].(utils.Bool); !ok {
-				panic("params should be bool")
-			}
+			unify(utils.Bool{Name: "Bool"}, argTypes[len(argTypes)-1], n.Args[len(n.Args)-1].GetLocation(), "Argument of print_bool")
 			return utils.Bool{Name: "Bool"}
 		} else if name == "read_int" {
 			return utils.Int{Name: "Int"}
+		} else if enumType, tag, ok := enumVariant(n.Name, symTab); ok {
+			fields := enumType.Fields[tag]
+			if len(fields) != len(argTypes) {
+				panic(fmt.Sprintf("Variant %s of %s needs %d values, got %d at %v",
+					enumType.Variants[tag], enumType.Name, len(fields), len(argTypes), n.Location))
+			}
+			for i, field := range fields {
+				unify(field, argTypes[i], n.Args[i].GetLocation(),
+					fmt.Sprintf("Value %d of %s.%s", i, enumType.Name, enumType.Variants[tag]))
+			}
+			return enumType
+		} else if name == "len" {
+			if len(argTypes) != 1 {
+				panic(fmt.Sprintf("len expects 1 arg, got %d", len(argTypes)))
+			}
+			switch known(argTypes[0], n.Args[0], "its length is taken").(type) {
+			case utils.Array, utils.String:
+			default:
+				panic(fmt.Sprintf("len expects an array or a string, got %v", argTypes[0]))
+			}
+			return utils.Int{Name: "Int"}
+		}
+		if generic, ok := lookupGeneric(symTab, name); ok {
+			return instantiate(generic, name, n.Args, argTypes, n.Location)
+		}
+		var fnType utils.Type
+		if identifier, ok := n.Name.(ast.Identifier); ok {
+			// A called function is not a value, any number of parameters do
+			fnType, _ = lookupValue(symTab, identifier.Name)
+			if fnType == nil {
+				fnType = utils.Unit{}
+			}
+		} else {
+			fnType = typecheck(n.Name, symTab)
+		}
+		fnType = utils.Prune(fnType)
+		// Calling a value of an inferred type makes it a function
+		if _, ok := fnType.(*utils.Var); ok {
+			called := utils.Fun{Res: &utils.Var{}}
+			for range argTypes {
+				called.Params = append(called.Params, &utils.Var{})
+			}
+			functionValue(called, n.Name.GetLocation(), "Called value")
+			unify(called, fnType, n.Name.GetLocation(), "Called value")
+			fnType = utils.Prune(fnType)
 		}
-		fnType := typecheck(n.Name, symTab)
 		if ft, ok := fnType.(utils.Fun); ok {
 			if len(ft.Params) != len(argTypes) {
 				panic(fmt.Sprintf("Function %s expects %d args, got %d", name, len(ft.Params), len(argTypes)))
 			}
 			for i, pt := range ft.Params {
-				if pt != argTypes[i] {
-					panic(fmt.Sprintf("Argument %d type mismatch: expected %v, got %v", i, pt, argTypes[i]))
-				}
+				unify(pt, argTypes[i], n.Args[i].GetLocation(), fmt.Sprintf("Argument %d of %s", i, name))
+			}
+			if v, ok := ft.Res.(*utils.Var); ok && v.Infer != nil {
+				v.Infer()
 			}
 			return ft.Res
 		}
 		return fnType
 
+	case ast.MatchExpression:
+		return typecheckMatch(n, symTab)
+
+	case ast.Lambda:
+		lambdaTab := utils.NewSymTab(symTab)
+		lambdaTab.Table["__lambda__"] = utils.Unit{}
+		var resType utils.Type
+		if n.ResultType != nil {
+			resType = resolveTypeExpr(n.ResultType, symTab)
+		} else {
+			resType = inferred(symTab, n.Location, "the result of the lambda")
+		}
+		lambdaTab.Table["__return_type__"] = resType
+		var params []utils.Type
+		for _, p := range n.Params {
+			param := p.(ast.Param)
+			pName := param.Name.(ast.Identifier).Name
+			if _, exists := lambdaTab.Table[pName]; exists {
+				panic(fmt.Sprintf("Duplicate parameter name: %s", pName))
+			}
+			var pType utils.Type
+			if param.Type != nil {
+				pType = resolveTypeExpr(param.Type, symTab)
+			} else {
+				pType = inferred(symTab, param.Location, "the type of parameter "+pName)
+			}
+			lambdaTab.Table[pName] = pType
+			params = append(params, pType)
+		}
+		functionValue(utils.Fun{Params: params}, n.Location, "Lambda")
+		bodyType := typecheck(n.Body, lambdaTab)
+		resultOf(resType, bodyType, n.Body.GetLocation(), "Result of the lambda")
+		return utils.Fun{Params: params, Res: resType}
+
 	case ast.Block:
 		var exprs []utils.Type
 		tab := utils.NewSymTab(symTab)
@@ -253,17 +831,44 @@ func typecheck(node ast.Expression, symTab *SymTab) utils.Type {
 		return res
 
 	case ast.WhileLoop:
-		cond := typecheck(n.Condition, symTab)
-		if _, ok := cond.(utils.Bool); !ok {
-			panic(fmt.Sprintf("%s condition is not boolean", cond))
+		unify(utils.Bool{Name: "Bool"}, typecheck(n.Condition, symTab), n.Condition.GetLocation(), "Condition")
+		literal, endless := n.Condition.(ast.BooleanLiteral)
+		tab := loopScope(symTab, n.Label, endless && literal.Boolean == "true")
+		typecheck(n.Looping, tab)
+		return loopType(tab)
+
+	case ast.ForLoop:
+		tab := loopScope(symTab, n.Label, n.Condition == nil)
+		if n.Init != nil {
+			typecheck(n.Init, tab)
 		}
-		typecheck(n.Looping, symTab)
-		return utils.Unit{}
+		if n.Condition != nil {
+			unify(utils.Bool{Name: "Bool"}, typecheck(n.Condition, tab), n.Condition.GetLocation(), "Condition")
+		}
+		if n.Step != nil {
+			typecheck(n.Step, tab)
+		}
+		typecheck(n.Body, tab)
+		return loopType(tab)
 
 	case ast.BreakExpression:
+		loop := findLoop(symTab, n.Label, "break", n.Location)
+		var value utils.Type = utils.Unit{}
+		if n.Value != nil {
+			if _, ok := loop.Table["__endless__"]; !ok {
+				panic(fmt.Sprintf("break with a value at %v needs a loop that only ends with break, such as while true", n.Location))
+			}
+			value = typecheck(n.Value, symTab)
+		}
+		if previous, ok := loop.Table["__break__"]; ok {
+			unify(previous, value, n.Location, "Value of break")
+		} else {
+			loop.Table["__break__"] = value
+		}
 		return utils.Unit{}
 
 	case ast.ContinueExpression:
+		findLoop(symTab, n.Label, "continue", n.Location)
 		return utils.Unit{}
 
 	case ast.ReturnExpression:
@@ -272,9 +877,7 @@ func typecheck(node ast.Expression, symTab *SymTab) utils.Type {
 		cur := symTab
 		for cur != nil {
 			if expected, exists := cur.Table["__return_type__"]; exists {
-				if retVal != expected {
-					panic(fmt.Sprintf("Return type mismatch: expected %v, got %v", expected, retVal))
-				}
+				unify(expected, retVal, n.Result.GetLocation(), "Returned value")
 				break
 			}
 			cur = cur.Parent
@@ -285,11 +888,633 @@ func typecheck(node ast.Expression, symTab *SymTab) utils.Type {
 	return utils.Unit{}
 }
 
+// checkFunction checks the body of the function fd against its signature
+func checkFunction(fd ast.FunctionDefinition, symTab *SymTab) {
+	fnTab := utils.NewSymTab(symTab)
+	declareTypeParams(fd, fnTab)
+	retType := resultType(fd, fnTab)
+	if v, ok := retType.(*utils.Var); ok {
+		// A recursive call cannot wait for the body to be checked
+		v.Infer = nil
+	}
+	fnTab.Table["__return_type__"] = retType
+	seen := make(map[string]bool)
+	for _, p := range fd.Params {
+		param := p.(ast.Param)
+		pName := param.Name.(ast.Identifier).Name
+		if seen[pName] {
+			panic(fmt.Sprintf("Duplicate parameter name: %s", pName))
+		}
+		seen[pName] = true
+		pType := resolveTypeExpr(param.Type, fnTab)
+		fnTab.Table[pName] = pType
+	}
+	bodyType := typecheck(fd.Body, fnTab)
+	resultOf(retType, bodyType, fd.Body.GetLocation(), "Result of function "+fd.Name.(ast.Identifier).Name)
+}
+
+// unify makes got, the type of the expression at loc, the type want,
+// inferring the types the program leaves out. When the types conflict the
+// error also points at where the inferred types involved were decided.
+func unify(want utils.Type, got utils.Type, loc ast.Location, what string) {
+	if utils.Unify(want, got, loc) {
+		return
+	}
+	var notes []string
+	inferredAt(want, &notes)
+	inferredAt(got, &notes)
+	panic(fmt.Sprintf("%s at %s must be %v, got %v%s", what, loc.Position(), want, got, strings.Join(notes, "")))
+}
+
+// integer checks that t, the type of the expression at loc, is an integer
+// type. A type still to infer can only become one.
+func integer(t utils.Type, loc ast.Location, what string) {
+	if v, ok := utils.Prune(t).(*utils.Var); ok {
+		v.Integer = true
+		return
+	}
+	unify(&utils.Var{Integer: true}, t, loc, what)
+}
+
+// inferredAt notes where the types inferred in t were decided
+func inferredAt(t utils.Type, notes *[]string) {
+	switch tt := t.(type) {
+	case *utils.Var:
+		if tt.Bound == nil {
+			return
+		}
+		if tt.Name != "" {
+			*notes = append(*notes, fmt.Sprintf("; %s was inferred as %v at %s", tt.Name, tt.Bound, tt.BoundAt.Position()))
+		}
+		inferredAt(tt.Bound, notes)
+	case utils.Pointer:
+		inferredAt(tt.Elem, notes)
+	case utils.Array:
+		inferredAt(tt.Elem, notes)
+	case utils.Tuple:
+		for _, e := range tt.Elems {
+			inferredAt(e, notes)
+		}
+	case utils.Fun:
+		for _, p := range tt.Params {
+			inferredAt(p, notes)
+		}
+		inferredAt(tt.Res, notes)
+	}
+}
+
+// resultOf checks the type of the body of a function or lambda against its
+// result type. A body ending in a statement has type Unit and leaves the
+// result to return; without any return the result type is Unit.
+func resultOf(resType utils.Type, bodyType utils.Type, loc ast.Location, what string) {
+	if _, ok := utils.Prune(bodyType).(utils.Unit); !ok {
+		unify(resType, bodyType, loc, what)
+	} else if v, ok := utils.Prune(resType).(*utils.Var); ok && !v.Integer {
+		unify(resType, bodyType, loc, what)
+	}
+}
+
+// known returns the type t of expr stands for, which has to be known already:
+// there is no type to infer from the use because describes. An integer of
+// unknown type is an Int from then on.
+func known(t utils.Type, expr ast.Expression, because string) utils.Type {
+	t = utils.Prune(t)
+	if v, ok := t.(*utils.Var); ok && v.Integer {
+		utils.Unify(v, utils.Int{Name: "Int"}, expr.GetLocation())
+		return v.Bound
+	}
+	if _, ok := t.(*utils.Var); ok {
+		name := "the value"
+		if identifier, ok := expr.(ast.Identifier); ok {
+			name = identifier.Name
+		}
+		panic(fmt.Sprintf("The type of %s at %v must be known before %s, add a type annotation", name, expr.GetLocation(), because))
+	}
+	return t
+}
+
+// inferred returns the type to infer for the annotation the program leaves
+// out at loc. It is kept in the outermost scope under "__inferred__ <loc>",
+// so that Infer can write it into the program afterwards.
+func inferred(symTab *SymTab, loc ast.Location, name string) *utils.Var {
+	root := symTab
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	key := fmt.Sprintf("__inferred__ %v", loc)
+	if v, exists := root.Table[key]; exists {
+		return v.(*utils.Var)
+	}
+	v := &utils.Var{Name: name}
+	root.Table[key] = v
+	return v
+}
+
+// resultType resolves the result type of a function, or the type to infer
+// when the program leaves it out.
+func resultType(fd ast.FunctionDefinition, symTab *SymTab) utils.Type {
+	if fd.ResultType != nil {
+		return resolveTypeExpr(fd.ResultType, symTab)
+	}
+	return inferred(symTab, fd.Location, "the result of "+fd.Name.(ast.Identifier).Name)
+}
+
+// mentions reports whether t refers to the type parameter name
+func mentions(t utils.Type, name string) bool {
+	switch tt := t.(type) {
+	case utils.TypeParam:
+		return tt.Name == name
+	case utils.Pointer:
+		return mentions(tt.Elem, name)
+	case utils.Array:
+		return mentions(tt.Elem, name)
+	case utils.Tuple:
+		return slices.ContainsFunc(tt.Elems, func(e utils.Type) bool { return mentions(e, name) })
+	case utils.Fun:
+		return mentions(tt.Res, name) || slices.ContainsFunc(tt.Params, func(p utils.Type) bool { return mentions(p, name) })
+	}
+	return false
+}
+
+// typecheckMatch checks that every arm of a match names a variant of the
+// enum, binds all of its fields and has the type of the other arms, and that
+// together the arms cover every variant.
+func typecheckMatch(n ast.MatchExpression, symTab *SymTab) utils.Type {
+	value := known(typecheck(n.Value, symTab), n.Value, "it is matched")
+	enumType, ok := value.(utils.Enum)
+	if !ok {
+		panic(fmt.Sprintf("Cannot match on %v of type %v at %v", n.Value, value, n.Location))
+	}
+	covered := make([]bool, len(enumType.Variants))
+	wildcard := false
+	var result utils.Type
+	for _, a := range n.Arms {
+		arm := a.(ast.MatchArm)
+		if wildcard {
+			panic(fmt.Sprintf("Unreachable match arm at %v, _ already matched everything", arm.Location))
+		}
+		name := arm.Variant.(ast.Identifier).Name
+		tab := utils.NewSymTab(symTab)
+		if name == "_" {
+			if len(arm.Bindings) > 0 {
+				panic(fmt.Sprintf("_ cannot bind values at %v", arm.Location))
+			}
+			if !slices.Contains(covered, false) {
+				panic(fmt.Sprintf("Unreachable match arm at %v, every variant is already matched", arm.Location))
+			}
+			wildcard = true
+		} else {
+			tag, ok := enumType.Tag(name)
+			if !ok {
+				panic(fmt.Sprintf("Enum %s has no variant %s at %v", enumType.Name, name, arm.Location))
+			}
+			if covered[tag] {
+				panic(fmt.Sprintf("Variant %s is matched twice at %v", name, arm.Location))
+			}
+			covered[tag] = true
+			fields := enumType.Fields[tag]
+			if len(arm.Bindings) != len(fields) {
+				panic(fmt.Sprintf("Variant %s of %s has %d values, got %d names at %v",
+					name, enumType.Name, len(fields), len(arm.Bindings), arm.Location))
+			}
+			for i, b := range arm.Bindings {
+				binding := b.(ast.Identifier).Name
+				if binding == "_" {
+					continue
+				}
+				if _, exists := tab.Table[binding]; exists {
+					panic(fmt.Sprintf("Duplicate name %s in match arm at %v", binding, arm.Location))
+				}
+				tab.Table[binding] = fields[i]
+			}
+		}
+		body := typecheck(arm.Body, tab)
+		if result == nil {
+			result = body
+		} else {
+			unify(result, body, arm.Body.GetLocation(), "Match arm")
+		}
+	}
+	if !wildcard {
+		var missing []string
+		for tag, done := range covered {
+			if !done {
+				missing = append(missing, enumType.Variants[tag])
+			}
+		}
+		if len(missing) > 0 {
+			panic(fmt.Sprintf("Match at %v does not cover %s", n.Location, strings.Join(missing, ", ")))
+		}
+	}
+	return result
+}
+
+// loopScope returns the scope of a loop body. "__loop__" marks the scope of
+// every loop and "__loop__ <label>" a labeled one. Loops that only end with
+// break are marked "__endless__" and can break with a value.
+func loopScope(symTab *SymTab, label string, endless bool) *SymTab {
+	tab := utils.NewSymTab(symTab)
+	tab.Table["__loop__"] = utils.Unit{}
+	if label != "" {
+		tab.Table["__loop__ "+label] = utils.Unit{}
+	}
+	if endless {
+		tab.Table["__endless__"] = utils.Unit{}
+	}
+	return tab
+}
+
+// loopType is the type of the values the loop was left with, which the
+// breaks record in its scope under "__break__"
+func loopType(tab *SymTab) utils.Type {
+	if value, ok := tab.Table["__break__"]; ok {
+		return value
+	}
+	return utils.Unit{}
+}
+
+// findLoop returns the scope of the loop a break or continue leaves: the
+// innermost one, or the one with the label. Loops outside the enclosing
+// function or lambda cannot be reached.
+func findLoop(symTab *SymTab, label string, keyword string, loc ast.Location) *SymTab {
+	key := "__loop__"
+	if label != "" {
+		key += " " + label
+	}
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if _, ok := cur.Table[key]; ok {
+			return cur
+		}
+		if _, ok := cur.Table["__return_type__"]; ok {
+			break
+		}
+	}
+	if label != "" {
+		panic(fmt.Sprintf("%s at %v: no loop named %s", keyword, loc, label))
+	}
+	panic(fmt.Sprintf("%s outside of a loop at %v", keyword, loc))
+}
+
+// reserved rejects the names of functions that start with __, which the
+// compiler uses for its intrinsics and the runtime
+func reserved(name string, loc ast.Location) {
+	if strings.HasPrefix(name, "__") {
+		panic(fmt.Sprintf("The function name %s at %v is reserved, names starting with __ belong to the compiler", name, loc))
+	}
+}
+
+// typecheckTopLevel checks the top-level block of the program. Variables
+// declared directly in it are globals and go into the outermost scope, next
+// to the functions, so every function can use them.
+func typecheckTopLevel(node ast.Expression, symTab *SymTab) utils.Type {
+	block, ok := node.(ast.Block)
+	if !ok {
+		return typecheck(node, symTab)
+	}
+	for _, expr := range block.Expressions {
+		typecheck(expr, symTab)
+	}
+	return typecheck(block.Result, symTab)
+}
+
+// capturedByLambda reports whether name refers to a local variable from
+// outside the innermost lambda. Lambdas get copies of such variables, so they
+// cannot be assigned to. The outermost scope only holds functions and
+// globals.
+func capturedByLambda(symTab *SymTab, name string) bool {
+	inLambda := false
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if _, exists := cur.Table[name]; exists {
+			return inLambda && cur.Parent != nil
+		}
+		if _, exists := cur.Table["__lambda__"]; exists {
+			inLambda = true
+		}
+	}
+	return false
+}
+
+// declaredWith returns the keyword name is declared with when it cannot be
+// assigned to, val or const, and "" otherwise. The scope declaring such a
+// variable marks it "val <name>" or "const <name>".
+func declaredWith(symTab *SymTab, name string) string {
+	for cur := symTab; cur != nil; cur = cur.Parent {
+		if _, exists := cur.Table[name]; !exists {
+			continue
+		}
+		for _, kind := range []string{"val", "const"} {
+			if _, ok := cur.Table[kind+" "+name]; ok {
+				return kind
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// constant checks that the value of a const can be evaluated at compile time:
+// it is built from literals and other consts with operators.
+func constant(expr ast.Expression, symTab *SymTab) {
+	switch e := expr.(type) {
+	case ast.Literal, ast.BooleanLiteral:
+		return
+	case ast.Identifier:
+		if declaredWith(symTab, e.Name) == "const" {
+			return
+		}
+	case ast.Unary:
+		if e.Op == "-" || e.Op == "not" {
+			constant(e.Exp, symTab)
+			return
+		}
+	case ast.Cast:
+		constant(e.Value, symTab)
+		return
+	case ast.BinaryOp:
+		if e.Op != "=" {
+			constant(e.Left, symTab)
+			constant(e.Right, symTab)
+			return
+		}
+	}
+	panic(fmt.Sprintf("The value at %v is not known at compile time, a const can only use literals, other consts and operators", expr.GetLocation()))
+}
+
+// foldConstants evaluates the consts of the top-level block of a checked
+// program and writes their values in as literals, so every backend gets the
+// same values and a const that cannot be evaluated fails before the program
+// runs. Arithmetic wraps around like it does in the compiled code.
+func foldConstants(nodes ast.Expression) ast.Expression {
+	module, isModule := nodes.(ast.Module)
+	if isModule {
+		nodes = module.Block
+	}
+	block, ok := nodes.(ast.Block)
+	if !ok {
+		return foldConstant(nodes, map[string]any{})
+	}
+	values := map[string]any{}
+	expressions := make([]ast.Expression, len(block.Expressions))
+	for i, e := range block.Expressions {
+		expressions[i] = foldConstant(e, values)
+	}
+	block.Expressions = expressions
+	if block.Result != nil {
+		block.Result = foldConstant(block.Result, values)
+	}
+	if isModule {
+		module.Block = block
+		return module
+	}
+	return block
+}
+
+// foldConstant replaces the value of expr with a literal when it declares a
+// const, adding the value to values
+func foldConstant(expr ast.Expression, values map[string]any) ast.Expression {
+	decl, ok := expr.(ast.Declaration)
+	if !ok || decl.Kind != "const" {
+		return expr
+	}
+	value := evaluate(decl.Value, values)
+	values[decl.Variable.(ast.Identifier).Name] = value
+	loc := decl.Value.GetLocation()
+	if b, ok := value.(bool); ok {
+		decl.Value = ast.BooleanLiteral{Boolean: fmt.Sprint(b), Location: loc}
+		return decl
+	}
+	intType, word := utils.IntOf(value)
+	decl.Value = ast.Literal{Value: word, Location: loc}
+	if intType.Width() < 64 || intType.Unsigned {
+		decl.Value = ast.Cast{
+			Value:    decl.Value,
+			Type:     ast.Identifier{Name: intType.String(), Location: loc},
+			Location: loc,
+		}
+	}
+	return decl
+}
+
+// evaluate computes the value of a const, which constant has checked, as a
+// bool or a Go integer of the width and signedness of its type
+func evaluate(expr ast.Expression, values map[string]any) any {
+	switch e := expr.(type) {
+	case ast.Literal:
+		return int64(e.Value.(uint64))
+	case ast.BooleanLiteral:
+		return e.Boolean == "true"
+	case ast.Identifier:
+		return values[e.Name]
+	case ast.Cast:
+		_, word := utils.IntOf(evaluate(e.Value, values))
+		return utils.IntTypes[e.Type.(ast.Identifier).Name].Value(word)
+	case ast.Unary:
+		value := evaluate(e.Exp, values)
+		if b, ok := value.(bool); ok {
+			return !b
+		}
+		intType, _ := utils.IntOf(value)
+		return utils.IntOp("-", intType.Value(0), value)
+	case ast.BinaryOp:
+		left, right := evaluate(e.Left, values), evaluate(e.Right, values)
+		switch e.Op {
+		case "==":
+			return left == right
+		case "!=":
+			return left != right
+		case "and":
+			return left.(bool) && right.(bool)
+		case "or":
+			return left.(bool) || right.(bool)
+		case "/", "%":
+			if _, word := utils.IntOf(right); word == 0 {
+				panic(fmt.Sprintf("Division by zero in a const at %s", e.Right.GetLocation().Position()))
+			}
+		}
+		return utils.IntOp(e.Op, left, right)
+	}
+	panic(fmt.Sprintf("Cannot evaluate the const value at %s at compile time", expr.GetLocation().Position()))
+}
+
+func isDeref(expr ast.Expression) bool {
+	u, ok := expr.(ast.Unary)
+	return ok && u.Op == "*"
+}
+
 func Type(nodes ast.Expression) any {
+	res, _ := infer(nodes)
+	return res
+}
+
+// Infer type checks a program like Type and returns it with the types the
+// typechecker inferred written in: the result types of functions and lambdas
+// and the types of lambda parameters that the program leaves out. The later
+// stages rely on every type being written down.
+func Infer(nodes ast.Expression) ast.Expression {
+	_, annotated := infer(nodes)
+	return annotated
+}
+
+func infer(nodes ast.Expression) (utils.Type, ast.Expression) {
 	tab := utils.NewSymTab[utils.Type](nil)
 	tab.Table["print_int"] = utils.Fun{Params: []utils.Type{utils.Int{Name: "Int"}}, Res: utils.Unit{Name: "Unit"}}
 	tab.Table["print_bool"] = utils.Fun{Params: []utils.Type{utils.Bool{Name: "Bool"}}, Res: utils.Unit{Name: "Unit"}}
 	tab.Table["read_int"] = utils.Fun{Params: []utils.Type{}, Res: utils.Int{Name: "Int"}}
-	res := typecheck(nodes, tab)
-	return res
+	tab.Table["exit"] = utils.Fun{Params: []utils.Type{utils.Int{Name: "Int"}}, Res: utils.Unit{Name: "Unit"}}
+	tab.Table["gc_collect"] = utils.Fun{Params: []utils.Type{}, Res: utils.Unit{Name: "Unit"}}
+	tab.Table["print_string"] = utils.Fun{Params: []utils.Type{utils.String{Name: "String"}}, Res: utils.Unit{Name: "Unit"}}
+	tab.Table["concat"] = utils.Fun{
+		Params: []utils.Type{utils.String{Name: "String"}, utils.String{Name: "String"}},
+		Res:    utils.String{Name: "String"},
+	}
+	var res utils.Type
+	if _, ok := nodes.(ast.Module); ok {
+		res = typecheck(nodes, tab)
+	} else {
+		res = typecheckTopLevel(nodes, tab)
+	}
+	return defaulted(res), foldConstants(annotate(nodes, tab))
+}
+
+// defaulted returns t with the integers of unknown type in it made Int
+func defaulted(t utils.Type) utils.Type {
+	switch tt := utils.Prune(t).(type) {
+	case *utils.Var:
+		if tt.Integer {
+			tt.Bound = utils.Int{Name: "Int"}
+			return tt.Bound
+		}
+	case utils.Pointer:
+		defaulted(tt.Elem)
+	case utils.Array:
+		defaulted(tt.Elem)
+	case utils.Tuple:
+		for _, e := range tt.Elems {
+			defaulted(e)
+		}
+	case utils.Fun:
+		for _, p := range tt.Params {
+			defaulted(p)
+		}
+		defaulted(tt.Res)
+	}
+	return utils.Prune(t)
+}
+
+// annotate writes the types inferred for the annotations left out of expr
+// into it. The parameters come before the result, so a result that cannot be
+// inferred for lack of a parameter type reports the parameter.
+func annotate(expr ast.Expression, tab *SymTab) ast.Expression {
+	if expr == nil {
+		return nil
+	}
+	if param, ok := expr.(ast.Param); ok {
+		if param.Type == nil {
+			param.Type = inferredTypeExpr(tab, param.Location)
+		}
+		return param
+	}
+	if literal, ok := expr.(ast.Literal); ok {
+		return typedLiteral(literal, literal, false, tab)
+	}
+	if unary, ok := expr.(ast.Unary); ok && unary.Op == "-" {
+		if literal, ok := unary.Exp.(ast.Literal); ok {
+			return typedLiteral(unary, literal, true, tab)
+		}
+	}
+	expr = ast.Map(expr, func(child ast.Expression) ast.Expression {
+		return annotate(child, tab)
+	})
+	switch e := expr.(type) {
+	case ast.FunctionDefinition:
+		if e.ResultType == nil {
+			e.ResultType = inferredTypeExpr(tab, e.Location)
+		}
+		return e
+	case ast.Lambda:
+		if e.ResultType == nil {
+			e.ResultType = inferredTypeExpr(tab, e.Location)
+		}
+		return e
+	}
+	return expr
+}
+
+// typedLiteral checks that the integer literal, negated in expr when
+// negative is set, fits its type, and casts expr to the type unless it is
+// an Int
+func typedLiteral(expr ast.Expression, literal ast.Literal, negative bool, tab *SymTab) ast.Expression {
+	value, ok := literal.Value.(uint64)
+	if !ok {
+		return expr
+	}
+	v, ok := tab.Table[fmt.Sprintf("__inferred__ %v", literal.Location)].(*utils.Var)
+	if !ok {
+		return expr
+	}
+	intType, ok := defaulted(v).(utils.Int)
+	if !ok {
+		return expr
+	}
+	if !intType.Fits(value, negative) {
+		sign := ""
+		if negative {
+			sign = "-"
+		}
+		panic(fmt.Sprintf("The literal %s%d at %s does not fit %v", sign, value, literal.Location.Position(), intType))
+	}
+	if intType.Width() == 64 && !intType.Unsigned {
+		return expr
+	}
+	return ast.Cast{
+		Value:    expr,
+		Type:     ast.Identifier{Name: intType.String(), Location: literal.Location},
+		Location: literal.Location,
+	}
+}
+
+// inferredTypeExpr is the annotation for the type inferred at loc
+func inferredTypeExpr(tab *SymTab, loc ast.Location) ast.Expression {
+	v := tab.Table[fmt.Sprintf("__inferred__ %v", loc)].(*utils.Var)
+	return typeExpr(v, v.Name, loc)
+}
+
+// typeExpr writes t as a type annotation. name tells whose type t is when it
+// turns out not to be inferred.
+func typeExpr(t utils.Type, name string, loc ast.Location) ast.Expression {
+	switch tt := defaulted(t).(type) {
+	case *utils.Var:
+		panic(fmt.Sprintf("Cannot infer %s at %v, add a type annotation", name, loc))
+	case utils.Int:
+		return ast.Identifier{Name: tt.String(), Location: loc}
+	case utils.Bool:
+		return ast.Identifier{Name: "Bool", Location: loc}
+	case utils.String:
+		return ast.Identifier{Name: "String", Location: loc}
+	case utils.Unit:
+		return ast.Identifier{Name: "Unit", Location: loc}
+	case utils.Struct:
+		return ast.Identifier{Name: tt.Name, Location: loc}
+	case utils.Enum:
+		return ast.Identifier{Name: tt.Name, Location: loc}
+	case utils.TypeParam:
+		return ast.Identifier{Name: tt.Name, Location: loc}
+	case utils.Pointer:
+		return ast.PointerType{Elem: typeExpr(tt.Elem, name, loc), Location: loc}
+	case utils.Array:
+		return ast.ArrayType{Elem: typeExpr(tt.Elem, name, loc), Location: loc}
+	case utils.Tuple:
+		var elems []ast.Expression
+		for _, e := range tt.Elems {
+			elems = append(elems, typeExpr(e, name, loc))
+		}
+		return ast.TupleType{Elems: elems, Location: loc}
+	case utils.Fun:
+		var params []ast.Expression
+		for _, p := range tt.Params {
+			params = append(params, typeExpr(p, name, loc))
+		}
+		return ast.FunType{Params: params, ResType: typeExpr(tt.Res, name, loc), Location: loc}
+	}
+	panic(fmt.Sprintf("Cannot write the type %v of %s at %v", t, name, loc))
 }
@@ -5,6 +5,8 @@ import (
 	"compiler/parser"
 	"compiler/tokenizer"
 	"compiler/utils"
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -12,7 +14,7 @@ func TestTypecheck(t *testing.T) {
 	t.Run("IntegerLiteral returns Int", func(t *testing.T) {
 		literal := ast.Literal{Value: uint64(42)}
 		symTab := utils.NewSymTab[utils.Type](nil)
-		got := typecheck(literal, symTab)
+		got := defaulted(typecheck(literal, symTab))
 		if _, ok := got.(utils.Int); !ok {
 			t.Errorf("Expected Int type, got %T", got)
 		}
@@ -31,7 +33,7 @@ func TestTypecheck(t *testing.T) {
 		right := ast.Literal{Value: uint64(42)}
 		binaryOp := ast.BinaryOp{Left: left, Op: "+", Right: right}
 		symTab := utils.NewSymTab[utils.Type](nil)
-		got := typecheck(binaryOp, symTab)
+		got := defaulted(typecheck(binaryOp, symTab))
 		if _, ok := got.(utils.Int); !ok {
 			t.Errorf("Expected Int type, got %T", got)
 		}
@@ -267,6 +269,14 @@ func TestTypecheck(t *testing.T) {
 		}
 	})
 
+	t.Run("Unannotated function returning an integer literal", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun k() { return 5; }\nprint_int(k());\nk()", "")
+		got := Type(parser.Parse(tokens))
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int type, got %v", got)
+		}
+	})
+
 	t.Run("Function with early return and final return", func(t *testing.T) {
 		tokens := tokenizer.Tokenize(`
 			fun f(n: Int): Int {
@@ -395,4 +405,814 @@ func TestTypecheck(t *testing.T) {
 		}
 	})
 
+	t.Run("Extern function type checks", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			extern fun is_big(x: Int): Bool;
+			is_big(3)
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Bool); !ok {
+			t.Errorf("Expected Bool type, got %T", got)
+		}
+	})
+
+	t.Run("Extern function with Unit parameter should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			extern fun f(x: Unit): Int;
+			1
+		`, "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for Unit parameter")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Pointers type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun inc(p: Int*): Unit {
+				*p = *p + 1;
+			}
+			var x = 1;
+			var p: Int* = &x;
+			inc(p);
+			var b: Bool** = new Bool*(new Bool(true));
+			delete b;
+			*p
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int type, got %T", got)
+		}
+	})
+
+	t.Run("Dereferencing an Int should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var x = 1; *x", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for dereferencing an Int")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Pointer type mismatch should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var x = true; var p: Int* = &x; 1", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for Bool* assigned to Int*")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Arrays type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun first(a: Array[Bool]): Bool {
+				return a[0];
+			}
+			var a: Array[Int] = new Array[Int](3);
+			a[1] = len(a);
+			var m = [a, [1, 2]];
+			if first([true]) then { m[0][1] } else { 0 }
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int type, got %T", got)
+		}
+	})
+
+	t.Run("Mixed array elements should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var a = [1, true]; 1", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for an array of Int and Bool")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Bool index should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var a = [1, 2]; a[true]", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for indexing with a Bool")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Structs type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			struct Pair { left: Int, right: Bool }
+			struct Box { pair: Pair }
+			fun left(b: Box): Int {
+				return b.pair.left;
+			}
+			var b: Box = Box { pair: Pair { right: true, left: 1 } };
+			b.pair.left = 2;
+			if b.pair.right then { left(b) } else { 0 }
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int type, got %T", got)
+		}
+	})
+
+	t.Run("Missing struct field should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("struct Pair { left: Int, right: Int }\nvar p = Pair { left: 1 }; 1", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for a missing field")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Unknown struct field should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("struct Pair { left: Int }\nvar p = Pair { left: 1 }; p.right", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for an unknown field")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Strings type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			var s: String = concat("a", "b");
+			print_string(s);
+			s == "ab" and len(s) == 2
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Bool); !ok {
+			t.Errorf("Expected Bool type, got %T", got)
+		}
+	})
+
+	t.Run("Concatenating an Int should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`concat("a", 1)`, "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for concat of a String and an Int")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Closures type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun adder(n: Int): (Int) => Int {
+				fun(x: Int): Int { x + n }
+			}
+			fun twice(f: (Int) => Int, x: Int): Int {
+				f(f(x))
+			}
+			var k = 2;
+			var scale = fun(x: Int) { x * k };
+			twice(adder(1), scale(3)) + adder(2)(1)
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int type, got %T", got)
+		}
+	})
+
+	t.Run("Passing a function of the wrong type should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun twice(f: (Int) => Int, x: Int): Int {
+				f(f(x))
+			}
+			twice(print_bool, 1)
+		`, "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for a (Bool) => Unit argument")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Assigning a captured variable should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun f(): Unit { var n = 1; var inc = fun() { n = n + 1 }; inc() }\nf()", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for assigning a captured variable")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Globals are visible from functions and lambdas", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun get(): Int { n }\nvar n = 1; var inc = fun() { n = n + 1 }; inc(); get()", "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int, got %v", got)
+		}
+	})
+
+	t.Run("Redeclaring a global should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var n = 1; var n = 2;", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for redeclaring a global")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("For loop variables are local to the loop", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var i = true; for i in 0..3 do { print_int(i) }; i", "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Bool); !ok {
+			t.Errorf("Expected the outer i to stay Bool, got %v", got)
+		}
+	})
+
+	t.Run("For loop condition must be Bool", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("for (var i = 0; i; i = i + 1) { print_int(i) }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for an Int condition")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Break with a value gives the loop its type", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var i = 0; outer: while true do { while i < 5 do { i = i + 1; if i == 3 then { break outer i * 2 } } }", "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int, got %v", got)
+		}
+	})
+
+	t.Run("Break with a value from a loop with a condition should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var i = 0; while i < 3 do { break 1 }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for a loop that can end without a value")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Breaks with different types should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("while true do { if true then { break 1 } else { break true } }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for breaks with Int and Bool")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Break in a lambda cannot leave the loop around it", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("while true do { var f = fun() { break }; f() }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for break outside of a loop")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Comparing functions should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var f = print_int; f == print_int", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for comparing functions")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Enums and match type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			enum Shape { Circle(Int), Rect(Int, Int), Empty }
+			fun area(s: Shape): Int {
+				match s { Circle(r) => r * r, Rect(w, h) => w * h, Empty => 0 }
+			}
+			var s: Shape = Shape.Empty;
+			s = Shape.Rect(2, 3);
+			area(s) + match Shape.Circle(1) { Circle(_) => 1, _ => 0 }
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int type, got %T", got)
+		}
+	})
+
+	t.Run("Tuples type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun divmod(a: Int, b: Int): (Int, Int) { (a / b, a % b) }
+			var (q, r) = divmod(7, 2);
+			var p: (Int, (Bool, String)) = (q, (true, "x"));
+			p.1
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		expected := utils.Tuple{Elems: []utils.Type{utils.Bool{Name: "Bool"}, utils.String{Name: "String"}}}
+		if !utils.SameType(got.(utils.Type), expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+	})
+
+	t.Run("Destructuring the wrong number of elements should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var (a, b, c) = (1, 2);", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for 3 names and 2 elements")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A tuple element out of range should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var t = (1, true); t.2", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for t.2")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Generic functions type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun swap[A, B](p: (A, B)): (B, A) { (p.1, p.0) }
+			fun apply[T, R](f: (T) => R, x: T): R { f(x) }
+			var n: Int = apply(fun(x: Int): Int { x + 1 }, 1);
+			swap((n, true))
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		expected := utils.Tuple{Elems: []utils.Type{utils.Bool{Name: "Bool"}, utils.Int{Name: "Int"}}}
+		if !utils.SameType(got.(utils.Type), expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+	})
+
+	t.Run("Arguments giving a type parameter two types should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun first[T](a: T, b: T): T { a }\nfirst(1, true)", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for T being Int and Bool")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A type parameter only in the result should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun make[T](n: Int): Array[T] { new Array[T](n) }\nmake(3)", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for T that cannot be inferred")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A generic function used as a value should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun id[T](x: T): T { x }\nvar f = id;", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for id without a call")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A generic function using its parameter as an Int should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun inc[T](x: T): T { x + 1 }\ninc(1)", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for T + Int")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Result types and lambda parameter types are inferred", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun twice(f: (Int) => Int, x: Int) { f(f(x)) }
+			fun double(x: Int) { x * 2 }
+			var inc = fun(x) { x + 1 };
+			(twice(inc, double(3)), fun(b) { not b }(true))
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		expected := utils.Tuple{Elems: []utils.Type{utils.Int{Name: "Int"}, utils.Bool{Name: "Bool"}}}
+		if !utils.SameType(got.(utils.Type), expected) {
+			t.Errorf("Expected %v, got %v", expected, got)
+		}
+	})
+
+	t.Run("Inferred types are written into the program", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun half(x: Int) { x / 2 }
+			fun(p) { *p + half(1) }
+		`, "")
+		mod := Infer(parser.Parse(tokens)).(ast.Module)
+		half := mod.Functions[0].(ast.FunctionDefinition)
+		if fmt.Sprint(half.ResultType) != fmt.Sprint(ast.Identifier{Name: "Int", Location: half.Location}) {
+			t.Errorf("Expected result type Int, got %v", half.ResultType)
+		}
+		lambda := mod.Block.(ast.Block).Result.(ast.Lambda)
+		param := lambda.Params[0].(ast.Param)
+		if ptr, ok := param.Type.(ast.PointerType); !ok || ptr.Elem.(ast.Identifier).Name != "Int" {
+			t.Errorf("Expected parameter type Int*, got %v", param.Type)
+		}
+		if lambda.ResultType.(ast.Identifier).Name != "Int" {
+			t.Errorf("Expected result type Int, got %v", lambda.ResultType)
+		}
+	})
+
+	t.Run("Conflicting uses of an inferred type should fail at both", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`var k = fun(x) {
+			print_string(x);
+			x + 1
+		};`, "")
+		res := parser.Parse(tokens)
+		defer func() {
+			r := recover()
+			message := fmt.Sprint(r)
+			use := tokenizer.SourceLocation{Line: 3, Column: 4}.Position()
+			inferred := tokenizer.SourceLocation{Line: 2, Column: 17}.Position()
+			if !strings.Contains(message, use) || !strings.Contains(message, inferred) {
+				t.Errorf("Expected an error at %v and %v, got %v", use, inferred, r)
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A parameter type that nothing decides should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var id = fun(x) { x };", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for the type of x")
+			}
+		}()
+		Infer(res)
+	})
+
+	t.Run("Using a field of a value of unknown type should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("struct P { x: Int } var f = fun(p) { p.x };", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for p.x")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("val and const type check", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun limit(x: Int): Int { if x > MAX then { MAX } else { x } }
+			const MAX = 10 * 10;
+			const ON = MAX > 50 and true;
+			val (a, b) = (limit(500), ON);
+			val total = a + 1;
+			{ var total = 2; total = total + a; total }
+		`, "")
+		res := parser.Parse(tokens)
+		got := Type(res)
+		if _, ok := got.(utils.Int); !ok {
+			t.Errorf("Expected Int, got %v", got)
+		}
+	})
+
+	t.Run("Assigning to a val should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("val x = 1; x = 2", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for x = 2")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Assigning to a const in a function should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun reset(): Unit { N = 0; } const N = 3;", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for N = 0")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Taking the address of a val should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("val x = 1; var p = &x;", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for &x")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A const using a variable should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var n = 2; const N = n + 1;", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for a const using n")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A const outside the top-level block should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun f(): Int { const N = 1; N }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for a const in a function")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A const dividing by zero should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("print_int(1); const Z = 1 / 0;", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); fmt.Sprint(r) != "Division by zero in a const at 1:29" {
+				t.Errorf("Expected panic for a const dividing by zero, got %v", r)
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Consts are folded into literals", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			const N = 2 * 3;
+			const S: UInt8 = 250 as UInt8 + 10 as UInt8;
+			const ON = not (N == 6);
+			N
+		`, "")
+		block := Infer(parser.Parse(tokens)).(ast.Block)
+		values := []string{}
+		for _, e := range block.Expressions {
+			switch v := e.(ast.Declaration).Value.(type) {
+			case ast.Literal:
+				values = append(values, fmt.Sprint(v.Value))
+			case ast.Cast:
+				values = append(values, fmt.Sprintf("%v as %s", v.Value.(ast.Literal).Value, v.Type.(ast.Identifier).Name))
+			case ast.BooleanLiteral:
+				values = append(values, v.Boolean)
+			default:
+				t.Errorf("Expected a folded const, got %T", v)
+			}
+		}
+		if fmt.Sprint(values) != "[6 4 as UInt8 false]" {
+			t.Errorf("Expected [6 4 as UInt8 false], got %v", values)
+		}
+	})
+
+	t.Run("A match that misses a variant should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("enum Shape { Circle(Int), Rect(Int, Int), Empty }\nmatch Shape.Empty { Circle(r) => r, Empty => 0 }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for a match without Rect")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("A match with the wrong number of bindings should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("enum Shape { Circle(Int), Rect(Int, Int), Empty }\nmatch Shape.Empty { Circle(r) => r, Rect(w) => w, Empty => 0 }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for Rect(w)")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("If branches with different types should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var x = if true then 1 else false;", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for branches of type Int and Bool")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("If branches with the same type", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("if 1 < 2 then { 3 } else { 4 }", "")
+		if got := Type(parser.Parse(tokens)); fmt.Sprint(got) != "Int" {
+			t.Errorf("Expected Int, got %v", got)
+		}
+	})
+
+	t.Run("Match arms with different types should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("enum Shape { Circle(Int), Rect(Int, Int), Empty }\nmatch Shape.Empty { Circle(r) => r, Rect(w, h) => true, Empty => 0 }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for arms of type Int and Bool")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("An arm after _ should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("enum Shape { Circle(Int), Rect(Int, Int), Empty }\nmatch Shape.Empty { _ => 0, Circle(r) => r }", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for an unreachable arm")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Building a variant with the wrong values should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("enum Shape { Circle(Int), Empty }\nShape.Circle(true)", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for Shape.Circle(true)")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Literals take the integer type they are used as", func(t *testing.T) {
+		tokens := tokenizer.Tokenize(`
+			fun low(x: UInt8): UInt8 { x % 16 }
+			var a: Int8 = -128;
+			var b = low(200) + 1;
+			var c = 300;
+			(a as Int) + (b as Int) + c
+		`, "")
+		res := Infer(parser.Parse(tokens))
+		block := res.(ast.Module).Block.(ast.Block)
+		decl := block.Expressions[0].(ast.Declaration)
+		cast, ok := decl.Value.(ast.Cast)
+		if !ok || cast.Type.(ast.Identifier).Name != "Int8" {
+			t.Errorf("Expected -128 to be cast to Int8, got %v", decl.Value)
+		}
+		if decl := block.Expressions[2].(ast.Declaration); decl.Value != (ast.Literal{Value: uint64(300), Location: decl.Value.GetLocation()}) {
+			t.Errorf("Expected 300 to stay an Int literal, got %v", decl.Value)
+		}
+		if got := Type(parser.Parse(tokens)); got != (utils.Int{Name: "Int"}) {
+			t.Errorf("Expected Int, got %v", got)
+		}
+	})
+
+	t.Run("Mixing integer types should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var a: UInt8 = 1; var b: Int8 = 2; a + b", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "must be UInt8, got Int8") {
+				t.Errorf("Expected a mismatch of UInt8 and Int8, got %v", r)
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Type errors name the types and positions as written", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("fun f(p: Int*): Unit { p; }\nvar g: (Bool) => Unit = f;", "types.src")
+		res := parser.Parse(tokens)
+		defer func() {
+			expected := "Value of g at types.src:2:25 must be (Bool) => Unit, got (Int*) => Unit"
+			if r := recover(); fmt.Sprint(r) != expected {
+				t.Errorf("Expected %q, got %v", expected, r)
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Casts of other types than integers should fail", func(t *testing.T) {
+		for source, expected := range map[string]string{
+			"true as Int":          "Cannot cast a value of type Bool at 1:6, only integers can be cast",
+			"1 as Bool":            "Cannot cast to Bool at 1:3, only to integer types",
+			"var u: UInt8 = 1; -u": "Cannot negate a value of unsigned type UInt8 at 1:20",
+		} {
+			func() {
+				defer func() {
+					if r := recover(); fmt.Sprint(r) != expected {
+						t.Errorf("Expected %q for %s, got %v", expected, source, r)
+					}
+				}()
+				Type(parser.Parse(tokenizer.Tokenize(source, "")))
+			}()
+		}
+	})
+
+	t.Run("Function values with more than five parameters should fail", func(t *testing.T) {
+		add6 := "fun add6(a: Int, b: Int, c: Int, d: Int, e: Int, f: Int): Int { a + b + c + d + e + f }\n"
+		for source, expected := range map[string]string{
+			add6 + "var g = add6;":                                       "add6 at 2:9 takes 6 parameters, a function value can take at most 5",
+			"var g = fun(a, b, c, d, e, f) { a };":                       "Lambda at 1:9 takes 6 parameters, a function value can take at most 5",
+			"fun h(g: (Int, Int, Int, Int, Int, Int) => Int): Int { 0 }": "Function type at 1:10 takes 6 parameters, a function value can take at most 5",
+			"fun(g) { g(1, 2, 3, 4, 5, 6) }":                             "Called value at 1:10 takes 6 parameters, a function value can take at most 5",
+		} {
+			func() {
+				defer func() {
+					if r := recover(); fmt.Sprint(r) != expected {
+						t.Errorf("Expected %q for %s, got %v", expected, source, r)
+					}
+				}()
+				Type(parser.Parse(tokenizer.Tokenize(source, "")))
+			}()
+		}
+		// Calling the function directly passes every argument in a register
+		Type(parser.Parse(tokenizer.Tokenize(add6+"add6(1, 2, 3, 4, 5, 6)", "")))
+	})
+
+	t.Run("A literal out of the range of its type should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var a: Int8 = 1; a = -129", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "-129 at 1:23 does not fit Int8") {
+				t.Errorf("Expected -129 not to fit Int8, got %v", r)
+			}
+		}()
+		Infer(res)
+	})
+
+	t.Run("Negating an unsigned integer should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("var a: UInt32 = 1; -a", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for -a")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Casting a value that is not an integer should fail", func(t *testing.T) {
+		tokens := tokenizer.Tokenize("true as Int8", "")
+		res := parser.Parse(tokens)
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("Expected panic for true as Int8")
+			}
+		}()
+		Type(res)
+	})
+
+	t.Run("Function names starting with __ should fail", func(t *testing.T) {
+		for _, source := range []string{
+			"fun __c_bool(x: Int): Bool { x > 0 }\n__c_bool(1)",
+			"extern fun __free(p: Int): Int;\n__free(0)",
+		} {
+			func() {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("Expected panic for the reserved name in %q", source)
+					}
+				}()
+				Type(parser.Parse(tokenizer.Tokenize(source, "")))
+			}()
+		}
+	})
 }
@@ -1,21 +1,179 @@
 package utils
 
+import (
+	"compiler/tokenizer"
+	"fmt"
+	"strings"
+)
+
 type Type interface {
 	isType()
 }
 
+// Int is an integer type. Int itself is signed and 64 bits wide, the same
+// type as Int64; Int8 to Int32 and UInt8 to UInt64 name the others. Values
+// of every integer type take a 64 bit word, sign or zero extended from their
+// Bits, and arithmetic wraps around at their width.
 type Int struct {
 	Name string
+	// Bits is the width of the type, 0 for the 64 bits of Int
+	Bits     int
+	Unsigned bool
 }
 
 func (Int) isType() {}
 
+func (t Int) String() string {
+	if t.Width() == 64 && !t.Unsigned {
+		return "Int"
+	}
+	if t.Unsigned {
+		return fmt.Sprintf("UInt%d", t.Width())
+	}
+	return fmt.Sprintf("Int%d", t.Width())
+}
+
+// Width is the number of bits of the type
+func (t Int) Width() int {
+	if t.Bits == 0 {
+		return 64
+	}
+	return t.Bits
+}
+
+// IntTypes are the integer types by name
+var IntTypes = map[string]Int{
+	"Int":    {Name: "Int"},
+	"Int8":   {Name: "Int8", Bits: 8},
+	"Int16":  {Name: "Int16", Bits: 16},
+	"Int32":  {Name: "Int32", Bits: 32},
+	"Int64":  {Name: "Int"},
+	"UInt8":  {Name: "UInt8", Bits: 8, Unsigned: true},
+	"UInt16": {Name: "UInt16", Bits: 16, Unsigned: true},
+	"UInt32": {Name: "UInt32", Bits: 32, Unsigned: true},
+	"UInt64": {Name: "UInt64", Bits: 64, Unsigned: true},
+}
+
+// Value converts a 64 bit word to the value of type t it holds, keeping the
+// low bits. The value is a Go integer of the same width and signedness, so
+// arithmetic on it wraps around like the compiled code: int8 for Int8 and
+// int64 for Int.
+func (t Int) Value(word uint64) any {
+	switch {
+	case t.Unsigned && t.Width() == 8:
+		return uint8(word)
+	case t.Unsigned && t.Width() == 16:
+		return uint16(word)
+	case t.Unsigned && t.Width() == 32:
+		return uint32(word)
+	case t.Unsigned:
+		return word
+	case t.Width() == 8:
+		return int8(word)
+	case t.Width() == 16:
+		return int16(word)
+	case t.Width() == 32:
+		return int32(word)
+	}
+	return int64(word)
+}
+
+// Fits reports whether the integer n, negated when negative is set, is a
+// value of type t
+func (t Int) Fits(n uint64, negative bool) bool {
+	if negative {
+		return !t.Unsigned && n <= 1<<(t.Width()-1)
+	}
+	if t.Unsigned {
+		return t.Width() == 64 || n < 1<<t.Width()
+	}
+	return n < 1<<(t.Width()-1)
+}
+
+// IntOf returns the type of an integer value made by Value and the 64 bit
+// word holding it
+func IntOf(value any) (Int, uint64) {
+	switch v := value.(type) {
+	case int8:
+		return IntTypes["Int8"], uint64(v)
+	case int16:
+		return IntTypes["Int16"], uint64(v)
+	case int32:
+		return IntTypes["Int32"], uint64(v)
+	case int64:
+		return IntTypes["Int"], uint64(v)
+	case uint8:
+		return IntTypes["UInt8"], uint64(v)
+	case uint16:
+		return IntTypes["UInt16"], uint64(v)
+	case uint32:
+		return IntTypes["UInt32"], uint64(v)
+	case uint64:
+		return IntTypes["UInt64"], v
+	}
+	panic(fmt.Sprintf("%v is not an integer", value))
+}
+
+// IntOp applies the arithmetic or comparison operator op to two integer
+// values of the same type. Signed division rounds towards zero and the
+// results wrap around, as in the compiled code. The divisor of / and % must
+// not be zero.
+func IntOp(op string, a any, b any) any {
+	switch x := a.(type) {
+	case int8:
+		return intOp(op, x, b.(int8))
+	case int16:
+		return intOp(op, x, b.(int16))
+	case int32:
+		return intOp(op, x, b.(int32))
+	case int64:
+		return intOp(op, x, b.(int64))
+	case uint8:
+		return intOp(op, x, b.(uint8))
+	case uint16:
+		return intOp(op, x, b.(uint16))
+	case uint32:
+		return intOp(op, x, b.(uint32))
+	case uint64:
+		return intOp(op, x, b.(uint64))
+	}
+	panic(fmt.Sprintf("%v is not an integer", a))
+}
+
+func intOp[T int8 | int16 | int32 | int64 | uint8 | uint16 | uint32 | uint64](op string, a T, b T) any {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	case "%":
+		return a % b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	panic(fmt.Sprintf("Unknown integer operator %s", op))
+}
+
 type Bool struct {
 	Name string
 }
 
 func (Bool) isType() {}
 
+func (Bool) String() string {
+	return "Bool"
+}
+
 type Fun struct {
 	Params []Type
 	Res    Type
@@ -23,12 +181,458 @@ type Fun struct {
 
 func (Fun) isType() {}
 
+func (f Fun) String() string {
+	params := make([]string, len(f.Params))
+	for i, p := range f.Params {
+		params[i] = fmt.Sprint(p)
+	}
+	return "(" + strings.Join(params, ", ") + ") => " + fmt.Sprint(f.Res)
+}
+
+// String is an immutable sequence of bytes
+type String struct {
+	Name string
+}
+
+func (String) isType() {}
+
+func (String) String() string {
+	return "String"
+}
+
+// Pointer is the type of the address of a value of type Elem: Int*
+type Pointer struct {
+	Elem Type
+}
+
+func (Pointer) isType() {}
+
+func (p Pointer) String() string {
+	return fmt.Sprint(p.Elem) + "*"
+}
+
+// Array is a heap allocated array of Elem values: Array[Int]
+type Array struct {
+	Elem Type
+}
+
+func (Array) isType() {}
+
+func (a Array) String() string {
+	return "Array[" + fmt.Sprint(a.Elem) + "]"
+}
+
+// Struct is a user defined record type. Every use of the type shares the
+// layout of its definition, so struct types are equal when they come from
+// the same definition.
+type Struct struct {
+	*StructLayout
+}
+
+func (Struct) isType() {}
+
+func (s Struct) String() string {
+	return s.Name
+}
+
+// StructLayout places the fields of a struct in memory: every field takes one
+// 8 byte word, in declaration order. The interpreter and the backends all
+// find fields through it.
+type StructLayout struct {
+	Name   string
+	Fields []string
+	Types  []Type
+}
+
+// Offset returns the byte offset of field, or false if there is no such
+// field.
+func (l *StructLayout) Offset(field string) (int, bool) {
+	for i, name := range l.Fields {
+		if name == field {
+			return i * 8, true
+		}
+	}
+	return 0, false
+}
+
+// FieldType returns the type of a field known to exist.
+func (l *StructLayout) FieldType(field string) Type {
+	offset, _ := l.Offset(field)
+	return l.Types[offset/8]
+}
+
+// Size is the number of bytes a value of the struct takes.
+func (l *StructLayout) Size() int {
+	return len(l.Fields) * 8
+}
+
+// Enum is a tagged union: enum Shape { Circle(Int), Rect(Int, Int) }. Like
+// structs, enum types are equal when they come from the same definition.
+type Enum struct {
+	*EnumLayout
+}
+
+func (Enum) isType() {}
+
+func (e Enum) String() string {
+	return e.Name
+}
+
+// EnumLayout places the values of an enum in memory: a heap record whose
+// first word is the tag, the index of the variant, followed by one 8 byte
+// word for each field of the variant.
+type EnumLayout struct {
+	Name     string
+	Variants []string
+	Fields   [][]Type
+}
+
+// Tag returns the tag of variant, or false if there is no such variant.
+func (l *EnumLayout) Tag(variant string) (int, bool) {
+	for i, name := range l.Variants {
+		if name == variant {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Offset is the byte offset of field i of a variant.
+func (l *EnumLayout) Offset(i int) int {
+	return (i + 1) * 8
+}
+
+// Tuple is an immutable record of Elems: (Int, Bool). Like a struct it is a
+// heap record with one 8 byte word per element, but since it cannot change
+// sharing the record behaves like copying the elements.
+type Tuple struct {
+	Elems []Type
+}
+
+func (Tuple) isType() {}
+
+func (t Tuple) String() string {
+	elems := make([]string, len(t.Elems))
+	for i, e := range t.Elems {
+		elems[i] = fmt.Sprint(e)
+	}
+	return "(" + strings.Join(elems, ", ") + ")"
+}
+
 type Unit struct {
 	Name string
 }
 
 func (Unit) isType() {}
 
+func (Unit) String() string {
+	return "Unit"
+}
+
+// TypeParam is a type parameter of a generic function, T in
+// fun id[T](x: T): T. In the body of the function it is a type of its own.
+type TypeParam struct {
+	Name string
+}
+
+func (TypeParam) isType() {}
+
+func (t TypeParam) String() string {
+	return t.Name
+}
+
+// Generic is the type of a generic function. Every call infers the types its
+// TypeParams stand for from the arguments.
+type Generic struct {
+	TypeParams []string
+	Fun        Fun
+}
+
+func (Generic) isType() {}
+
+func (g Generic) String() string {
+	return "[" + strings.Join(g.TypeParams, ", ") + "] " + g.Fun.String()
+}
+
+// Var is a type the typechecker infers, such as the type of a lambda
+// parameter without an annotation. Unify binds it to the type it has to be
+// and records where that was decided.
+type Var struct {
+	// Name tells what the type belongs to, such as "the type of parameter
+	// x", empty for the parts of other types the typechecker makes up
+	Name    string
+	Bound   Type
+	BoundAt tokenizer.SourceLocation
+	// Infer, when set, checks the code that decides the type. The result
+	// type of a function that is needed before the typechecker gets to the
+	// body of the function is inferred this way.
+	Infer func()
+	// Integer restricts the Var to the integer types. The type of an
+	// integer literal is such a Var, which is Int unless the literal is used
+	// as another integer type.
+	Integer bool
+}
+
+func (*Var) isType() {}
+
+func (v *Var) String() string {
+	if v.Bound != nil {
+		return fmt.Sprint(v.Bound)
+	}
+	if v.Integer {
+		return "integer"
+	}
+	return "?"
+}
+
+// Prune follows bound Vars to the type they stand for.
+func Prune(t Type) Type {
+	for {
+		v, ok := t.(*Var)
+		if !ok || v.Bound == nil {
+			return t
+		}
+		t = v.Bound
+	}
+}
+
+// Unify makes a and b the same type by binding the Vars in them at loc. It
+// reports false when they cannot be the same, possibly having bound some
+// Vars already.
+func Unify(a Type, b Type, loc tokenizer.SourceLocation) bool {
+	a, b = Prune(a), Prune(b)
+	if av, ok := a.(*Var); ok {
+		if av == b {
+			return true
+		}
+		// A type cannot contain itself
+		if occurs(av, b) {
+			return false
+		}
+		if av.Integer {
+			switch bt := b.(type) {
+			case *Var:
+				if !bt.Integer {
+					// The restricted Var stays unbound
+					bt.Bound = av
+					bt.BoundAt = loc
+					return true
+				}
+			case Int:
+			default:
+				return false
+			}
+		}
+		av.Bound = b
+		av.BoundAt = loc
+		return true
+	}
+	if _, ok := b.(*Var); ok {
+		return Unify(b, a, loc)
+	}
+	switch at := a.(type) {
+	case Pointer:
+		bt, ok := b.(Pointer)
+		return ok && Unify(at.Elem, bt.Elem, loc)
+	case Array:
+		bt, ok := b.(Array)
+		return ok && Unify(at.Elem, bt.Elem, loc)
+	case Tuple:
+		bt, ok := b.(Tuple)
+		if !ok || len(at.Elems) != len(bt.Elems) {
+			return false
+		}
+		for i := range at.Elems {
+			if !Unify(at.Elems[i], bt.Elems[i], loc) {
+				return false
+			}
+		}
+		return true
+	case Fun:
+		bt, ok := b.(Fun)
+		if !ok || len(at.Params) != len(bt.Params) {
+			return false
+		}
+		for i := range at.Params {
+			if !Unify(at.Params[i], bt.Params[i], loc) {
+				return false
+			}
+		}
+		return Unify(at.Res, bt.Res, loc)
+	}
+	return SameType(a, b)
+}
+
+// occurs reports whether the Var v is part of t
+func occurs(v *Var, t Type) bool {
+	switch tt := Prune(t).(type) {
+	case *Var:
+		return tt == v
+	case Pointer:
+		return occurs(v, tt.Elem)
+	case Array:
+		return occurs(v, tt.Elem)
+	case Tuple:
+		for _, e := range tt.Elems {
+			if occurs(v, e) {
+				return true
+			}
+		}
+	case Fun:
+		for _, p := range tt.Params {
+			if occurs(v, p) {
+				return true
+			}
+		}
+		return occurs(v, tt.Res)
+	}
+	return false
+}
+
+// Bind matches arg against param, a type that can mention type parameters,
+// recording in bindings the type each type parameter stands for. It reports
+// whether arg fits param.
+func Bind(param Type, arg Type, bindings map[string]Type) bool {
+	arg = Prune(arg)
+	switch pt := param.(type) {
+	case TypeParam:
+		if bound, ok := bindings[pt.Name]; ok {
+			return SameType(bound, arg)
+		}
+		bindings[pt.Name] = arg
+		return true
+	case Pointer:
+		at, ok := arg.(Pointer)
+		return ok && Bind(pt.Elem, at.Elem, bindings)
+	case Array:
+		at, ok := arg.(Array)
+		return ok && Bind(pt.Elem, at.Elem, bindings)
+	case Tuple:
+		at, ok := arg.(Tuple)
+		if !ok || len(pt.Elems) != len(at.Elems) {
+			return false
+		}
+		for i := range pt.Elems {
+			if !Bind(pt.Elems[i], at.Elems[i], bindings) {
+				return false
+			}
+		}
+		return true
+	case Fun:
+		at, ok := arg.(Fun)
+		if !ok || len(pt.Params) != len(at.Params) {
+			return false
+		}
+		for i := range pt.Params {
+			if !Bind(pt.Params[i], at.Params[i], bindings) {
+				return false
+			}
+		}
+		return Bind(pt.Res, at.Res, bindings)
+	}
+	return SameType(param, arg)
+}
+
+// Substitute replaces the type parameters in t with the types bindings gives
+// them.
+func Substitute(t Type, bindings map[string]Type) Type {
+	t = Prune(t)
+	switch tt := t.(type) {
+	case TypeParam:
+		if bound, ok := bindings[tt.Name]; ok {
+			return bound
+		}
+	case Pointer:
+		return Pointer{Elem: Substitute(tt.Elem, bindings)}
+	case Array:
+		return Array{Elem: Substitute(tt.Elem, bindings)}
+	case Tuple:
+		elems := make([]Type, len(tt.Elems))
+		for i, e := range tt.Elems {
+			elems[i] = Substitute(e, bindings)
+		}
+		return Tuple{Elems: elems}
+	case Fun:
+		params := make([]Type, len(tt.Params))
+		for i, p := range tt.Params {
+			params[i] = Substitute(p, bindings)
+		}
+		return Fun{Params: params, Res: Substitute(tt.Res, bindings)}
+	}
+	return t
+}
+
+// SameType reports whether a and b are the same type. Function, pointer,
+// array and tuple types are compared by their parts, since a Fun cannot be
+// compared with ==. A Var is the type it is bound to; an unbound one is only
+// the same as itself.
+func SameType(a Type, b Type) bool {
+	a, b = Prune(a), Prune(b)
+	switch at := a.(type) {
+	case *Var:
+		return at == b
+	case Int:
+		bt, ok := b.(Int)
+		return ok && at.Width() == bt.Width() && at.Unsigned == bt.Unsigned
+	case Bool:
+		_, ok := b.(Bool)
+		return ok
+	case String:
+		_, ok := b.(String)
+		return ok
+	case Unit:
+		_, ok := b.(Unit)
+		return ok
+	case TypeParam:
+		bt, ok := b.(TypeParam)
+		return ok && at.Name == bt.Name
+	case Pointer:
+		bt, ok := b.(Pointer)
+		return ok && SameType(at.Elem, bt.Elem)
+	case Array:
+		bt, ok := b.(Array)
+		return ok && SameType(at.Elem, bt.Elem)
+	case Struct:
+		bt, ok := b.(Struct)
+		return ok && at.StructLayout == bt.StructLayout
+	case Enum:
+		bt, ok := b.(Enum)
+		return ok && at.EnumLayout == bt.EnumLayout
+	case Tuple:
+		bt, ok := b.(Tuple)
+		if !ok || len(at.Elems) != len(bt.Elems) {
+			return false
+		}
+		for i := range at.Elems {
+			if !SameType(at.Elems[i], bt.Elems[i]) {
+				return false
+			}
+		}
+		return true
+	case Fun:
+		bt, ok := b.(Fun)
+		if !ok || len(at.Params) != len(bt.Params) || !SameType(at.Res, bt.Res) {
+			return false
+		}
+		for i := range at.Params {
+			if !SameType(at.Params[i], bt.Params[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Runtime error codes shared by the interpreter and the stdlib's
+// __runtime_error routine. The code is also the exit status of the program.
+const (
+	RuntimeErrorDivisionByZero  = 3
+	RuntimeErrorOverflow        = 4
+	RuntimeErrorOutOfMemory     = 5
+	RuntimeErrorIndexOutOfRange = 6
+)
+
 type SymTab[T any] struct {
 	Parent *SymTab[T]
 	Table  map[string]T